@@ -4,97 +4,289 @@
 package loxilib
 
 import (
+	"container/heap"
+	"container/list"
 	"errors"
+	"sort"
 )
 
 // Counter - context container
+// Counters are handed out in FIFO order - first the ones which were never used
+// in ascending order, followed by the returned ones in the order they were returned.
+// Only returned or reserved counters consume memory, so the counter space can be
+// as large as a uint64 allows
 type Counter struct {
-	begin    uint64
-	end      uint64
-	start    uint64
-	len      uint64
-	cap      uint64
-	counters []uint64
+	begin   uint64
+	len     uint64
+	cap     uint64
+	next    uint64
+	ahead   map[uint64]struct{}
+	free    *list.List
+	freeMap map[uint64]*list.Element
+	low     *counterHeap
+}
+
+// counterHeap - Min-heap of returned counters. It may hold counters which were
+// handed out again, these are skipped when they come up
+type counterHeap []uint64
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h counterHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *counterHeap) Push(x interface{}) {
+	*h = append(*h, x.(uint64))
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 // NewCounter - Allocate a set of counters
 func NewCounter(begin uint64, length uint64) *Counter {
 	counter := new(Counter)
-	counter.counters = make([]uint64, length)
 	counter.begin = begin
-	counter.start = 0
-	counter.end = length - 1
 	counter.len = length
 	counter.cap = length
-	for i := uint64(0); i < length; i++ {
-		counter.counters[i] = i + 1
-	}
-	counter.counters[length-1] = ^uint64(0)
+	counter.next = 0
+	counter.ahead = make(map[uint64]struct{})
+	counter.free = list.New()
+	counter.freeMap = make(map[uint64]*list.Element)
 	return counter
 }
 
 // GetCounter - Get next available counter
 func (C *Counter) GetCounter() (uint64, error) {
-	if C.cap <= 0 || C.start == ^uint64(0) {
+	if C.cap <= 0 {
 		return ^uint64(0), errors.New("Overflow")
 	}
 
-	C.cap--
-	var rid = C.start
-	if C.start == C.end {
-		C.start = ^uint64(0)
-	} else {
-		C.start = C.counters[rid]
-		C.counters[rid] = ^uint64(0)
+	for C.next < C.len {
+		rid := C.next
+		C.next++
+		if _, ok := C.ahead[rid]; ok {
+			// Reserved before it could be handed out
+			delete(C.ahead, rid)
+			continue
+		}
+		C.cap--
+		return rid + C.begin, nil
 	}
+
+	e := C.free.Front()
+	if e == nil {
+		return ^uint64(0), errors.New("Overflow")
+	}
+	rid := C.free.Remove(e).(uint64)
+	delete(C.freeMap, rid)
+	C.cap--
 	return rid + C.begin, nil
 }
 
 // PutCounter - Return a counter to the available list
 func (C *Counter) PutCounter(id uint64) error {
-	if id < C.begin || id >= C.begin+C.len {
+	if id < C.begin || id-C.begin >= C.len {
 		return errors.New("Range")
 	}
 	rid := id - C.begin
-	var tmp = C.end
-	C.end = rid
-	C.counters[tmp] = rid
-	C.cap++
-	if C.start == ^uint64(0) {
-		C.start = C.end
+	if rid >= C.next {
+		if _, ok := C.ahead[rid]; !ok {
+			return errors.New("Not allocated")
+		}
+		delete(C.ahead, rid)
+	} else {
+		if _, ok := C.freeMap[rid]; ok {
+			return errors.New("Not allocated")
+		}
+		C.freeMap[rid] = C.free.PushBack(rid)
+		if C.low != nil {
+			if C.low.Len() > 2*len(C.freeMap)+64 {
+				C.buildLow()
+			} else {
+				heap.Push(C.low, rid)
+			}
+		}
 	}
+	C.cap++
 	return nil
 }
 
+// buildLow - Build the heap of returned counters
+func (C *Counter) buildLow() {
+	low := make(counterHeap, 0, len(C.freeMap))
+	for rid := range C.freeMap {
+		low = append(low, rid)
+	}
+	heap.Init(&low)
+	C.low = &low
+}
+
+// GetLowestCounter - Get the lowest available counter
+func (C *Counter) GetLowestCounter() (uint64, error) {
+	if C.cap <= 0 {
+		return ^uint64(0), errors.New("Overflow")
+	}
+
+	if C.low == nil {
+		C.buildLow()
+	}
+
+	// Returned counters are always below the ones never handed out
+	for C.low.Len() > 0 {
+		rid := heap.Pop(C.low).(uint64)
+		if e, ok := C.freeMap[rid]; ok {
+			C.free.Remove(e)
+			delete(C.freeMap, rid)
+			C.cap--
+			return rid + C.begin, nil
+		}
+	}
+
+	return C.GetCounter()
+}
+
 // ReserveCounter - Don't allocate this counter
 func (C *Counter) ReserveCounter(id uint64) error {
-	if id < C.begin || id >= C.begin+C.len {
+	if id < C.begin || id-C.begin >= C.len {
 		return errors.New("Range")
 	}
 
-	if C.cap <= 0 || C.start == ^uint64(0) {
+	if C.cap <= 0 {
 		return errors.New("Overflow")
 	}
 
 	rid := id - C.begin
-	if C.counters[rid] == ^uint64(0) {
-		return errors.New("Already exists")
+	if rid >= C.next {
+		if _, ok := C.ahead[rid]; ok {
+			return errors.New("Already exists")
+		}
+		C.ahead[rid] = struct{}{}
+	} else {
+		e, ok := C.freeMap[rid]
+		if !ok {
+			return errors.New("Already exists")
+		}
+		C.free.Remove(e)
+		delete(C.freeMap, rid)
 	}
+	C.cap--
 
-	for i := uint64(0); i < C.len; i++ {
-		if C.counters[i] == rid {
-			C.counters[i] = C.counters[rid]
-		}
+	return nil
+}
+
+// takeCounter - Take a counter the way GetCounter hands it out if it is the
+// next one GetCounter would return, else reserve it
+func (C *Counter) takeCounter(id uint64) error {
+	if id < C.begin || id-C.begin >= C.len {
+		return errors.New("Range")
 	}
 
-	if C.start == rid {
-		C.start = C.counters[rid]
+	rid := id - C.begin
+	if _, ok := C.ahead[rid]; ok || rid < C.next || C.cap <= 0 {
+		return C.ReserveCounter(id)
+	}
+	for n := C.next; n < rid; n++ {
+		if _, ok := C.ahead[n]; !ok {
+			return C.ReserveCounter(id)
+		}
 	}
-	if C.end == rid {
-		C.end = C.counters[rid]
+
+	for ; C.next < rid; C.next++ {
+		delete(C.ahead, C.next)
 	}
-	C.counters[rid] = ^uint64(0)
+	C.next++
 	C.cap--
 
 	return nil
 }
+
+// CounterSize - Get the total number of counters
+func (C *Counter) CounterSize() uint64 {
+	return C.len
+}
+
+// CounterFree - Get the number of counters available for allocation
+func (C *Counter) CounterFree() uint64 {
+	return C.cap
+}
+
+// getState - Get the counters in use in ascending order, the returned counters
+// in the order they will be reused and the first counter never handed out yet
+func (C *Counter) getState() ([]uint64, []uint64, uint64) {
+	var used []uint64
+	var free []uint64
+
+	for rid := uint64(0); rid < C.next; rid++ {
+		if _, ok := C.freeMap[rid]; !ok {
+			used = append(used, rid+C.begin)
+		}
+	}
+
+	ahead := make([]uint64, 0, len(C.ahead))
+	for rid := range C.ahead {
+		ahead = append(ahead, rid+C.begin)
+	}
+	sort.Slice(ahead, func(i, j int) bool { return ahead[i] < ahead[j] })
+	used = append(used, ahead...)
+
+	for e := C.free.Front(); e != nil; e = e.Next() {
+		free = append(free, e.Value.(uint64)+C.begin)
+	}
+
+	return used, free, C.next + C.begin
+}
+
+// setState - Restore the counter state as returned by getState
+func (C *Counter) setState(used []uint64, free []uint64, next uint64) error {
+	if next < C.begin || next-C.begin > C.len {
+		return errors.New("Range")
+	}
+
+	C.next = next - C.begin
+	C.low = nil
+	C.ahead = make(map[uint64]struct{})
+	C.free = list.New()
+	C.freeMap = make(map[uint64]*list.Element)
+
+	for _, id := range free {
+		if id < C.begin || id-C.begin >= C.next {
+			return errors.New("Range")
+		}
+		rid := id - C.begin
+		if _, ok := C.freeMap[rid]; ok {
+			return errors.New("Already exists")
+		}
+		C.freeMap[rid] = C.free.PushBack(rid)
+	}
+
+	nUsed := uint64(0)
+	seen := make(map[uint64]struct{})
+	for _, id := range used {
+		if id < C.begin || id-C.begin >= C.len {
+			return errors.New("Range")
+		}
+		rid := id - C.begin
+		if _, ok := seen[rid]; ok {
+			return errors.New("Already exists")
+		}
+		seen[rid] = struct{}{}
+		if rid >= C.next {
+			C.ahead[rid] = struct{}{}
+		} else if _, ok := C.freeMap[rid]; ok {
+			return errors.New("Already exists")
+		} else {
+			nUsed++
+		}
+	}
+
+	// Every counter handed out so far must be either in use or returned
+	if nUsed+uint64(len(C.freeMap)) != C.next {
+		return errors.New("Inconsistent")
+	}
+
+	C.cap = C.len - nUsed - uint64(len(C.ahead))
+	return nil
+}
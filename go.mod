@@ -2,9 +2,9 @@ module github.com/loxilb-io/loxilib
 
 go 1.23.0
 
+require golang.org/x/sys v0.8.0 // indirect
+
 require (
-	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
+	github.com/loxilb-io/sctp v0.0.0-20241217032220-301b591b9ced
+	golang.org/x/net v0.10.0
 )
-
-require github.com/loxilb-io/sctp v0.0.0-20241217032220-301b591b9ced
@@ -0,0 +1,334 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// IDPoolNoIdent - Ident of IDs which are not shared
+const IDPoolNoIdent = ""
+
+// ID pool error kinds, which are the Kind of an IDPoolError
+var (
+	ErrIDPoolInvalidInput  = errors.New("idpool invalid input")
+	ErrIDPoolNotFound      = errors.New("idpool pool not found")
+	ErrIDPoolExists        = errors.New("idpool pool exists")
+	ErrIDPoolInUse         = errors.New("idpool pool in use")
+	ErrIDPoolExhausted     = errors.New("idpool pool exhausted")
+	ErrIDPoolOutOfBounds   = errors.New("idpool id out of bounds")
+	ErrIDPoolIDInUse       = errors.New("idpool id in use")
+	ErrIDPoolIDNotAlloc    = errors.New("idpool id not allocated")
+	ErrIDPoolIdentExists   = errors.New("idpool ident exists")
+	ErrIDPoolIdentNotFound = errors.New("idpool ident not found")
+)
+
+// IDPoolError - Error of the ID pool manager, which matches its ErrIDPool Kind with errors.Is.
+// HasID tells if ID is set, as zero is a valid ID
+type IDPoolError struct {
+	Kind  error
+	Msg   string
+	Pool  string
+	Ident string
+	ID    uint64
+	HasID bool
+}
+
+// Error - Get the error message along with the pool, ID and ident it is about
+func (e *IDPoolError) Error() string {
+	id := ""
+	if e.HasID {
+		id = strconv.FormatUint(e.ID, 10)
+	}
+	return errContext(e.Msg, "pool", e.Pool, "id", id, "ident", e.Ident)
+}
+
+// Unwrap - Get the ErrIDPool kind of the error
+func (e *IDPoolError) Unwrap() error {
+	return e.Kind
+}
+
+// IDPool - Named pool of numeric IDs like rule IDs, VNIs, VLAN tags or marks
+// An ident holds at most one ID, which ReserveID can take further references to,
+// while every allocation without an ident gets an ID of its own
+type IDPool struct {
+	mtx    sync.Mutex
+	name   string
+	begin  uint64
+	length uint64
+	freeID *Counter
+	ident  map[string]uint64
+	users  map[uint64]map[string]int
+}
+
+// IDPoolManager - Manager of named ID pools
+type IDPoolManager struct {
+	mtx   sync.RWMutex
+	pools map[string]*IDPool
+}
+
+// IDPoolInfo - Allocation totals of an ID pool
+type IDPoolInfo struct {
+	Name  string
+	Begin uint64
+	Size  uint64
+	Used  uint64
+	Free  uint64
+}
+
+// IDAllocInfo - Information about an allocated ID
+// Idents maps the idents holding the ID to their refcounts.
+// An allocation made without an ident is listed as IDPoolNoIdent
+type IDAllocInfo struct {
+	ID     uint64
+	Idents map[string]int
+}
+
+// IDPoolManagerNew - Create a new ID pool manager
+func IDPoolManagerNew() *IDPoolManager {
+	idm := new(IDPoolManager)
+	idm.pools = make(map[string]*IDPool)
+	return idm
+}
+
+// AddIDPool - Add a new pool of length IDs starting at begin
+func (idm *IDPoolManager) AddIDPool(name string, begin uint64, length uint64) error {
+	if name == "" || length == 0 || begin+length-1 < begin {
+		return &IDPoolError{Kind: ErrIDPoolInvalidInput, Msg: "invalid id pool", Pool: name}
+	}
+
+	idm.mtx.Lock()
+	defer idm.mtx.Unlock()
+
+	if idm.pools[name] != nil {
+		return &IDPoolError{Kind: ErrIDPoolExists, Msg: "id pool exists", Pool: name}
+	}
+
+	idp := new(IDPool)
+	idp.name = name
+	idp.begin = begin
+	idp.length = length
+	idp.freeID = NewCounter(begin, length)
+	idp.ident = make(map[string]uint64)
+	idp.users = make(map[uint64]map[string]int)
+	idm.pools[name] = idp
+
+	return nil
+}
+
+// DeleteIDPool - Delete a pool. A pool which still has IDs allocated is not deleted
+func (idm *IDPoolManager) DeleteIDPool(name string) error {
+	idm.mtx.Lock()
+	defer idm.mtx.Unlock()
+
+	idp := idm.pools[name]
+	if idp == nil {
+		return &IDPoolError{Kind: ErrIDPoolNotFound, Msg: "no such id pool", Pool: name}
+	}
+
+	idp.mtx.Lock()
+	defer idp.mtx.Unlock()
+
+	if len(idp.users) != 0 {
+		return &IDPoolError{Kind: ErrIDPoolInUse, Msg: "id pool in use", Pool: name}
+	}
+	delete(idm.pools, name)
+
+	return nil
+}
+
+// getIDPool - Find a pool and lock it for update.
+// A successful call must be paired with a call to putIDPool
+func (idm *IDPoolManager) getIDPool(name string) (*IDPool, error) {
+	idm.mtx.RLock()
+	idp := idm.pools[name]
+	if idp == nil {
+		idm.mtx.RUnlock()
+		return nil, &IDPoolError{Kind: ErrIDPoolNotFound, Msg: "no such id pool", Pool: name}
+	}
+	idp.mtx.Lock()
+
+	return idp, nil
+}
+
+// putIDPool - Release the locks taken by getIDPool
+func (idm *IDPoolManager) putIDPool(idp *IDPool) {
+	idp.mtx.Unlock()
+	idm.mtx.RUnlock()
+}
+
+// AllocateID - Allocate an ID from a pool. Like IPAllocator, it fails with
+// ErrIDPoolIdentExists if the ident already holds an ID of the pool
+func (idm *IDPoolManager) AllocateID(name string, idString string) (uint64, error) {
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return 0, err
+	}
+	defer idm.putIDPool(idp)
+
+	if id, ok := idp.ident[idString]; ok && idString != IDPoolNoIdent {
+		return 0, &IDPoolError{Kind: ErrIDPoolIdentExists, Msg: "ident holds an id", Pool: name, Ident: idString, ID: id, HasID: true}
+	}
+
+	id, err := idp.freeID.GetCounter()
+	if err != nil {
+		return 0, &IDPoolError{Kind: ErrIDPoolExhausted, Msg: "id pool exhausted", Pool: name, Ident: idString}
+	}
+	idp.addRef(idString, id)
+
+	return id, nil
+}
+
+// ReserveID - Don't allocate this ID from a pool and account it to the ident.
+// Reserving the ID an ident already holds bumps its refcount
+func (idm *IDPoolManager) ReserveID(name string, idString string, id uint64) error {
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return err
+	}
+	defer idm.putIDPool(idp)
+
+	if id < idp.begin || id-idp.begin >= idp.length {
+		return &IDPoolError{Kind: ErrIDPoolOutOfBounds, Msg: "id out of pool bounds", Pool: name, ID: id, HasID: true}
+	}
+
+	if cur, ok := idp.ident[idString]; ok && idString != IDPoolNoIdent {
+		if cur != id {
+			return &IDPoolError{Kind: ErrIDPoolIdentExists, Msg: "ident holds another id", Pool: name, Ident: idString, ID: cur, HasID: true}
+		}
+		idp.users[id][idString]++
+		return nil
+	}
+
+	if err := idp.freeID.ReserveCounter(id); err != nil {
+		return &IDPoolError{Kind: ErrIDPoolIDInUse, Msg: "id in use", Pool: name, ID: id, HasID: true}
+	}
+	idp.addRef(idString, id)
+
+	return nil
+}
+
+// ReleaseID - Drop a reference of the ident to an ID of a pool. The ID is returned
+// to the pool once it has no references left
+func (idm *IDPoolManager) ReleaseID(name string, idString string, id uint64) error {
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return err
+	}
+	defer idm.putIDPool(idp)
+
+	refs := idp.users[id]
+	if refs[idString] == 0 {
+		if refs == nil {
+			return &IDPoolError{Kind: ErrIDPoolIDNotAlloc, Msg: "id not allocated", Pool: name, ID: id, HasID: true}
+		}
+		return &IDPoolError{Kind: ErrIDPoolIdentNotFound, Msg: "ident does not hold id", Pool: name, Ident: idString, ID: id, HasID: true}
+	}
+
+	refs[idString]--
+	if refs[idString] > 0 {
+		return nil
+	}
+	delete(refs, idString)
+	if idString != IDPoolNoIdent {
+		delete(idp.ident, idString)
+	}
+	if len(refs) > 0 {
+		return nil
+	}
+	delete(idp.users, id)
+
+	if err := idp.freeID.PutCounter(id); err != nil {
+		return &IDPoolError{Kind: ErrIDPoolIDNotAlloc, Msg: "id put counter failure", Pool: name, ID: id, HasID: true}
+	}
+	return nil
+}
+
+// addRef - Account a reference of an ident to an ID. Caller must hold idp.mtx
+func (idp *IDPool) addRef(idString string, id uint64) {
+	if idp.users[id] == nil {
+		idp.users[id] = make(map[string]int)
+	}
+	idp.users[id][idString]++
+	if idString != IDPoolNoIdent {
+		idp.ident[idString] = id
+	}
+}
+
+// info - Get the allocation totals of the pool. Caller must hold idp.mtx
+func (idp *IDPool) info() IDPoolInfo {
+	free := idp.freeID.CounterFree()
+	return IDPoolInfo{Name: idp.name, Begin: idp.begin, Size: idp.length, Used: idp.length - free, Free: free}
+}
+
+// GetIDPoolInfo - Get the allocation totals of a pool
+func (idm *IDPoolManager) GetIDPoolInfo(name string) (IDPoolInfo, error) {
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return IDPoolInfo{}, err
+	}
+	defer idm.putIDPool(idp)
+
+	return idp.info(), nil
+}
+
+// ListIDPools - Get the allocation totals of all pools sorted by name
+func (idm *IDPoolManager) ListIDPools() []IDPoolInfo {
+	idm.mtx.RLock()
+	defer idm.mtx.RUnlock()
+
+	infos := make([]IDPoolInfo, 0, len(idm.pools))
+	for _, idp := range idm.pools {
+		idp.mtx.Lock()
+		infos = append(infos, idp.info())
+		idp.mtx.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos
+}
+
+// ListIDs - Get the IDs allocated from a pool in ascending order
+func (idm *IDPoolManager) ListIDs(name string) ([]IDAllocInfo, error) {
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return nil, err
+	}
+	defer idm.putIDPool(idp)
+
+	ids := make([]IDAllocInfo, 0, len(idp.users))
+	for id, refs := range idp.users {
+		idents := make(map[string]int, len(refs))
+		for idString, n := range refs {
+			idents[idString] = n
+		}
+		ids = append(ids, IDAllocInfo{ID: id, Idents: idents})
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].ID < ids[j].ID })
+
+	return ids, nil
+}
+
+// LookupIdent - Get the ID an ident holds in a pool along with its refcount
+func (idm *IDPoolManager) LookupIdent(name string, idString string) (uint64, int, error) {
+	if idString == IDPoolNoIdent {
+		return 0, 0, &IDPoolError{Kind: ErrIDPoolInvalidInput, Msg: "empty ident", Pool: name}
+	}
+
+	idp, err := idm.getIDPool(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer idm.putIDPool(idp)
+
+	id, ok := idp.ident[idString]
+	if !ok {
+		return 0, 0, &IDPoolError{Kind: ErrIDPoolIdentNotFound, Msg: "ident not found", Pool: name, Ident: idString}
+	}
+
+	return id, idp.users[id][idString], nil
+}
@@ -4,11 +4,17 @@
 package loxilib
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math/bits"
 	"net"
+	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Constants
@@ -34,411 +40,768 @@ func MakeIPAMIdent(name string, id uint32, proto string) string {
 	return fmt.Sprintf("%s|%d|%s", name, id, lowerProto)
 }
 
+// ParseIPAMIdent - Get the name, id and proto of an identifier made with MakeIPAMIdent
+func ParseIPAMIdent(ident string) (string, uint32, string, error) {
+	p := strings.LastIndex(ident, "|")
+	if p < 0 {
+		return "", 0, "", &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam ident", Ident: ident}
+	}
+	n := strings.LastIndex(ident[:p], "|")
+	if n < 0 {
+		return "", 0, "", &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam ident", Ident: ident}
+	}
+
+	id, err := strconv.ParseUint(ident[n+1:p], 10, 32)
+	if err != nil {
+		return "", 0, "", &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam ident id", Ident: ident}
+	}
+
+	return ident[:n], uint32(id), ident[p+1:], nil
+}
+
 // IPRange - Defines an IPRange
 type IPRange struct {
-	isRange bool
-	startIP net.IP
-	endIP   net.IP
-	ipNet   net.IPNet
-	freeID  *Counter
-	fOK     bool
-	first   uint64
-	ident   map[IdentKey]int
+	mtx      sync.Mutex
+	rng      IPAMRange
+	isRange  bool
+	startIP  net.IP
+	endIP    net.IP
+	ipNet    net.IPNet
+	freeID   *Counter
+	fOK      bool
+	first    uint64
+	ident    map[IdentKey]int
+	identIdx map[IdentKey]uint64
+	prio     int
+	seq      uint64
+	excl     map[string][]ipExclusion
+	held     map[uint64]struct{}
+	users    map[uint64]int
+	lease    map[IdentKey]time.Time
+	sharing  IPAMSharing
+	strategy IPAMStrategy
+	wmark    int
+	quar     map[uint64]struct{}
 }
 
 // IPClusterPool - Holds IP ranges for a cluster
 type IPClusterPool struct {
+	mtx  sync.RWMutex
 	name string
 	pool map[string]*IPRange
+	seq  uint64
 }
 
 // IPAllocator - Main IP allocator context
 type IPAllocator struct {
-	ipBlocks map[string]*IPClusterPool
+	mtx       sync.RWMutex
+	ipBlocks  map[string]*IPClusterPool
+	clock     func() time.Time
+	leaseHook IPAMLeaseExpiryHook
+	xOverlap  bool
+	conflict  IPAMConflictChecker
+	evHook    IPAMEventHook
+	wmarks    []float64
+	wmHyst    float64
+	smtx      sync.RWMutex
+	skeys     map[string]*sync.Mutex
+	store     IPAMStore
+	storeVer  map[string]uint64
+	storePart bool
+	journal   *ipamJournal
 }
 
-func addIPIndex(ip net.IP, index uint64) net.IP {
-	retIP := ip
+// ipToU128 - Convert an IP address in its 4 or 16 byte form to a 128-bit integer
+func ipToU128(ip net.IP) (uint64, uint64) {
+	var hi, lo uint64
+
+	for i := 0; i < len(ip); i++ {
+		hi = hi<<8 | lo>>56
+		lo = lo<<8 | uint64(ip[i])
+	}
+	return hi, lo
+}
 
-	v := index
-	c := uint64(0)
-	arrIndex := len(ip) - 1
+// u128ToIP - Convert a 128-bit integer to an IP address of the given length
+func u128ToIP(hi, lo uint64, iplen int) net.IP {
+	ip := make(net.IP, iplen)
 
-	for i := 0; i < IP6Len && arrIndex >= 0 && v > 0; i++ {
-		c = v / 255
-		retIP[arrIndex] += uint8((v + c) % 255)
-		arrIndex--
-		v >>= 8
+	for i := iplen - 1; i >= 0; i-- {
+		ip[i] = uint8(lo)
+		lo = lo>>8 | hi<<56
+		hi >>= 8
 	}
+	return ip
+}
+
+// addIPIndex - Get the IP address which is index addresses away from ip.
+// The returned IP has the same length as ip, which is left unmodified
+func addIPIndex(ip net.IP, index uint64) net.IP {
+	hi, lo := ipToU128(ip)
+
+	lo, carry := bits.Add64(lo, index, 0)
+	hi += carry
 
-	return retIP
+	return u128ToIP(hi, lo, len(ip))
 }
 
+// diffIPIndex - Get the index of IP relative to baseIP. It returns ^uint64(0) if
+// the addresses are of different families, IP is below baseIP or too far from it
 func diffIPIndex(baseIP net.IP, IP net.IP) uint64 {
-	index := uint64(0)
-	iplen := 0
-
 	if baseIP == nil || IP == nil {
 		return ^uint64(0)
 	}
 
-	if IsNetIPv4(baseIP.String()) {
-		iplen = IP4Len
-	} else {
-		iplen = IP6Len
+	if (baseIP.To4() == nil) != (IP.To4() == nil) {
+		return ^uint64(0)
+	}
+
+	bhi, blo := ipToU128(baseIP.To16())
+	hi, lo := ipToU128(IP.To16())
+
+	lo, borrow := bits.Sub64(lo, blo, 0)
+	hi, borrow = bits.Sub64(hi, bhi, borrow)
+	if borrow != 0 || hi != 0 {
+		return ^uint64(0)
 	}
 
-	arrIndex := len(baseIP) - iplen
-	arrIndex1 := len(IP) - iplen
+	return lo
+}
 
-	for i := 0; i < IP6Len && arrIndex < len(baseIP) && arrIndex1 < len(IP); i++ {
+// getIPRange - Find a range of a cluster by its canonical key and lock it for update.
+// The allocator and the cluster pool are only read-locked while the range is
+// in use, so operations on other ranges or clusters can proceed in parallel.
+// A successful call must be paired with a call to putIPRange
+func (ipa *IPAllocator) getIPRange(cluster string, cidr string) (*IPClusterPool, *IPRange, error) {
+	ipa.mtx.RLock()
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		ipa.mtx.RUnlock()
+		return nil, nil, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster, Range: cidr}
+	}
 
-		basev := uint8(baseIP[arrIndex])
-		ipv := uint8(IP[arrIndex1])
+	ipCPool.mtx.RLock()
+	ipr := ipCPool.pool[cidr]
+	if ipr == nil {
+		ipCPool.mtx.RUnlock()
+		ipa.mtx.RUnlock()
+		return nil, nil, &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, Range: cidr}
+	}
+	ipr.mtx.Lock()
 
-		if basev > ipv {
-			return ^uint64(0)
-		}
+	return ipCPool, ipr, nil
+}
+
+// getIPRangeAdd - Find a range of a cluster and lock it for update like getIPRange.
+// A missing cluster is created along with the range and the range added event is
+// queued to evs
+func (ipa *IPAllocator) getIPRangeAdd(cluster string, r IPAMRange, cidr string, evs *ipamEvents) (*IPClusterPool, *IPRange, error) {
+	ipa.mtx.RLock()
+	ipCPool := ipa.ipBlocks[cluster]
+	ipa.mtx.RUnlock()
 
-		index = uint64(ipv - basev)
-		arrIndex++
-		arrIndex1++
-		index |= index << (8 * (iplen - i - 1))
+	if ipCPool == nil {
+		if err := ipa.addIPRange(cluster, r, cidr, evs); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return index
+	return ipa.getIPRange(cluster, cidr)
+}
+
+// putIPRange - Release the locks taken by getIPRange
+func (ipa *IPAllocator) putIPRange(ipCPool *IPClusterPool, ipr *IPRange) {
+	ipr.mtx.Unlock()
+	ipCPool.mtx.RUnlock()
+	ipa.mtx.RUnlock()
 }
 
 // ReserveIP - Don't allocate this IP address/ID pair from the given cluster and CIDR range
 // If id is empty, a new IP address will be allocated else IP addresses will be shared and
 // it will be same as the first IP address allocted for this range
 func (ipa *IPAllocator) ReserveIP(cluster string, cidr string, idString string, IPString string) error {
-	var ipCPool *IPClusterPool
-	var ipr *IPRange
-	var baseIP net.IP
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return err
+	}
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return err
+	}
+	return ipa.ReserveAddr(cluster, r, idString, addr)
+}
+
+// ReserveAddr - Don't allocate this IP address/ID pair from the given cluster and range
+func (ipa *IPAllocator) ReserveAddr(cluster string, r IPAMRange, idString string, addr netip.Addr) (err error) {
+	cidr := r.String()
+
+	evs := ipa.newEvents()
+	defer evs.emit()
 
-	_, ipn, err := net.ParseCIDR(cidr)
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalReserve, Cluster: cluster, Range: cidr, Ident: idString, IP: addr.String()})
 	if err != nil {
-		if strings.Contains(cidr, "-") {
-			ipBlock := strings.Split(cidr, "-")
-			if len(ipBlock) != 2 {
-				return errors.New("invalid ip-range")
-			}
+		return err
+	}
+	defer func() { err = jo.done(err) }()
 
-			startIP := net.ParseIP(ipBlock[0])
-			lastIP := net.ParseIP(ipBlock[1])
-			if startIP == nil || lastIP == nil {
-				return errors.New("invalid ip-range ips")
-			}
-			if IsNetIPv4(startIP.String()) && IsNetIPv6(lastIP.String()) ||
-				IsNetIPv6(startIP.String()) && IsNetIPv4(lastIP.String()) {
-				return errors.New("invalid ip-types ips")
-			}
-		} else {
-			return errors.New("invalid CIDR")
-		}
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.ReserveAddr(cluster, r, idString, addr)
+	}); ok {
+		return err
 	}
 
-	IP := net.ParseIP(IPString)
-	if IP == nil {
-		return errors.New("invalid IP String")
+	if err := checkIPAMRange(r); err != nil {
+		return err
+	}
+	if err := checkIPAMAddr(addr); err != nil {
+		return err
 	}
+	IP := ipamNetIP(addr)
 
-	if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-		if err := ipa.AddIPRange(cluster, cidr); err != nil {
-			return errors.New("no such IP Cluster Pool")
-		}
-		if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-			return errors.New("ip range allocation failure")
-		}
+	ipCPool, ipr, err := ipa.getIPRangeAdd(cluster, r, cidr, evs)
+	if err != nil {
+		return err
 	}
+	defer ipa.putIPRange(ipCPool, ipr)
 
-	if ipr = ipCPool.pool[cidr]; ipr == nil {
-		return errors.New("no such IP Range")
+	if err := ipr.reserveIP(idString, IP, false); err != nil {
+		return ipamContext(err, cluster, cidr)
 	}
+	evs.ipEvent(IPAMEventAllocate, cluster, cidr, ipr, idString, IP)
 
-	if ipr.isRange {
-		baseIP = ipr.startIP
-		d1 := diffIPIndex(ipr.startIP, ipr.endIP)
-		d2 := diffIPIndex(ipr.startIP, IP)
-		if d2 > d1 {
-			return errors.New("ip string out of range-bounds")
-		}
-	} else {
-		baseIP = ipr.ipNet.IP
-		if !ipn.Contains(IP) {
-			return errors.New("ip string out of bounds")
+	return nil
+}
+
+// reserveIP - Reserve an IP address/ID pair in the range. If alloc is set, the IP address
+// was handed out by an allocation and is taken out of the range the same way.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) reserveIP(idString string, IP net.IP, alloc bool) error {
+	baseIP := ipr.baseIP()
+
+	if !ipr.Contains(IP) {
+		if ipr.isRange {
+			return &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip string out of range-bounds", IP: IP}
 		}
+		return &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip string out of bounds", IP: IP}
 	}
 
 	key := getIdentKey(idString)
 	if _, ok := ipr.ident[key]; ok {
 		if idString != "" {
-			return errors.New("ip Range,Ident,proto exists")
+			return &IPAMError{Kind: ErrIPAMIdentExists, Msg: "ip Range,Ident,proto exists", Ident: idString}
 		}
 	}
 
-	var retIndex uint64
-	if idString == "" || !ipr.fOK {
-		retIndex = diffIPIndex(baseIP, IP)
-		if retIndex == ^uint64(0) {
-			return errors.New("ip return index not found")
-		}
+	retIndex := diffIPIndex(baseIP, IP)
+	if retIndex == ^uint64(0) {
+		return &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip return index not found", IP: IP}
+	}
 
-		err = ipr.freeID.ReserveCounter(retIndex)
-		if err != nil {
-			return errors.New("ip reserve counter failure")
+	if idString != "" && ipr.sharing == IPAMSharePort {
+		if err := ipr.portReserve(idString, IP, retIndex, alloc); err != nil {
+			return err
+		}
+	} else if idString == "" || !ipr.sharedIndex() {
+		if ipr.isExcluded(retIndex) {
+			return &IPAMError{Kind: ErrIPAMIPExcluded, Msg: "ip excluded from range", IP: IP}
+		}
+		if err := ipr.reserveIndex(idString, retIndex, alloc); err != nil {
+			return &IPAMError{Kind: ErrIPAMIPInUse, Msg: "ip reserve counter failure", IP: IP}
 		}
 		if !ipr.fOK {
 			ipr.first = retIndex
 			ipr.fOK = true
 		}
+	} else {
+		retIndex = ipr.first
 	}
 
-	if idString == "" {
-		key = getIdentKey(strconv.FormatInt(int64(retIndex), 10))
-	}
-
-	ipr.ident[key]++
+	ipr.addKey(allocKey(idString, retIndex), retIndex)
 	return nil
 }
 
+// reserveIndex - Take an index out of the counter of the range as reserveIP does.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) reserveIndex(idString string, idx uint64, alloc bool) error {
+	if alloc {
+		return ipr.takeIndex(idString, idx)
+	}
+	return ipr.freeID.ReserveCounter(idx)
+}
+
 // AllocateNewIP - Allocate a New IP address from the given cluster and CIDR range
 // If idString is empty, a new IP address will be allocated else IP addresses will be shared and
 // it will be same as the first IP address allocted for this range
 func (ipa *IPAllocator) AllocateNewIP(cluster string, cidr string, idString string) (net.IP, error) {
-	var ipCPool *IPClusterPool
-	var ipr *IPRange
-	var newIndex uint64
-	var ip net.IP
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return net.IP{0, 0, 0, 0}, err
+	}
+	addr, err := ipa.AllocateAddr(cluster, r, idString)
+	if err != nil {
+		return net.IP{0, 0, 0, 0}, err
+	}
+	return ipamNetIP(addr), nil
+}
+
+// AllocateAddr - Allocate a New IP address from the given cluster and range
+func (ipa *IPAllocator) AllocateAddr(cluster string, r IPAMRange, idString string) (addr netip.Addr, err error) {
+	cidr := r.String()
 
-	_, ipn, err := net.ParseCIDR(cidr)
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalAllocate, Cluster: cluster, Range: cidr, Ident: idString})
 	if err != nil {
-		if strings.Contains(cidr, "-") {
-			ipBlock := strings.Split(cidr, "-")
-			if len(ipBlock) != 2 {
-				return net.IP{0, 0, 0, 0}, errors.New("invalid ip-range")
-			}
+		return netip.Addr{}, err
+	}
+	defer func() { err = jo.done(err, ipamNetIP(addr)) }()
 
-			startIP := net.ParseIP(ipBlock[0])
-			lastIP := net.ParseIP(ipBlock[1])
-			if startIP == nil || lastIP == nil {
-				return net.IP{0, 0, 0, 0}, errors.New("invalid ip-range ips")
-			}
-			if IsNetIPv4(startIP.String()) && IsNetIPv6(lastIP.String()) ||
-				IsNetIPv6(startIP.String()) && IsNetIPv4(lastIP.String()) {
-				return net.IP{0, 0, 0, 0}, errors.New("invalid ip-types ips")
-			}
-			ip = startIP
-		} else {
-			return net.IP{0, 0, 0, 0}, errors.New("invalid CIDR")
-		}
-	} else {
-		ip = ipn.IP
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) (err error) {
+		addr, err = s.AllocateAddr(cluster, r, idString)
+		return err
+	}); ok {
+		return addr, err
 	}
 
-	if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-		if err := ipa.AddIPRange(cluster, cidr); err != nil {
-			return net.IP{0, 0, 0, 0}, errors.New("no such IP Cluster Pool")
-		}
-		if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-			return net.IP{0, 0, 0, 0}, errors.New("ip Range allocation failure")
-		}
+	if err := checkIPAMRange(r); err != nil {
+		return netip.Addr{}, err
 	}
 
-	if ipr = ipCPool.pool[cidr]; ipr == nil {
-		return net.IP{0, 0, 0, 0}, errors.New("no such IP Range")
+	ipCPool, ipr, err := ipa.getIPRangeAdd(cluster, r, cidr, evs)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	ip, err := ipa.allocateChecked(ipr, idString)
+	if err != nil {
+		return netip.Addr{}, ipamContext(err, cluster, cidr)
 	}
+	evs.ipEvent(IPAMEventAllocate, cluster, cidr, ipr, idString, ip)
+
+	return ipamAddr(ip), nil
+}
+
+// allocateNewIP - Allocate a new IP address from the range. Caller must hold ipr.mtx
+func (ipr *IPRange) allocateNewIP(idString string) (net.IP, error) {
+	var newIndex uint64
+	var err error
 
 	key := getIdentKey(idString)
 	if _, ok := ipr.ident[key]; ok {
 		if idString != "" {
-			return net.IP{0, 0, 0, 0}, errors.New("ip/ident exists")
+			return net.IP{0, 0, 0, 0}, &IPAMError{Kind: ErrIPAMIdentExists, Msg: "ip/ident exists", Ident: idString}
 		}
 	}
 
-	if idString == "" || !ipr.fOK {
-		newIndex, err = ipr.freeID.GetCounter()
+	switch {
+	case idString != "" && ipr.sharing == IPAMSharePort:
+		newIndex, err = ipr.portIndex(idString)
 		if err != nil {
-			return net.IP{0, 0, 0, 0}, errors.New("ip Alloc counter failure")
+			return net.IP{0, 0, 0, 0}, err
+		}
+	case idString != "" && ipr.sharedIndex():
+		newIndex = ipr.first
+	default:
+		newIndex, err = ipr.newIndex(idString)
+		if err != nil {
+			return net.IP{0, 0, 0, 0}, &IPAMError{Kind: ErrIPAMPoolExhausted, Msg: "ip Alloc counter failure"}
 		}
 		if !ipr.fOK {
 			ipr.first = newIndex
 			ipr.fOK = true
 		}
-	} else {
-		newIndex = ipr.first
-		ipr.freeID.ReserveCounter(newIndex)
-	}
-
-	if idString == "" {
-		key = getIdentKey(strconv.FormatInt(int64(newIndex), 10))
 	}
 
-	ipr.ident[key]++
+	ipr.addKey(allocKey(idString, newIndex), newIndex)
 
-	retIP := addIPIndex(ip, uint64(newIndex))
+	retIP := addIPIndex(ipr.baseIP(), newIndex)
 
 	return retIP, nil
 }
 
 // DeAllocateIP - Deallocate the IP address from the given cluster and CIDR range
 func (ipa *IPAllocator) DeAllocateIP(cluster string, cidr string, idString, IPString string) error {
-	var ipCPool *IPClusterPool
-	var ipr *IPRange
-	var baseIP net.IP
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return err
+	}
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return err
+	}
+	return ipa.DeAllocateAddr(cluster, r, idString, addr)
+}
+
+// DeAllocateAddr - Deallocate the IP address from the given cluster and range
+func (ipa *IPAllocator) DeAllocateAddr(cluster string, r IPAMRange, idString string, addr netip.Addr) (err error) {
+	cidr := r.String()
 
-	_, _, err := net.ParseCIDR(cidr)
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRelease, Cluster: cluster, Range: cidr, Ident: idString, IP: addr.String()})
 	if err != nil {
-		if strings.Contains(cidr, "-") {
-			ipBlock := strings.Split(cidr, "-")
-			if len(ipBlock) != 2 {
-				return errors.New("invalid ip-range")
-			}
+		return err
+	}
+	defer func() { err = jo.done(err) }()
 
-			startIP := net.ParseIP(ipBlock[0])
-			lastIP := net.ParseIP(ipBlock[1])
-			if startIP == nil || lastIP == nil {
-				return errors.New("invalid ip-range ips")
-			}
-			if IsNetIPv4(startIP.String()) && IsNetIPv6(lastIP.String()) ||
-				IsNetIPv6(startIP.String()) && IsNetIPv4(lastIP.String()) {
-				return errors.New("invalid ip-types ips")
-			}
-		} else {
-			return errors.New("invalid CIDR")
-		}
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.DeAllocateAddr(cluster, r, idString, addr)
+	}); ok {
+		return err
 	}
 
-	IP := net.ParseIP(IPString)
-	if IP == nil {
-		return errors.New("invalid IP String")
+	if err := checkIPAMRange(r); err != nil {
+		return err
+	}
+	if err := checkIPAMAddr(addr); err != nil {
+		return err
 	}
+	IP := ipamNetIP(addr)
 
-	if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-		return errors.New("ip Cluster not found")
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
 	}
+	defer ipa.putIPRange(ipCPool, ipr)
 
-	if ipr = ipCPool.pool[cidr]; ipr == nil {
-		return errors.New("no such IP Range")
+	if err := ipr.deAllocateIP(idString, IP); err != nil {
+		return ipamContext(err, cluster, cidr)
 	}
+	evs.ipEvent(IPAMEventRelease, cluster, cidr, ipr, idString, IP)
+
+	return nil
+}
 
+// deAllocKey - Get the key of an allocation to be returned to the range. Caller must hold ipr.mtx
+func (ipr *IPRange) deAllocKey(idString string, IP net.IP) (IdentKey, error) {
 	var key IdentKey
 	key = getIdentKey(idString)
 	if _, ok := ipr.ident[key]; !ok {
 		if idString != "" {
-			return errors.New("ip Range - Ident not found")
+			return key, &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - Ident not found", Ident: idString}
 		}
 	}
 
-	if ipr.isRange {
-		baseIP = ipr.startIP
-	} else {
-		baseIP = ipr.ipNet.IP
+	retIndex := diffIPIndex(ipr.baseIP(), IP)
+	if retIndex == ^uint64(0) {
+		return key, &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip return index not found", IP: IP}
 	}
 
-	retIndex := diffIPIndex(baseIP, IP)
-	if retIndex <= 0 {
-		if retIndex != 0 || (retIndex == 0 && ipr.first != 0) {
-			return errors.New("ip return index not found")
-		}
+	key = allocKey(idString, retIndex)
+	if _, ok := ipr.ident[key]; !ok {
+		return key, &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - key not found", IP: IP, Ident: idString}
 	}
 
-	if idString == "" {
-		key = getIdentKey(strconv.FormatInt(int64(retIndex), 10))
-	}
+	return key, nil
+}
 
-	if _, ok := ipr.ident[key]; !ok {
-		return errors.New("ip Range - key not found")
+// deAllocateIP - Return an IP address to the range. Caller must hold ipr.mtx
+func (ipr *IPRange) deAllocateIP(idString string, IP net.IP) error {
+	key, err := ipr.deAllocKey(idString, IP)
+	if err != nil {
+		return err
 	}
 
 	ipr.ident[key]--
 
 	if ipr.ident[key] <= 0 {
-		delete(ipr.ident, key)
-		err = ipr.freeID.PutCounter(retIndex)
-		if err != nil {
-			return errors.New("ip Range counter failure")
+		if err := ipr.dropKey(key); err != nil {
+			return &IPAMError{Kind: ErrIPAMIPNotAllocated, Msg: "ip Range counter failure", IP: IP, Ident: idString}
 		}
 	}
 
 	return nil
 }
 
-// Contains - Check if IP is in IPrange
-func (i *IPRange) Contains(IP net.IP) bool {
-	if i.isRange {
-		d1 := diffIPIndex(i.startIP, i.endIP)
-		d2 := diffIPIndex(i.startIP, IP)
-		if d2 > d1 {
-			return false
-		}
+// allocKey - Get the key of an allocation. Allocations made without an ident
+// are keyed by their index
+func allocKey(idString string, idx uint64) IdentKey {
+	if idString == "" {
+		return getIdentKey(strconv.FormatUint(idx, 10))
+	}
+	return getIdentKey(idString)
+}
+
+// addKey - Account a reference of a key to an index. Caller must hold ipr.mtx
+func (ipr *IPRange) addKey(key IdentKey, idx uint64) {
+	if ipr.ident[key] == 0 {
+		ipr.identIdx[key] = idx
+		ipr.users[idx]++
+	}
+	ipr.ident[key]++
+}
+
+// dropKey - Drop all references of a key. Its index is returned once no other
+// key uses it anymore. Caller must hold ipr.mtx
+func (ipr *IPRange) dropKey(key IdentKey) error {
+	idx := ipr.identIdx[key]
+	delete(ipr.ident, key)
+	delete(ipr.identIdx, key)
+	delete(ipr.lease, key)
+
+	ipr.users[idx]--
+	if ipr.users[idx] > 0 {
+		return nil
+	}
+	delete(ipr.users, idx)
+	return ipr.putIndex(idx)
+}
+
+// sharedIndex - Make sure the IP address shared by idents is allocated.
+// It returns false if there is no usable shared IP address. Caller must hold ipr.mtx
+func (ipr *IPRange) sharedIndex() bool {
+	if !ipr.fOK {
+		return false
+	}
+	if ipr.users[ipr.first] > 0 {
 		return true
-	} else {
-		return i.ipNet.Contains(IP)
 	}
+	if ipr.strategy == IPAMStrategySticky {
+		// Once released, the next ident picks its own preferred shared IP address
+		ipr.fOK = false
+		return false
+	}
+	if ipr.freeID.ReserveCounter(ipr.first) != nil {
+		// Shared IP address got excluded or reserved after it was released
+		ipr.fOK = false
+		return false
+	}
+	return true
 }
 
-// AddIPRange - Add a new IP Range for allocation in a cluster
-func (ipa *IPAllocator) AddIPRange(cluster string, cidr string) error {
-	var ipCPool *IPClusterPool
-	var startIP net.IP
-	var lastIP net.IP
+// sortedRanges - Get the ranges of a cluster in allocation order. Ranges are sorted
+// by priority and then by the order they were added. Caller must hold ipCPool.mtx
+func (ipCPool *IPClusterPool) sortedRanges() []string {
+	ranges := make([]string, 0, len(ipCPool.pool))
+	for cidr := range ipCPool.pool {
+		ranges = append(ranges, cidr)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		ri := ipCPool.pool[ranges[i]]
+		rj := ipCPool.pool[ranges[j]]
+		if ri.prio != rj.prio {
+			return ri.prio < rj.prio
+		}
+		return ri.seq < rj.seq
+	})
+	return ranges
+}
+
+// SetIPRangePriority - Set the priority of a range for cluster wide allocation
+// Ranges with a lower priority value are used first and ranges with the same
+// priority are used in the order they were added
+func (ipa *IPAllocator) SetIPRangePriority(cluster string, cidr string, prio int) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
 
-	isRange := false
-	ip, ipn, err := net.ParseCIDR(cidr)
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRangePriority, Cluster: cluster, Range: cidr, Args: []string{strconv.Itoa(prio)}})
 	if err != nil {
-		if strings.Contains(cidr, "-") {
-			isRange = true
-			ipBlock := strings.Split(cidr, "-")
-			if len(ipBlock) != 2 {
-				return errors.New("invalid ip-range")
-			}
+		return err
+	}
+	defer func() { err = jo.done(err) }()
 
-			startIP = net.ParseIP(ipBlock[0])
-			lastIP = net.ParseIP(ipBlock[1])
-			if startIP == nil || lastIP == nil {
-				return errors.New("invalid ip-range ips")
-			}
-			if IsNetIPv4(startIP.String()) && IsNetIPv6(lastIP.String()) ||
-				IsNetIPv6(startIP.String()) && IsNetIPv4(lastIP.String()) {
-				return errors.New("invalid ip-types ips")
-			}
-		} else {
-			return errors.New("invalid CIDR")
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.SetIPRangePriority(cluster, cidr, prio)
+	}); ok {
+		return err
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	ipr.prio = prio
+	return nil
+}
+
+// AllocateIPFromCluster - Allocate a New IP address of the given family from any range
+// of the cluster. Ranges are tried in priority order till one has a free IP address.
+// It returns the IP address and the range it was allocated from
+func (ipa *IPAllocator) AllocateIPFromCluster(cluster string, v6 bool, idString string) (net.IP, string, error) {
+	addr, r, err := ipa.AllocateAddrFromCluster(cluster, v6, idString)
+	if err != nil {
+		return net.IP{0, 0, 0, 0}, "", err
+	}
+	return ipamNetIP(addr), r.String(), nil
+}
+
+// AllocateAddrFromCluster - Allocate a New IP address of the given family from any range
+// of the cluster. It returns the IP address and the range it was allocated from
+func (ipa *IPAllocator) AllocateAddrFromCluster(cluster string, v6 bool, idString string) (addr netip.Addr, r IPAMRange, err error) {
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalAllocate, Cluster: cluster, Ident: idString})
+	if err != nil {
+		return netip.Addr{}, IPAMRange{}, err
+	}
+	defer func() {
+		if jo != nil && err == nil {
+			jo.ents[0].Range = r.String()
 		}
+		err = jo.done(err, ipamNetIP(addr))
+	}()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) (err error) {
+		addr, r, err = s.AllocateAddrFromCluster(cluster, v6, idString)
+		return err
+	}); ok {
+		return addr, r, err
 	}
 
-	ipCPool = ipa.ipBlocks[IPClusterDefault]
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
 
-	if cluster != IPClusterDefault {
-		if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-			ipCPool = new(IPClusterPool)
-			ipCPool.name = cluster
-			ipCPool.pool = make(map[string]*IPRange)
-			ipa.ipBlocks[cluster] = ipCPool
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		return netip.Addr{}, IPAMRange{}, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster}
+	}
+
+	ipCPool.mtx.RLock()
+	defer ipCPool.mtx.RUnlock()
+
+	key := getIdentKey(idString)
+	for _, cidr := range ipCPool.sortedRanges() {
+		ipr := ipCPool.pool[cidr]
+		if ipr.isV6() != v6 {
+			continue
+		}
+
+		ipr.mtx.Lock()
+		if _, ok := ipr.ident[key]; ok && idString != "" {
+			ipr.mtx.Unlock()
+			return netip.Addr{}, IPAMRange{}, &IPAMError{Kind: ErrIPAMIdentExists, Msg: "ip/ident exists", Cluster: cluster, Range: cidr, Ident: idString}
+		}
+		ip, err := ipa.allocateChecked(ipr, idString)
+		if err == nil {
+			evs.ipEvent(IPAMEventAllocate, cluster, cidr, ipr, idString, ip)
+			ipr.mtx.Unlock()
+			return ipamAddr(ip), ipr.rng, nil
 		}
+		ipr.mtx.Unlock()
+
+		// Only an exhausted range moves the allocation on to the next one
+		if !errors.Is(err, ErrIPAMPoolExhausted) {
+			return netip.Addr{}, IPAMRange{}, ipamContext(err, cluster, cidr)
+		}
+	}
+
+	return netip.Addr{}, IPAMRange{}, &IPAMError{Kind: ErrIPAMPoolExhausted, Msg: "ip Cluster pool exhausted", Cluster: cluster}
+}
+
+// DeAllocateIPFromCluster - Deallocate the IP address from the range of the cluster holding it
+func (ipa *IPAllocator) DeAllocateIPFromCluster(cluster string, idString, IPString string) error {
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return err
+	}
+	return ipa.DeAllocateAddrFromCluster(cluster, idString, addr)
+}
+
+// DeAllocateAddrFromCluster - Deallocate the IP address from the range of the cluster holding it
+func (ipa *IPAllocator) DeAllocateAddrFromCluster(cluster string, idString string, addr netip.Addr) (err error) {
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRelease, Cluster: cluster, Ident: idString, IP: addr.String()})
+	if err != nil {
+		return err
 	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.DeAllocateAddrFromCluster(cluster, idString, addr)
+	}); ok {
+		return err
+	}
+
+	if err := checkIPAMAddr(addr); err != nil {
+		return err
+	}
+	IP := ipamNetIP(addr)
+
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
 
+	ipCPool := ipa.ipBlocks[cluster]
 	if ipCPool == nil {
-		return errors.New("can't find IP Cluster Pool")
+		return &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster}
 	}
 
-	for _, ipr := range ipCPool.pool {
-		if ipr.Contains(ip) {
-			return errors.New("existing IP Pool")
+	ipCPool.mtx.RLock()
+	defer ipCPool.mtx.RUnlock()
+
+	for cidr, ipr := range ipCPool.pool {
+		if !ipr.Contains(IP) {
+			continue
+		}
+
+		ipr.mtx.Lock()
+		defer ipr.mtx.Unlock()
+
+		if err := ipr.deAllocateIP(idString, IP); err != nil {
+			return ipamContext(err, cluster, cidr)
 		}
+		evs.ipEvent(IPAMEventRelease, cluster, cidr, ipr, idString, IP)
+
+		return nil
+	}
+
+	return &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, IP: IP}
+}
+
+// isV6 - Check if the range holds IPv6 addresses
+func (ipr *IPRange) isV6() bool {
+	return ipr.baseIP().To4() == nil
+}
+
+// baseIP - Get the IP address with index 0 in the range
+func (ipr *IPRange) baseIP() net.IP {
+	if ipr.isRange {
+		return ipr.startIP
+	}
+	return ipr.ipNet.IP
+}
+
+// Contains - Check if IP is in IPrange
+func (i *IPRange) Contains(IP net.IP) bool {
+	if IP.To16() == nil || (IP.To4() == nil) != i.isV6() {
+		return false
 	}
 
+	var ip u128
+	ip.hi, ip.lo = ipToU128(IP.To16())
+	first, last := i.span()
+	return !ip.less(first) && !last.less(ip)
+}
+
+// newIPRange - Create a new IP range of a CIDR prefix or an "a-b" range
+func newIPRange(r IPAMRange) (*IPRange, error) {
+	if !r.IsValid() {
+		return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip range"}
+	}
+	cidr := r.String()
+
 	ipr := new(IPRange)
+	ipr.rng = r
 	iprSz := uint64(0)
-	sz := 0
 	start := uint64(1)
 
-	if !isRange {
-		ipr.ipNet = *ipn
-		sz, _ = ipn.Mask.Size()
-		if IsNetIPv4(ip.String()) {
+	if r.IsPrefix() {
+		prefix := r.Prefix()
+		ip := ipamNetIP(prefix.Addr())
+		sz, maskBits := prefix.Bits(), prefix.Addr().BitLen()
+		ipr.ipNet = net.IPNet{IP: ipamNetIP(prefix.Masked().Addr()), Mask: net.CIDRMask(sz, maskBits)}
+		if maskBits == 32 {
 			ignore := uint64(0)
 			if sz != 32 && sz%8 == 0 {
 				ignore = 2
@@ -461,25 +824,36 @@ func (ipa *IPAllocator) AddIPRange(cluster string, cidr string) error {
 			} else {
 				start = 0
 			}
-			iprSz = (1 << (128 - sz)) - ignore
+			// Allocation indices are 64-bit wide, so the pool can't be larger
+			// than a /64. Refuse it rather than handing out a truncated pool
+			hostBits := 128 - sz
+			if hostBits > 64 {
+				return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip pool too large", Range: cidr}
+			}
+			if hostBits == 64 {
+				iprSz = ^uint64(0) - ignore + 1
+			} else {
+				iprSz = (1 << hostBits) - ignore
+			}
 		}
 	} else {
+		startIP := ipamNetIP(r.Start()).To16()
+		lastIP := ipamNetIP(r.End()).To16()
 		start = uint64(0)
 		ipr.isRange = true
 		ipr.startIP = startIP
 		ipr.endIP = lastIP
 		iprSz = diffIPIndex(startIP, lastIP)
+		if iprSz == ^uint64(0) && bytes.Compare(startIP.To16(), lastIP.To16()) < 0 {
+			return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip pool too large", Range: cidr}
+		}
 		if iprSz != 0 {
 			iprSz++
 		}
 	}
 
 	if iprSz < 1 {
-		return errors.New("ip pool subnet error")
-	}
-
-	if iprSz > uint64(^uint16(0)) {
-		iprSz = uint64(^uint16(0))
+		return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip pool subnet error"}
 	}
 
 	// If it is a x.x.x.0/24, then we will allocate
@@ -487,35 +861,294 @@ func (ipa *IPAllocator) AddIPRange(cluster string, cidr string) error {
 	ipr.freeID = NewCounter(start, iprSz)
 
 	if ipr.freeID == nil {
-		return errors.New("ip pool alloc failed")
+		return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip pool alloc failed", Range: cidr}
 	}
 
 	ipr.ident = make(map[IdentKey]int)
-	ipCPool.pool[cidr] = ipr
+	ipr.identIdx = make(map[IdentKey]uint64)
+	ipr.excl = make(map[string][]ipExclusion)
+	ipr.held = make(map[uint64]struct{})
+	ipr.quar = make(map[uint64]struct{})
+	ipr.users = make(map[uint64]int)
+	ipr.lease = make(map[IdentKey]time.Time)
+
+	return ipr, nil
+}
+
+// span - Get the first and the last IP address covered by the range
+func (ipr *IPRange) span() (u128, u128) {
+	var first, last u128
+
+	if ipr.isRange {
+		first.hi, first.lo = ipToU128(ipr.startIP.To16())
+		last.hi, last.lo = ipToU128(ipr.endIP.To16())
+		return first, last
+	}
+
+	lastIP := make(net.IP, len(ipr.ipNet.IP))
+	for i := range ipr.ipNet.IP {
+		lastIP[i] = ipr.ipNet.IP[i] | ^ipr.ipNet.Mask[i]
+	}
+	first.hi, first.lo = ipToU128(ipr.ipNet.IP.To16())
+	last.hi, last.lo = ipToU128(lastIP.To16())
+	return first, last
+}
+
+// overlaps - Check if two ranges have any IP address in common. Ranges of
+// different families never overlap, even if ::/63 spans the IPv4 mapped space
+func (ipr *IPRange) overlaps(other *IPRange) bool {
+	if (ipr.baseIP().To4() == nil) != (other.baseIP().To4() == nil) {
+		return false
+	}
+	first, last := ipr.span()
+	oFirst, oLast := other.span()
+	return !oLast.less(first) && !last.less(oFirst)
+}
+
+// checkOverlap - Check a new range against all ranges of a cluster except the one
+// it replaces, if any. Caller must hold ipCPool.mtx
+func (ipCPool *IPClusterPool) checkOverlap(cluster string, cidr string, newIPR *IPRange, oldIPR *IPRange) error {
+	for oCidr, ipr := range ipCPool.pool {
+		if ipr != oldIPR && ipr.overlaps(newIPR) {
+			return &IPAMError{Kind: ErrIPAMRangeExists, Msg: "existing IP Pool " + oCidr + " overlaps " + cidr, Cluster: cluster, Range: cidr}
+		}
+	}
+	return nil
+}
+
+// SetIPRangeOverlapCheck - Select if new ranges are checked for overlaps with the
+// ranges of all clusters, instead of only the ranges of their own cluster
+func (ipa *IPAllocator) SetIPRangeOverlapCheck(allClusters bool) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.xOverlap = allClusters
+}
+
+// AddIPRange - Add a new IP Range for allocation in a cluster
+// The range must not overlap any range of the cluster, or of any cluster
+// if enabled with SetIPRangeOverlapCheck
+func (ipa *IPAllocator) AddIPRange(cluster string, cidr string) error {
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+	return ipa.AddRange(cluster, r)
+}
+
+// AddRange - Add a new IP Range for allocation in a cluster
+func (ipa *IPAllocator) AddRange(cluster string, r IPAMRange) (err error) {
+	cidr := r.String()
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRangeAdd, Cluster: cluster, Range: cidr})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.AddRange(cluster, r)
+	}); ok {
+		return err
+	}
+
+	if err := checkIPAMRange(r); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	return ipa.addIPRange(cluster, r, cidr, evs)
+}
+
+// addIPRange - Add a new IP Range to a cluster, creating the cluster if needed.
+// The range is kept under its canonical string cidr and its event is queued to evs
+func (ipa *IPAllocator) addIPRange(cluster string, r IPAMRange, cidr string, evs *ipamEvents) error {
+	var ipCPool *IPClusterPool
+
+	newIPR, err := newIPRange(r)
+	if err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	ipa.mtx.RLock()
+	if ipa.xOverlap {
+		ipa.mtx.RUnlock()
+		return ipa.addIPRangeChecked(cluster, cidr, newIPR, evs)
+	}
+	ipCPool = ipa.ipBlocks[cluster]
+
+	if ipCPool == nil && cluster != IPClusterDefault {
+		ipa.mtx.RUnlock()
+		ipa.mtx.Lock()
+		if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
+			ipCPool = new(IPClusterPool)
+			ipCPool.name = cluster
+			ipCPool.pool = make(map[string]*IPRange)
+			ipa.ipBlocks[cluster] = ipCPool
+		}
+		ipa.mtx.Unlock()
+		ipa.mtx.RLock()
+		ipCPool = ipa.ipBlocks[cluster]
+	}
+	defer ipa.mtx.RUnlock()
+
+	if ipCPool == nil {
+		return &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "can't find IP Cluster Pool", Cluster: cluster}
+	}
+
+	ipCPool.mtx.Lock()
+	defer ipCPool.mtx.Unlock()
+
+	if err := ipCPool.checkOverlap(cluster, cidr, newIPR, nil); err != nil {
+		return err
+	}
+
+	ipCPool.seq++
+	newIPR.seq = ipCPool.seq
+	ipCPool.pool[cidr] = newIPR
+	evs.rangeEvent(IPAMEventRangeAdded, cluster, cidr)
+
+	return nil
+}
+
+// addIPRangeChecked - Add a new IP Range after checking it against the ranges of all clusters.
+// The allocator is locked exclusively, so that no cluster can change during the check
+func (ipa *IPAllocator) addIPRangeChecked(cluster string, cidr string, newIPR *IPRange, evs *ipamEvents) error {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	if ipa.storePart {
+		return errIPAMStoreScope
+	}
+
+	for name, ipCPool := range ipa.ipBlocks {
+		if err := ipCPool.checkOverlap(name, cidr, newIPR, nil); err != nil {
+			return err
+		}
+	}
+
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		ipCPool = new(IPClusterPool)
+		ipCPool.name = cluster
+		ipCPool.pool = make(map[string]*IPRange)
+		ipa.ipBlocks[cluster] = ipCPool
+	}
+
+	ipCPool.seq++
+	newIPR.seq = ipCPool.seq
+	ipCPool.pool[cidr] = newIPR
+	evs.rangeEvent(IPAMEventRangeAdded, cluster, cidr)
 
 	return nil
 }
 
+// GetIPRangeSize - Get the number of IP addresses which can be allocated from a range
+func (ipa *IPAllocator) GetIPRangeSize(cluster string, cidr string) (uint64, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return 0, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return 0, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	return ipr.freeID.CounterSize(), nil
+}
+
 // DeleteIPRange - Delete a IP Range from allocation in a cluster
+// A range which still has IP addresses allocated is not deleted
 func (ipa *IPAllocator) DeleteIPRange(cluster string, cidr string) error {
-	var ipCPool *IPClusterPool
-	_, _, err := net.ParseCIDR(cidr)
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+	return ipa.DeleteRange(cluster, r)
+}
 
+// DeleteIPRangeForce - Delete a IP Range from allocation in a cluster along with
+// its allocations. It returns the evicted allocations
+func (ipa *IPAllocator) DeleteIPRangeForce(cluster string, cidr string) ([]IPAMAllocInfo, error) {
+	r, err := ParseIPAMRange(cidr)
 	if err != nil {
-		return errors.New("invalid CIDR")
+		return nil, ipamContext(err, cluster, cidr)
 	}
+	return ipa.DeleteRangeForce(cluster, r)
+}
+
+// DeleteRange - Delete a IP Range from allocation in a cluster
+// A range which still has IP addresses allocated is not deleted
+func (ipa *IPAllocator) DeleteRange(cluster string, r IPAMRange) error {
+	_, err := ipa.deleteIPRange(cluster, r, false)
+	return err
+}
+
+// DeleteRangeForce - Delete a IP Range from allocation in a cluster along with
+// its allocations. It returns the evicted allocations
+func (ipa *IPAllocator) DeleteRangeForce(cluster string, r IPAMRange) ([]IPAMAllocInfo, error) {
+	return ipa.deleteIPRange(cluster, r, true)
+}
+
+func (ipa *IPAllocator) deleteIPRange(cluster string, r IPAMRange, force bool) (evicted []IPAMAllocInfo, err error) {
+	cidr := r.String()
+	op := IPAMJournalRangeDelete
+	if force {
+		op = IPAMJournalRangeDeleteForce
+	}
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: op, Cluster: cluster, Range: cidr})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) (err error) {
+		evicted, err = s.deleteIPRange(cluster, r, force)
+		return err
+	}); ok {
+		return evicted, err
+	}
+
+	var ipCPool *IPClusterPool
+
+	if err := checkIPAMRange(r); err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
 
 	if ipCPool = ipa.ipBlocks[cluster]; ipCPool == nil {
-		return errors.New("no such IP Cluster Pool")
+		return nil, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "no such IP Cluster Pool", Cluster: cluster}
 	}
 
-	if ipr := ipCPool.pool[cidr]; ipr == nil {
-		return errors.New("no such IP Range")
+	ipCPool.mtx.Lock()
+	defer ipCPool.mtx.Unlock()
+
+	ipr := ipCPool.pool[cidr]
+	if ipr == nil {
+		return nil, &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, Range: cidr}
 	}
 
+	ipr.mtx.Lock()
+	defer ipr.mtx.Unlock()
+
+	if len(ipr.ident) != 0 && !force {
+		return nil, &IPAMError{Kind: ErrIPAMRangeInUse, Msg: "ip Range in use", Cluster: cluster, Range: cidr}
+	}
+
+	evicted = ipr.allocatedIPs()
 	delete(ipCPool.pool, cidr)
+	evs.rangeEvent(IPAMEventRangeDeleted, cluster, cidr)
 
-	return nil
+	return evicted, nil
 }
 
 // IpAllocatorNew - Create a new allocator
@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// IPAMMaxConflictTries - Maximum number of candidate IP addresses checked for a single allocation
+const IPAMMaxConflictTries = 8
+
+// IPAMConflictChecker - Checks if a candidate IP address is already in use on the network
+// before it is handed out. It returns true if the IP address is in use
+type IPAMConflictChecker interface {
+	CheckConflict(IP net.IP) (bool, error)
+}
+
+// SetIPConflictChecker - Set the checker called for every new IP address before it is handed
+// out. IP addresses found in use are quarantined and the next one is tried. Checker errors
+// don't block allocations. The range is locked while checking, so checks should be quick.
+// Batches are checked without any allocator locks held. A nil checker disables the checks
+func (ipa *IPAllocator) SetIPConflictChecker(cc IPAMConflictChecker) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.conflict = cc
+}
+
+// allocateChecked - Allocate a new IP address from the range which is not in use on the
+// network as per the conflict checker. Caller must hold ipa.mtx and ipr.mtx
+func (ipa *IPAllocator) allocateChecked(ipr *IPRange, idString string) (net.IP, error) {
+	for try := 0; ; try++ {
+		ip, err := ipr.allocateNewIP(idString)
+		if err != nil || ipa.conflict == nil {
+			return ip, err
+		}
+
+		// IP addresses already shared with other idents are not checked again
+		idx := diffIPIndex(ipr.baseIP(), ip)
+		if ipr.users[idx] > 1 {
+			return ip, nil
+		}
+
+		if inUse, err := ipa.conflict.CheckConflict(ip); err != nil || !inUse {
+			return ip, nil
+		}
+		ipr.quarantine(allocKey(idString, idx))
+
+		if try+1 >= IPAMMaxConflictTries {
+			return net.IP{0, 0, 0, 0}, &IPAMError{Kind: ErrIPAMIPConflict, Msg: "ip conflict check failure", Ident: idString}
+		}
+	}
+}
+
+// allocateProbed - Allocate a new IP address from the range like allocateChecked, but
+// with the results of conflict checks done beforehand without the allocator locks.
+// It returns if the IP address was not checked yet. Caller must hold ipa.mtx and ipr.mtx
+func (ipa *IPAllocator) allocateProbed(ipr *IPRange, idString string, probed map[string]bool) (net.IP, bool, error) {
+	for try := 0; ; try++ {
+		ip, err := ipr.allocateNewIP(idString)
+		if err != nil || ipa.conflict == nil {
+			return ip, false, err
+		}
+
+		idx := diffIPIndex(ipr.baseIP(), ip)
+		if ipr.users[idx] > 1 {
+			return ip, false, nil
+		}
+
+		inUse, ok := probed[ip.String()]
+		if !ok {
+			return ip, true, nil
+		} else if !inUse {
+			return ip, false, nil
+		}
+		ipr.quarantine(allocKey(idString, idx))
+
+		if try+1 >= IPAMMaxConflictTries {
+			return net.IP{0, 0, 0, 0}, false, &IPAMError{Kind: ErrIPAMIPConflict, Msg: "ip conflict check failure", Ident: idString}
+		}
+	}
+}
+
+// probeConflict - Check if an IP address is in use with the conflict checker. Checker
+// errors don't block allocations, so the IP address is taken as not in use then
+func probeConflict(cc IPAMConflictChecker, IP net.IP) bool {
+	inUse, err := cc.CheckConflict(IP)
+	return err == nil && inUse
+}
+
+// quarantineIP - Quarantine a new allocation which was found in use after it was made.
+// An IP address which another ident shares by now is kept, like for allocateChecked.
+// It returns if the allocation was dropped. Caller must hold ipr.mtx
+func (ipr *IPRange) quarantineIP(idString string, IP net.IP) (bool, error) {
+	idx := diffIPIndex(ipr.baseIP(), IP)
+	key := allocKey(idString, idx)
+	if kidx, ok := ipr.identIdx[key]; !ok || kidx != idx {
+		return false, &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - key not found", IP: IP, Ident: idString}
+	}
+	if ipr.users[idx] > 1 {
+		return false, nil
+	}
+	ipr.quarantine(key)
+	return true, nil
+}
+
+// quarantine - Drop a new allocation found in use on the network and keep its IP
+// address from being handed out. Caller must hold ipr.mtx
+func (ipr *IPRange) quarantine(key IdentKey) {
+	idx := ipr.identIdx[key]
+	delete(ipr.ident, key)
+	delete(ipr.identIdx, key)
+	delete(ipr.users, idx)
+	if ipr.fOK && ipr.first == idx {
+		ipr.fOK = false
+	}
+	ipr.quar[idx] = struct{}{}
+}
+
+// ListQuarantinedIPs - Get the IP addresses of a range which were found in use on the network
+func (ipa *IPAllocator) ListQuarantinedIPs(cluster string, cidr string) ([]net.IP, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	quar := make([]uint64, 0, len(ipr.quar))
+	for idx := range ipr.quar {
+		quar = append(quar, idx)
+	}
+	sort.Slice(quar, func(i, j int) bool { return quar[i] < quar[j] })
+
+	ips := make([]net.IP, 0, len(quar))
+	for _, idx := range quar {
+		ips = append(ips, addIPIndex(ipr.baseIP(), idx))
+	}
+
+	return ips, nil
+}
+
+// ReleaseQuarantinedIP - Make a quarantined IP address of a range available again
+func (ipa *IPAllocator) ReleaseQuarantinedIP(cluster string, cidr string, IPString string) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalQuarantineRelease, Cluster: cluster, Range: cidr, IP: IPString})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.ReleaseQuarantinedIP(cluster, cidr, IPString)
+	}); ok {
+		return err
+	}
+
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+	IP := ipamNetIP(addr)
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	if !ipr.Contains(IP) {
+		return &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip string out of bounds", Cluster: cluster, Range: cidr, IP: IP}
+	}
+
+	idx := diffIPIndex(ipr.baseIP(), IP)
+	if _, ok := ipr.quar[idx]; !ok {
+		return &IPAMError{Kind: ErrIPAMIPNotAllocated, Msg: "ip not quarantined", Cluster: cluster, Range: cidr, IP: IP}
+	}
+	delete(ipr.quar, idx)
+
+	return ipr.putIndex(idx)
+}
+
+// IPAMArpChecker - Conflict checker which probes IPv4 addresses with an ARP request
+// on an interface and reports them in use if a reply arrives within the timeout.
+// IPv6 addresses are not probed
+type IPAMArpChecker struct {
+	IfName  string
+	SIP     net.IP
+	Timeout time.Duration
+}
+
+// IPAMArpCheckerNew - Create a new ARP conflict checker for an interface. If SIP is
+// nil, ARP probes with an unspecified sender address are sent
+func IPAMArpCheckerNew(ifName string, SIP net.IP, timeout time.Duration) *IPAMArpChecker {
+	if SIP == nil {
+		SIP = net.IPv4zero
+	}
+	return &IPAMArpChecker{IfName: ifName, SIP: SIP, Timeout: timeout}
+}
+
+// CheckConflict - Probe an IP address with ARP
+func (ac *IPAMArpChecker) CheckConflict(IP net.IP) (bool, error) {
+	if IP.To4() == nil {
+		return false, nil
+	}
+	return ArpProbe(IP, ac.SIP, ac.IfName, ac.Timeout)
+}
@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net"
+)
+
+// allocCheck - Check if allocateNewIP would succeed, without changing the range.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) allocCheck(idString string) error {
+	needNew := true
+
+	if idString != "" {
+		if _, ok := ipr.ident[getIdentKey(idString)]; ok {
+			return &IPAMError{Kind: ErrIPAMIdentExists, Msg: "ip/ident exists", Ident: idString}
+		}
+
+		if ipr.sharing == IPAMSharePort {
+			port, proto, err := identPort(idString)
+			if err != nil {
+				return err
+			}
+			conflict, shared := ipr.portConflicts(port, proto)
+			for idx := range shared {
+				if _, ok := conflict[idx]; !ok {
+					needNew = false
+					break
+				}
+			}
+		} else if ipr.fOK && ipr.users[ipr.first] > 0 {
+			needNew = false
+		}
+	}
+
+	if needNew && ipr.freeID.CounterFree() == 0 {
+		return &IPAMError{Kind: ErrIPAMPoolExhausted, Msg: "ip Alloc counter failure", Ident: idString}
+	}
+
+	return nil
+}
+
+// dualStackRanges - Find an IPv4 and an IPv6 range of a cluster.
+// Caller must hold ipa.mtx and, unless it holds ipa.mtx exclusively, ipCPool.mtx
+func (ipa *IPAllocator) dualStackRanges(ipCPool *IPClusterPool, cluster string, cidr4 string, cidr6 string) (*IPRange, *IPRange, error) {
+	ipr4 := ipCPool.pool[cidr4]
+	ipr6 := ipCPool.pool[cidr6]
+
+	if ipr4 == nil {
+		return nil, nil, &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, Range: cidr4}
+	} else if ipr6 == nil {
+		return nil, nil, &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, Range: cidr6}
+	} else if ipr4.isV6() || !ipr6.isV6() {
+		return nil, nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip-types ips", Cluster: cluster}
+	}
+
+	return ipr4, ipr6, nil
+}
+
+// getDualStackRanges - Find an IPv4 and an IPv6 range of a cluster and lock both for update.
+// A successful call must be paired with a call to putDualStackRanges
+func (ipa *IPAllocator) getDualStackRanges(cluster string, cidr4 string, cidr6 string) (*IPClusterPool, *IPRange, *IPRange, error) {
+	ipa.mtx.RLock()
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		ipa.mtx.RUnlock()
+		return nil, nil, nil, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster}
+	}
+
+	ipCPool.mtx.RLock()
+	ipr4, ipr6, err := ipa.dualStackRanges(ipCPool, cluster, cidr4, cidr6)
+	if err != nil {
+		ipCPool.mtx.RUnlock()
+		ipa.mtx.RUnlock()
+		return nil, nil, nil, err
+	}
+
+	// IPv4 ranges are always locked first
+	ipr4.mtx.Lock()
+	ipr6.mtx.Lock()
+
+	return ipCPool, ipr4, ipr6, nil
+}
+
+// putDualStackRanges - Release the locks taken by getDualStackRanges
+func (ipa *IPAllocator) putDualStackRanges(ipCPool *IPClusterPool, ipr4 *IPRange, ipr6 *IPRange) {
+	ipr6.mtx.Unlock()
+	ipr4.mtx.Unlock()
+	ipCPool.mtx.RUnlock()
+	ipa.mtx.RUnlock()
+}
+
+// AllocateDualStackIP - Allocate an IPv4 address from cidr4 and an IPv6 address from cidr6
+// of a cluster for the same ident. Either both addresses are allocated or none
+func (ipa *IPAllocator) AllocateDualStackIP(cluster string, cidr4 string, cidr6 string, idString string) (ip4 net.IP, ip6 net.IP, err error) {
+	if _, cidr4, err = ipamRangeKey(cidr4); err != nil {
+		return nil, nil, ipamContext(err, cluster, cidr4)
+	}
+	if _, cidr6, err = ipamRangeKey(cidr6); err != nil {
+		return nil, nil, ipamContext(err, cluster, cidr6)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalAllocate, Cluster: cluster, Range: cidr4, Ident: idString},
+		IPAMJournalEntry{Op: IPAMJournalAllocate, Cluster: cluster, Range: cidr6, Ident: idString})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { err = jo.done(err, ip4, ip6) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) (err error) {
+		ip4, ip6, err = s.AllocateDualStackIP(cluster, cidr4, cidr6, idString)
+		return err
+	}); ok {
+		return ip4, ip6, err
+	}
+
+	// Both IP addresses are allocated with the ranges locked and conflict checked after,
+	// without any allocator locks held. IP addresses found in use are quarantined and
+	// replaced in the next round
+	cidrs := [2]string{cidr4, cidr6}
+	ips := [2]net.IP{}
+	conflicts := [2]int{}
+	probed := make(map[string]bool)
+	for try := 0; ; try++ {
+		ipCPool, ipr4, ipr6, err := ipa.getDualStackRanges(cluster, cidr4, cidr6)
+		if err != nil {
+			return nil, nil, errors.Join(err, ipa.releaseDualStackIP(cluster, cidrs, idString, ips))
+		}
+		iprs := [2]*IPRange{ipr4, ipr6}
+
+		if try == 0 {
+			for i, ipr := range iprs {
+				if err := ipr.allocCheck(idString); err != nil {
+					ipa.putDualStackRanges(ipCPool, ipr4, ipr6)
+					return nil, nil, ipamContext(err, cluster, cidrs[i])
+				}
+			}
+		}
+
+		var unprobed []net.IP
+		for i, ipr := range iprs {
+			if ips[i] != nil && probed[ips[i].String()] {
+				var dropped bool
+				if dropped, err = ipr.quarantineIP(idString, ips[i]); dropped || err != nil {
+					ips[i] = nil
+				}
+				if conflicts[i]++; dropped && conflicts[i] >= IPAMMaxConflictTries {
+					err = &IPAMError{Kind: ErrIPAMIPConflict, Msg: "ip conflict check failure", Ident: idString}
+				}
+			}
+			if ips[i] == nil && err == nil {
+				var probe bool
+				if ips[i], probe, err = ipa.allocateProbed(ipr, idString, probed); err != nil {
+					ips[i] = nil
+				} else if probe {
+					unprobed = append(unprobed, ips[i])
+				}
+			}
+			if err != nil {
+				// Roll back the other IP address of the pair
+				err = ipamContext(err, cluster, cidrs[i])
+				for j, IP := range ips {
+					if IP == nil {
+						continue
+					}
+					if derr := iprs[j].deAllocateIP(idString, IP); derr != nil {
+						err = errors.Join(err, ipamContext(derr, cluster, cidrs[j]))
+					}
+				}
+				ipa.putDualStackRanges(ipCPool, ipr4, ipr6)
+				return nil, nil, err
+			}
+		}
+
+		if len(unprobed) == 0 {
+			evs.ipEvent(IPAMEventAllocate, cluster, cidr4, ipr4, idString, ips[0])
+			evs.ipEvent(IPAMEventAllocate, cluster, cidr6, ipr6, idString, ips[1])
+			ipa.putDualStackRanges(ipCPool, ipr4, ipr6)
+			return ips[0], ips[1], nil
+		}
+		cc := ipa.conflict
+		ipa.putDualStackRanges(ipCPool, ipr4, ipr6)
+
+		for _, IP := range unprobed {
+			probed[IP.String()] = probeConflict(cc, IP)
+		}
+	}
+}
+
+// releaseDualStackIP - Roll back the allocations of a pair whose ranges were changed
+// while its IP addresses were conflict checked
+func (ipa *IPAllocator) releaseDualStackIP(cluster string, cidrs [2]string, idString string, ips [2]net.IP) error {
+	var errs []error
+
+	for i, IP := range ips {
+		if IP == nil {
+			continue
+		}
+		ipCPool, ipr, err := ipa.getIPRange(cluster, cidrs[i])
+		if err != nil {
+			// The range and its allocations are gone
+			continue
+		}
+		if err := ipr.deAllocateIP(idString, IP); err != nil {
+			errs = append(errs, ipamContext(err, cluster, cidrs[i]))
+		}
+		ipa.putIPRange(ipCPool, ipr)
+	}
+
+	return errors.Join(errs...)
+}
+
+// DeAllocateDualStackIP - Deallocate the IPv4 and IPv6 addresses allocated with
+// AllocateDualStackIP. Either both addresses are deallocated or none
+func (ipa *IPAllocator) DeAllocateDualStackIP(cluster string, cidr4 string, cidr6 string, idString string, IP4String string, IP6String string) (err error) {
+	if _, cidr4, err = ipamRangeKey(cidr4); err != nil {
+		return ipamContext(err, cluster, cidr4)
+	}
+	if _, cidr6, err = ipamRangeKey(cidr6); err != nil {
+		return ipamContext(err, cluster, cidr6)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRelease, Cluster: cluster, Range: cidr4, Ident: idString, IP: IP4String},
+		IPAMJournalEntry{Op: IPAMJournalRelease, Cluster: cluster, Range: cidr6, Ident: idString, IP: IP6String})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.DeAllocateDualStackIP(cluster, cidr4, cidr6, idString, IP4String, IP6String)
+	}); ok {
+		return err
+	}
+
+	addr4, err := parseIPAMAddr(IP4String)
+	if err != nil {
+		return ipamContext(err, cluster, cidr4)
+	}
+	addr6, err := parseIPAMAddr(IP6String)
+	if err != nil {
+		return ipamContext(err, cluster, cidr6)
+	}
+	IP4, IP6 := ipamNetIP(addr4), ipamNetIP(addr6)
+
+	ipCPool, ipr4, ipr6, err := ipa.getDualStackRanges(cluster, cidr4, cidr6)
+	if err != nil {
+		return err
+	}
+	defer ipa.putDualStackRanges(ipCPool, ipr4, ipr6)
+
+	if _, err := ipr4.deAllocKey(idString, IP4); err != nil {
+		return ipamContext(err, cluster, cidr4)
+	}
+	if _, err := ipr6.deAllocKey(idString, IP6); err != nil {
+		return ipamContext(err, cluster, cidr6)
+	}
+
+	if err := ipr4.deAllocateIP(idString, IP4); err != nil {
+		return ipamContext(err, cluster, cidr4)
+	}
+	if err := ipr6.deAllocateIP(idString, IP6); err != nil {
+		return ipamContext(err, cluster, cidr6)
+	}
+	evs.ipEvent(IPAMEventRelease, cluster, cidr4, ipr4, idString, IP4)
+	evs.ipEvent(IPAMEventRelease, cluster, cidr6, ipr6, idString, IP6)
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// IPAM error kinds. Errors returned by the IP allocator match one of these with errors.Is
+var (
+	ErrIPAMInvalidInput      = errors.New("ipam invalid input")
+	ErrIPAMOutOfBounds       = errors.New("ipam ip out of bounds")
+	ErrIPAMClusterNotFound   = errors.New("ipam cluster not found")
+	ErrIPAMRangeNotFound     = errors.New("ipam range not found")
+	ErrIPAMRangeExists       = errors.New("ipam range exists")
+	ErrIPAMRangeInUse        = errors.New("ipam range in use")
+	ErrIPAMPoolExhausted     = errors.New("ipam pool exhausted")
+	ErrIPAMIPInUse           = errors.New("ipam ip in use")
+	ErrIPAMIPNotAllocated    = errors.New("ipam ip not allocated")
+	ErrIPAMIPExcluded        = errors.New("ipam ip excluded")
+	ErrIPAMIdentExists       = errors.New("ipam ident exists")
+	ErrIPAMIdentNotFound     = errors.New("ipam ident not found")
+	ErrIPAMExclusionExists   = errors.New("ipam exclusion exists")
+	ErrIPAMExclusionNotFound = errors.New("ipam exclusion not found")
+	ErrIPAMLeaseNotFound     = errors.New("ipam lease not found")
+	ErrIPAMLeaseExpired      = errors.New("ipam lease expired")
+	ErrIPAMIPConflict        = errors.New("ipam ip conflict")
+	ErrIPAMStoreConflict     = errors.New("ipam store version conflict")
+	ErrIPAMJournal           = errors.New("ipam journal failed")
+)
+
+// IPAMError - Error of the IP allocator with the context it occurred in
+// Kind is one of the ErrIPAM errors and context which is not known is left empty
+type IPAMError struct {
+	Kind    error
+	Msg     string
+	Cluster string
+	Range   string
+	IP      net.IP
+	Ident   string
+}
+
+// Error - Get the error message along with its context
+func (e *IPAMError) Error() string {
+	ip := ""
+	if e.IP != nil {
+		ip = e.IP.String()
+	}
+	return errContext(e.Msg, "cluster", e.Cluster, "range", e.Range, "ip", ip, "ident", e.Ident)
+}
+
+// Unwrap - Get the kind of the error
+func (e *IPAMError) Unwrap() error {
+	return e.Kind
+}
+
+// errContext - Get an error message followed by the context it occurred in. The context
+// is given as name and value pairs and pairs without a value are left out
+func errContext(msg string, ctx ...string) string {
+	var pairs []string
+
+	for i := 0; i+1 < len(ctx); i += 2 {
+		if ctx[i+1] != "" {
+			pairs = append(pairs, ctx[i]+" "+ctx[i+1])
+		}
+	}
+
+	if len(pairs) == 0 {
+		return msg
+	}
+	return msg + " (" + strings.Join(pairs, ", ") + ")"
+}
+
+// ipamContext - Add the cluster and range to an IPAM error which doesn't have them yet
+func ipamContext(err error, cluster string, cidr string) error {
+	var e *IPAMError
+	if errors.As(err, &e) {
+		if e.Cluster == "" {
+			e.Cluster = cluster
+		}
+		if e.Range == "" {
+			e.Range = cidr
+		}
+	}
+	return err
+}
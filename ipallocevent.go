@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"sort"
+)
+
+// IPAMEventType - Type of an IPAM event
+type IPAMEventType uint8
+
+// IPAM event types
+const (
+	IPAMEventAllocate IPAMEventType = iota
+	IPAMEventRelease
+	IPAMEventRangeAdded
+	IPAMEventRangeDeleted
+	IPAMEventWatermarkRaised
+	IPAMEventWatermarkCleared
+)
+
+// IPAMEvent - An event of the IP allocator
+// Ident and IP are only set for allocate and release events, Watermark and
+// Utilization only for watermark events
+type IPAMEvent struct {
+	Type        IPAMEventType
+	Cluster     string
+	Range       string
+	Ident       string
+	IP          net.IP
+	Watermark   float64
+	Utilization float64
+}
+
+// IPAMEventHook - Called for every IPAM event
+type IPAMEventHook func(ev IPAMEvent)
+
+// ipamEvents - Events and reclaimed leases of an operation, which are delivered once
+// the allocator and journal locks are released, so that hooks can call back into the allocator
+type ipamEvents struct {
+	ipa       *IPAllocator
+	hook      IPAMEventHook
+	evs       []IPAMEvent
+	leaseHook IPAMLeaseExpiryHook
+	leases    []IPAMLease
+}
+
+// SetIPAMEventHook - Set the hook called for IPAM events. Events of concurrent
+// operations can be delivered concurrently
+func (ipa *IPAllocator) SetIPAMEventHook(hook IPAMEventHook) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.evHook = hook
+}
+
+// SetIPAMWatermarks - Set the utilization watermarks in percent, which raise an event
+// once the utilization of a range reaches them. A raised watermark is cleared with
+// another event once the utilization drops below the watermark minus hysteresis.
+// Ranges already above a watermark are reported right away
+func (ipa *IPAllocator) SetIPAMWatermarks(marks []float64, hysteresis float64) error {
+	wmarks := append([]float64(nil), marks...)
+	sort.Float64s(wmarks)
+	for i, m := range wmarks {
+		if m <= 0 || m > 100 || (i > 0 && m == wmarks[i-1]) {
+			return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam watermark"}
+		}
+	}
+	if hysteresis < 0 || hysteresis >= 100 {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam watermark hysteresis"}
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.wmarks = wmarks
+	ipa.wmHyst = hysteresis
+
+	for name, ipCPool := range ipa.ipBlocks {
+		for _, cidr := range ipCPool.sortedRanges() {
+			ipr := ipCPool.pool[cidr]
+			ipr.mtx.Lock()
+			ipr.wmark = 0
+			evs.watermarks(name, cidr, ipr)
+			ipr.mtx.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// newEvents - Start collecting the events of an operation
+func (ipa *IPAllocator) newEvents() *ipamEvents {
+	return &ipamEvents{ipa: ipa}
+}
+
+// add - Queue an event. Caller must hold ipa.mtx
+func (e *ipamEvents) add(ev IPAMEvent) {
+	e.hook = e.ipa.evHook
+	if e.hook != nil {
+		e.evs = append(e.evs, ev)
+	}
+}
+
+// leasesExpired - Queue reclaimed leases for the lease expiry hook. Caller must hold ipa.mtx
+func (e *ipamEvents) leasesExpired(leases []IPAMLease) {
+	e.leaseHook = e.ipa.leaseHook
+	if e.leaseHook != nil {
+		e.leases = append(e.leases, leases...)
+	}
+}
+
+// rangeEvent - Queue a range added or deleted event. Caller must hold ipa.mtx
+func (e *ipamEvents) rangeEvent(typ IPAMEventType, cluster string, cidr string) {
+	e.add(IPAMEvent{Type: typ, Cluster: cluster, Range: cidr})
+}
+
+// ipEvent - Queue an allocate or release event and the watermark events it causes.
+// Caller must hold ipa.mtx and ipr.mtx
+func (e *ipamEvents) ipEvent(typ IPAMEventType, cluster string, cidr string, ipr *IPRange, idString string, IP net.IP) {
+	e.add(IPAMEvent{Type: typ, Cluster: cluster, Range: cidr, Ident: idString, IP: IP})
+	e.watermarks(cluster, cidr, ipr)
+}
+
+// watermarks - Raise or clear the watermarks of a range as per its utilization.
+// Caller must hold ipa.mtx and ipr.mtx
+func (e *ipamEvents) watermarks(cluster string, cidr string, ipr *IPRange) {
+	marks := e.ipa.wmarks
+	if ipr.wmark > len(marks) {
+		ipr.wmark = len(marks)
+	}
+	if len(marks) == 0 {
+		return
+	}
+
+	util := ipr.markUtilization()
+	for ipr.wmark < len(marks) && util >= marks[ipr.wmark] {
+		e.add(IPAMEvent{Type: IPAMEventWatermarkRaised, Cluster: cluster, Range: cidr, Watermark: marks[ipr.wmark], Utilization: util})
+		ipr.wmark++
+	}
+	for ipr.wmark > 0 && util < marks[ipr.wmark-1]-e.ipa.wmHyst {
+		ipr.wmark--
+		e.add(IPAMEvent{Type: IPAMEventWatermarkCleared, Cluster: cluster, Range: cidr, Watermark: marks[ipr.wmark], Utilization: util})
+	}
+}
+
+// markUtilization - Get the percentage of addresses in use out of the ones not held
+// back by exclusions or quarantined, so that a range is at 100% once it is exhausted.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) markUtilization() float64 {
+	ri := ipr.info("", "")
+	avail := ri.Size - ri.Excluded - ri.Quarantined
+	if avail == 0 {
+		return 100
+	}
+	return float64(ri.Used) * 100 / float64(avail)
+}
+
+// emit - Deliver the queued events and then the reclaimed leases. Must be called
+// without any allocator or journal locks held
+func (e *ipamEvents) emit() {
+	for _, ev := range e.evs {
+		e.hook(ev)
+	}
+	e.evs = nil
+	for _, lease := range e.leases {
+		e.leaseHook(lease)
+	}
+	e.leases = nil
+}
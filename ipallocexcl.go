@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"sort"
+)
+
+// IPAMMaxExclusionSize - Maximum number of IP addresses in an exclusion entry
+const IPAMMaxExclusionSize = 1 << 16
+
+// ipExclusion - An IP address or a sub-range excluded from allocation
+type ipExclusion struct {
+	spec  string
+	first uint64
+	last  uint64
+	empty bool
+}
+
+// newExclusion - Parse an exclusion entry given as an IP address, a CIDR or an "a-b" range
+// Addresses which can never be allocated from the range, like the network address, are ignored
+func (ipr *IPRange) newExclusion(excl string) (ipExclusion, error) {
+	var r IPAMRange
+
+	ex := ipExclusion{spec: excl}
+	if addr, err := parseIPAMAddr(excl); err == nil {
+		r = IPAMAddrRange(addr, addr)
+		ex.spec = addr.String()
+	} else if r, err = ParseIPAMRange(excl); err == nil {
+		ex.spec = r.String()
+	} else {
+		return ex, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip exclusion"}
+	}
+	startIP, lastIP := ipamNetIP(r.Start()), ipamNetIP(r.End())
+
+	if !ipr.Contains(startIP) || !ipr.Contains(lastIP) {
+		return ex, &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip exclusion out of bounds"}
+	}
+
+	ex.first = diffIPIndex(ipr.baseIP(), startIP)
+	ex.last = diffIPIndex(ipr.baseIP(), lastIP)
+	if ex.first > ex.last {
+		return ex, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip exclusion"}
+	}
+
+	begin := ipr.freeID.begin
+	end := begin + ipr.freeID.len - 1
+	if ex.first < begin {
+		ex.first = begin
+	}
+	if ex.last > end {
+		ex.last = end
+	}
+	if ex.first > ex.last {
+		ex.empty = true
+		return ex, nil
+	}
+
+	if ex.last-ex.first >= IPAMMaxExclusionSize {
+		return ex, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip exclusion too large"}
+	}
+
+	return ex, nil
+}
+
+// isExcluded - Check if an index is excluded from allocation. Caller must hold ipr.mtx
+func (ipr *IPRange) isExcluded(idx uint64) bool {
+	for _, exs := range ipr.excl {
+		for _, ex := range exs {
+			if !ex.empty && idx >= ex.first && idx <= ex.last {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// putIndex - Return an index which is no longer in use. If it is excluded,
+// it is held back instead of being made available. Caller must hold ipr.mtx
+func (ipr *IPRange) putIndex(idx uint64) error {
+	if ipr.isExcluded(idx) {
+		ipr.held[idx] = struct{}{}
+		return nil
+	}
+	return ipr.freeID.PutCounter(idx)
+}
+
+// holdExclusion - Hold back all free addresses of an exclusion entry. Addresses
+// in use are held back once they are released. Caller must hold ipr.mtx
+func (ipr *IPRange) holdExclusion(ex ipExclusion) {
+	if ex.empty {
+		return
+	}
+	for idx := ex.first; ; idx++ {
+		if _, ok := ipr.held[idx]; !ok {
+			if ipr.freeID.ReserveCounter(idx) == nil {
+				ipr.held[idx] = struct{}{}
+			}
+		}
+		if idx == ex.last {
+			break
+		}
+	}
+}
+
+// releaseExclusion - Make the held back addresses of an exclusion entry available,
+// unless they are covered by other exclusions. Caller must hold ipr.mtx
+func (ipr *IPRange) releaseExclusion(ex ipExclusion) {
+	if ex.empty {
+		return
+	}
+	for idx := ex.first; ; idx++ {
+		if _, ok := ipr.held[idx]; ok && !ipr.isExcluded(idx) {
+			delete(ipr.held, idx)
+			ipr.freeID.PutCounter(idx)
+		}
+		if idx == ex.last {
+			break
+		}
+	}
+}
+
+// addExclusion - Add an entry to a named exclusion set. Caller must hold ipr.mtx
+func (ipr *IPRange) addExclusion(name string, excl string) error {
+	ex, err := ipr.newExclusion(excl)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range ipr.excl[name] {
+		if e.spec == ex.spec {
+			return &IPAMError{Kind: ErrIPAMExclusionExists, Msg: "ip exclusion exists"}
+		}
+	}
+
+	ipr.excl[name] = append(ipr.excl[name], ex)
+	ipr.holdExclusion(ex)
+
+	return nil
+}
+
+// AddIPRangeExclusion - Exclude an IP address or a sub-range from allocation in a range.
+// excl can be an IP address, a CIDR or an "a-b" range and is added to the named exclusion
+// set. Addresses in use stay allocated, but are not handed out again once released
+func (ipa *IPAllocator) AddIPRangeExclusion(cluster string, cidr string, name string, excl string) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalExclusionAdd, Cluster: cluster, Range: cidr, Args: []string{name, excl}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.AddIPRangeExclusion(cluster, cidr, name, excl)
+	}); ok {
+		return err
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	return ipamContext(ipr.addExclusion(name, excl), cluster, cidr)
+}
+
+// DeleteIPRangeExclusion - Remove an entry from a named exclusion set of a range.
+// If excl is empty, the whole exclusion set is removed
+func (ipa *IPAllocator) DeleteIPRangeExclusion(cluster string, cidr string, name string, excl string) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalExclusionDelete, Cluster: cluster, Range: cidr, Args: []string{name, excl}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.DeleteIPRangeExclusion(cluster, cidr, name, excl)
+	}); ok {
+		return err
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	exs, ok := ipr.excl[name]
+	if !ok {
+		return &IPAMError{Kind: ErrIPAMExclusionNotFound, Msg: "no such ip exclusion", Cluster: cluster, Range: cidr}
+	}
+
+	var removed []ipExclusion
+	var remain []ipExclusion
+	for _, ex := range exs {
+		if excl == "" || ex.spec == excl {
+			removed = append(removed, ex)
+		} else {
+			remain = append(remain, ex)
+		}
+	}
+
+	if len(removed) == 0 {
+		return &IPAMError{Kind: ErrIPAMExclusionNotFound, Msg: "no such ip exclusion", Cluster: cluster, Range: cidr}
+	}
+
+	if len(remain) == 0 {
+		delete(ipr.excl, name)
+	} else {
+		ipr.excl[name] = remain
+	}
+
+	for _, ex := range removed {
+		ipr.releaseExclusion(ex)
+	}
+
+	return nil
+}
+
+// exclusions - Get the exclusion sets of the range. Caller must hold ipr.mtx
+func (ipr *IPRange) exclusions() map[string][]string {
+	excls := make(map[string][]string)
+	for name, exs := range ipr.excl {
+		for _, ex := range exs {
+			excls[name] = append(excls[name], ex.spec)
+		}
+	}
+	return excls
+}
+
+// ListIPRangeExclusions - Get the named exclusion sets of a range
+func (ipa *IPAllocator) ListIPRangeExclusions(cluster string, cidr string) (map[string][]string, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	return ipr.exclusions(), nil
+}
+
+// ListExcludedIPs - Get the IP addresses of a range which are held back by exclusions
+func (ipa *IPAllocator) ListExcludedIPs(cluster string, cidr string) ([]net.IP, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	held := make([]uint64, 0, len(ipr.held))
+	for idx := range ipr.held {
+		held = append(held, idx)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+
+	ips := make([]net.IP, 0, len(held))
+	for _, idx := range held {
+		ips = append(ips, addIPIndex(ipr.baseIP(), idx))
+	}
+
+	return ips, nil
+}
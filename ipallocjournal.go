@@ -0,0 +1,520 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IPAMJournalOp - Operation of an IPAM journal entry
+type IPAMJournalOp string
+
+// IPAM journal operations
+const (
+	IPAMJournalAllocate          IPAMJournalOp = "allocate"
+	IPAMJournalReserve           IPAMJournalOp = "reserve"
+	IPAMJournalRelease           IPAMJournalOp = "release"
+	IPAMJournalRangeAdd          IPAMJournalOp = "range-add"
+	IPAMJournalRangeDelete       IPAMJournalOp = "range-delete"
+	IPAMJournalRangeDeleteForce  IPAMJournalOp = "range-delete-force"
+	IPAMJournalRangeResize       IPAMJournalOp = "range-resize"
+	IPAMJournalRangePriority     IPAMJournalOp = "range-priority"
+	IPAMJournalRangeSharing      IPAMJournalOp = "range-sharing"
+	IPAMJournalRangeStrategy     IPAMJournalOp = "range-strategy"
+	IPAMJournalExclusionAdd      IPAMJournalOp = "exclusion-add"
+	IPAMJournalExclusionDelete   IPAMJournalOp = "exclusion-delete"
+	IPAMJournalLeaseRenew        IPAMJournalOp = "lease-renew"
+	IPAMJournalLeaseExpire       IPAMJournalOp = "lease-expire"
+	IPAMJournalQuarantineRelease IPAMJournalOp = "quarantine-release"
+)
+
+// IPAMJournalResultOK - Result of a journal entry of a successful mutation
+const IPAMJournalResultOK = "ok"
+
+// IPAMJournalEntry - A mutation of the IP allocator
+// IP is the allocated IP address for allocations and Args holds the operation
+// specific arguments, like the new range of a resize or the ttl of a lease.
+// Result is IPAMJournalResultOK or the error of a failed mutation
+type IPAMJournalEntry struct {
+	Time    time.Time     `json:"time"`
+	Op      IPAMJournalOp `json:"op"`
+	Cluster string        `json:"cluster,omitempty"`
+	Range   string        `json:"range,omitempty"`
+	Ident   string        `json:"ident,omitempty"`
+	IP      string        `json:"ip,omitempty"`
+	Args    []string      `json:"args,omitempty"`
+	Result  string        `json:"result"`
+}
+
+// IPAMJournal - Audit journal of IPAM mutations
+// Append adds the entries of a mutation, which must be persisted once it returns
+type IPAMJournal interface {
+	Append(ents ...IPAMJournalEntry) error
+	Entries() ([]IPAMJournalEntry, error)
+}
+
+// ipamJournal - Journal set on an allocator. Its lock serializes the mutations journaled
+// to it and err is set once an append failed
+type ipamJournal struct {
+	mtx     sync.Mutex
+	journal IPAMJournal
+	err     error
+}
+
+// SetIPAMJournal - Append every mutation of the allocator to a journal. Mutations are
+// serialized while a journal is set, so that the journal has them in the order they
+// were applied. A mutation whose entries can't be appended stays applied but fails with
+// ErrIPAMJournal, as do all mutations after it till a journal is set again. A nil
+// journal disables journaling
+func (ipa *IPAllocator) SetIPAMJournal(journal IPAMJournal) {
+	ipa.mtx.RLock()
+	old := ipa.journal
+	ipa.mtx.RUnlock()
+
+	// Wait for the mutations journaled to the old journal
+	if old != nil {
+		old.mtx.Lock()
+		defer old.mtx.Unlock()
+	}
+
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.journal = nil
+	if journal != nil {
+		ipa.journal = &ipamJournal{journal: journal}
+	}
+}
+
+// ipamJournalOp - Journal entries of a mutation in progress
+type ipamJournalOp struct {
+	jnl  *ipamJournal
+	now  time.Time
+	ents []IPAMJournalEntry
+}
+
+// failed - Get the error of mutations on a journal an append failed on
+func (jnl *ipamJournal) failed(ent *IPAMJournalEntry) error {
+	err := &IPAMError{Kind: ErrIPAMJournal, Msg: "ipam journal append failed: " + jnl.err.Error()}
+	if ent != nil {
+		err.Cluster = ent.Cluster
+		err.Range = ent.Range
+		err.Ident = ent.Ident
+	}
+	return err
+}
+
+// journalStart - Start a journaled mutation. It returns nil if no journal is set,
+// else the mutation is serialized till done is called. Hooks must not be called
+// before done, so the events of the mutation are emitted after it
+func (ipa *IPAllocator) journalStart(ents ...IPAMJournalEntry) (*ipamJournalOp, error) {
+	for {
+		ipa.mtx.RLock()
+		jnl := ipa.journal
+		ipa.mtx.RUnlock()
+		if jnl == nil {
+			return nil, nil
+		}
+
+		jnl.mtx.Lock()
+
+		ipa.mtx.RLock()
+		cur, now := ipa.journal, ipa.now()
+		ipa.mtx.RUnlock()
+
+		// The journal was replaced while waiting for it
+		if cur != jnl {
+			jnl.mtx.Unlock()
+			continue
+		}
+
+		if jnl.err != nil {
+			jnl.mtx.Unlock()
+			var ent *IPAMJournalEntry
+			if len(ents) != 0 {
+				ent = &ents[0]
+			}
+			return nil, jnl.failed(ent)
+		}
+
+		return &ipamJournalOp{jnl: jnl, now: now, ents: ents}, nil
+	}
+}
+
+// done - Append the entries of a mutation with its result and the IP addresses it
+// allocated, if any. It returns the error of the mutation, or ErrIPAMJournal if the
+// entries of a successful mutation could not be appended
+func (jo *ipamJournalOp) done(err error, ips ...net.IP) error {
+	if jo == nil {
+		return err
+	}
+	defer jo.jnl.mtx.Unlock()
+
+	if len(jo.ents) == 0 {
+		return err
+	}
+
+	result := IPAMJournalResultOK
+	if err != nil {
+		result = err.Error()
+	}
+	for i := range jo.ents {
+		jo.ents[i].Time = jo.now
+		jo.ents[i].Result = result
+		if i < len(ips) && ips[i] != nil && err == nil {
+			jo.ents[i].IP = ips[i].String()
+		}
+	}
+
+	if aerr := jo.jnl.journal.Append(jo.ents...); aerr != nil {
+		jo.jnl.err = aerr
+		if err == nil {
+			return jo.jnl.failed(&jo.ents[0])
+		}
+	}
+	return err
+}
+
+// IpAllocatorReplay - Create a new allocator by replaying the successful mutations of a
+// journal. Allocations take the IP addresses they got in the order they got them.
+// Quarantined IP addresses are not journaled and are found again by the conflict checker
+func IpAllocatorReplay(ents []IPAMJournalEntry) (*IPAllocator, error) {
+	ipa := IpAllocatorNew()
+
+	for i := range ents {
+		if ents[i].Result != IPAMJournalResultOK {
+			continue
+		}
+		if err := ipa.replayEntry(&ents[i]); err != nil {
+			return nil, &IPAMBatchError{Index: i, Err: err}
+		}
+	}
+
+	return ipa, nil
+}
+
+// IpAllocatorFromJournal - Create a new allocator by replaying a journal
+func IpAllocatorFromJournal(journal IPAMJournal) (*IPAllocator, error) {
+	ents, err := journal.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return IpAllocatorReplay(ents)
+}
+
+// journalArg - Get an argument of a journal entry
+func journalArg(ent *IPAMJournalEntry, i int) (string, error) {
+	if i >= len(ent.Args) {
+		return "", &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam journal entry", Cluster: ent.Cluster, Range: ent.Range}
+	}
+	return ent.Args[i], nil
+}
+
+// journalIntArg - Get an integer argument of a journal entry
+func journalIntArg(ent *IPAMJournalEntry, i int) (int, error) {
+	arg, err := journalArg(ent, i)
+	if err != nil {
+		return 0, err
+	}
+	val, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam journal entry", Cluster: ent.Cluster, Range: ent.Range}
+	}
+	return val, nil
+}
+
+// replayLease - Set the lease of a replayed allocation to ttl from the time of the entry
+func (ipa *IPAllocator) replayLease(ent *IPAMJournalEntry, expire bool) error {
+	addr, err := parseIPAMAddr(ent.IP)
+	if err != nil {
+		return ipamContext(err, ent.Cluster, ent.Range)
+	}
+	IP := ipamNetIP(addr)
+
+	_, cidr, err := ipamRangeKey(ent.Range)
+	if err != nil {
+		return ipamContext(err, ent.Cluster, cidr)
+	}
+
+	var ttl time.Duration
+	if !expire {
+		arg, err := journalArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		if ttl, err = time.ParseDuration(arg); err != nil {
+			return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip lease ttl", Cluster: ent.Cluster, Range: ent.Range}
+		}
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(ent.Cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	key := allocKey(ent.Ident, diffIPIndex(ipr.baseIP(), IP))
+	if _, ok := ipr.ident[key]; !ok {
+		return &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - key not found", Cluster: ent.Cluster, Range: ent.Range, IP: IP, Ident: ent.Ident}
+	}
+
+	if expire {
+		return ipr.dropKey(key)
+	}
+	ipr.lease[key] = ent.Time.Add(ttl)
+	return nil
+}
+
+// replayAllocate - Take the IP address of an allocation out of its range the way the
+// allocation took it, so that the free IP addresses are handed out in the same order.
+// Like the allocation, it creates the cluster of the range if it doesn't exist
+func (ipa *IPAllocator) replayAllocate(ent *IPAMJournalEntry) error {
+	addr, err := parseIPAMAddr(ent.IP)
+	if err != nil {
+		return ipamContext(err, ent.Cluster, ent.Range)
+	}
+
+	r, cidr, err := ipamRangeKey(ent.Range)
+	if err != nil {
+		return ipamContext(err, ent.Cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	ipCPool, ipr, err := ipa.getIPRangeAdd(ent.Cluster, r, cidr, evs)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	if err := ipr.reserveIP(ent.Ident, ipamNetIP(addr), true); err != nil {
+		return ipamContext(err, ent.Cluster, ent.Range)
+	}
+	return nil
+}
+
+// replayEntry - Apply a journal entry to the allocator
+func (ipa *IPAllocator) replayEntry(ent *IPAMJournalEntry) error {
+	switch ent.Op {
+	case IPAMJournalAllocate:
+		if err := ipa.replayAllocate(ent); err != nil {
+			return err
+		}
+		if len(ent.Args) != 0 {
+			return ipa.replayLease(ent, false)
+		}
+		return nil
+	case IPAMJournalReserve:
+		return ipa.ReserveIP(ent.Cluster, ent.Range, ent.Ident, ent.IP)
+	case IPAMJournalRelease:
+		if ent.Range == "" {
+			return ipa.DeAllocateIPFromCluster(ent.Cluster, ent.Ident, ent.IP)
+		}
+		return ipa.DeAllocateIP(ent.Cluster, ent.Range, ent.Ident, ent.IP)
+	case IPAMJournalRangeAdd:
+		return ipa.AddIPRange(ent.Cluster, ent.Range)
+	case IPAMJournalRangeDelete, IPAMJournalRangeDeleteForce:
+		_, err := ipa.DeleteIPRangeForce(ent.Cluster, ent.Range)
+		return err
+	case IPAMJournalRangeResize:
+		newCidr, err := journalArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		return ipa.ResizeIPRange(ent.Cluster, ent.Range, newCidr)
+	case IPAMJournalRangePriority:
+		prio, err := journalIntArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		return ipa.SetIPRangePriority(ent.Cluster, ent.Range, prio)
+	case IPAMJournalRangeSharing:
+		mode, err := journalIntArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		return ipa.SetIPRangeSharing(ent.Cluster, ent.Range, IPAMSharing(mode))
+	case IPAMJournalRangeStrategy:
+		strategy, err := journalIntArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		return ipa.SetIPRangeStrategy(ent.Cluster, ent.Range, IPAMStrategy(strategy))
+	case IPAMJournalExclusionAdd, IPAMJournalExclusionDelete:
+		name, err := journalArg(ent, 0)
+		if err != nil {
+			return err
+		}
+		excl, err := journalArg(ent, 1)
+		if err != nil {
+			return err
+		}
+		if ent.Op == IPAMJournalExclusionAdd {
+			return ipa.AddIPRangeExclusion(ent.Cluster, ent.Range, name, excl)
+		}
+		return ipa.DeleteIPRangeExclusion(ent.Cluster, ent.Range, name, excl)
+	case IPAMJournalLeaseRenew:
+		return ipa.replayLease(ent, false)
+	case IPAMJournalLeaseExpire:
+		return ipa.replayLease(ent, true)
+	case IPAMJournalQuarantineRelease:
+		// Quarantines are not journaled, so there is nothing to release
+		return nil
+	}
+
+	return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam journal op", Cluster: ent.Cluster, Range: ent.Range}
+}
+
+// IPAMRingJournal - IPAM journal keeping the latest entries in memory
+type IPAMRingJournal struct {
+	mtx     sync.Mutex
+	ents    []IPAMJournalEntry
+	next    int
+	full    bool
+	dropped uint64
+}
+
+// IPAMRingJournalNew - Create a new in-memory IPAM journal holding up to size entries
+func IPAMRingJournalNew(size int) *IPAMRingJournal {
+	if size <= 0 {
+		size = 1
+	}
+	return &IPAMRingJournal{ents: make([]IPAMJournalEntry, size)}
+}
+
+// Append - Add entries to the journal, overwriting the oldest ones if the journal is full
+func (rj *IPAMRingJournal) Append(ents ...IPAMJournalEntry) error {
+	rj.mtx.Lock()
+	defer rj.mtx.Unlock()
+
+	for _, ent := range ents {
+		if rj.full {
+			rj.dropped++
+		}
+		rj.ents[rj.next] = ent
+		rj.next++
+		if rj.next == len(rj.ents) {
+			rj.next = 0
+			rj.full = true
+		}
+	}
+
+	return nil
+}
+
+// Entries - Get the entries of the journal, oldest first
+func (rj *IPAMRingJournal) Entries() ([]IPAMJournalEntry, error) {
+	rj.mtx.Lock()
+	defer rj.mtx.Unlock()
+
+	if !rj.full {
+		return append([]IPAMJournalEntry(nil), rj.ents[:rj.next]...), nil
+	}
+	ents := append([]IPAMJournalEntry(nil), rj.ents[rj.next:]...)
+	return append(ents, rj.ents[:rj.next]...), nil
+}
+
+// Dropped - Get the number of entries which were overwritten. A journal which dropped
+// entries can't be replayed
+func (rj *IPAMRingJournal) Dropped() uint64 {
+	rj.mtx.Lock()
+	defer rj.mtx.Unlock()
+
+	return rj.dropped
+}
+
+// IPAMFileJournal - IPAM journal appending entries to a file as JSON lines
+type IPAMFileJournal struct {
+	mtx  sync.Mutex
+	path string
+	file *os.File
+}
+
+// IPAMFileJournalNew - Open an IPAM journal file, which is created if it doesn't exist
+func IPAMFileJournalNew(path string) (*IPAMFileJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &IPAMFileJournal{path: path, file: file}, nil
+}
+
+// Append - Add entries to the journal file. They are written at once and synced to
+// disk before returning
+func (fj *IPAMFileJournal) Append(ents ...IPAMJournalEntry) error {
+	var data []byte
+	for i := range ents {
+		line, err := json.Marshal(&ents[i])
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	fj.mtx.Lock()
+	defer fj.mtx.Unlock()
+
+	if fj.file == nil {
+		return errors.New("ipam journal closed")
+	}
+	if _, err := fj.file.Write(data); err != nil {
+		return err
+	}
+	return fj.file.Sync()
+}
+
+// Entries - Get the entries of the journal file. A partially written last entry,
+// as left by a crash, is ignored
+func (fj *IPAMFileJournal) Entries() ([]IPAMJournalEntry, error) {
+	fj.mtx.Lock()
+	defer fj.mtx.Unlock()
+
+	file, err := os.Open(fj.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ents []IPAMJournalEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without newline was not completely written
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ent IPAMJournalEntry
+		if err := json.Unmarshal(line, &ent); err != nil {
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+
+	return ents, nil
+}
+
+// Close - Close the journal file
+func (fj *IPAMFileJournal) Close() error {
+	fj.mtx.Lock()
+	defer fj.mtx.Unlock()
+
+	if fj.file == nil {
+		return nil
+	}
+	err := fj.file.Close()
+	fj.file = nil
+	return err
+}
@@ -0,0 +1,295 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IPAMLease - A leased IP address allocation
+type IPAMLease struct {
+	Cluster string
+	Range   string
+	Ident   string
+	IP      net.IP
+	Expiry  time.Time
+}
+
+// IPAMLeaseExpiryHook - Called for every lease which got reclaimed after it expired
+type IPAMLeaseExpiryHook func(lease IPAMLease)
+
+// SetClock - Set the clock used for leases. A nil clock selects the wall clock
+func (ipa *IPAllocator) SetClock(now func() time.Time) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.clock = now
+}
+
+// SetIPLeaseExpiryHook - Set the hook called for reclaimed leases
+func (ipa *IPAllocator) SetIPLeaseExpiryHook(hook IPAMLeaseExpiryHook) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipa.leaseHook = hook
+}
+
+// now - Get the current time of the allocator clock. Caller must hold ipa.mtx
+func (ipa *IPAllocator) now() time.Time {
+	if ipa.clock == nil {
+		return time.Now()
+	}
+	return ipa.clock()
+}
+
+// leaseInfo - Get the lease of a key. Caller must hold ipr.mtx
+func (ipr *IPRange) leaseInfo(cluster string, cidr string, key IdentKey) IPAMLease {
+	return IPAMLease{
+		Cluster: cluster,
+		Range:   cidr,
+		Ident:   ipr.identString(key),
+		IP:      addIPIndex(ipr.baseIP(), ipr.identIdx[key]),
+		Expiry:  ipr.lease[key],
+	}
+}
+
+// AllocateNewIPWithLease - Allocate a New IP address from the given cluster and CIDR range,
+// which is reclaimed once ttl passed without the lease being renewed
+func (ipa *IPAllocator) AllocateNewIPWithLease(cluster string, cidr string, idString string, ttl time.Duration) (ip net.IP, err error) {
+	r, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalAllocate, Cluster: cluster, Range: cidr, Ident: idString, Args: []string{ttl.String()}})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = jo.done(err, ip) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) (err error) {
+		ip, err = s.AllocateNewIPWithLease(cluster, cidr, idString, ttl)
+		return err
+	}); ok {
+		return ip, err
+	}
+
+	if ttl <= 0 {
+		return net.IP{0, 0, 0, 0}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip lease ttl"}
+	}
+
+	ipCPool, ipr, err := ipa.getIPRangeAdd(cluster, r, cidr, evs)
+	if err != nil {
+		return net.IP{0, 0, 0, 0}, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	ip, err = ipa.allocateChecked(ipr, idString)
+	if err != nil {
+		return ip, ipamContext(err, cluster, cidr)
+	}
+
+	ipr.lease[allocKey(idString, diffIPIndex(ipr.baseIP(), ip))] = ipa.now().Add(ttl)
+	evs.ipEvent(IPAMEventAllocate, cluster, cidr, ipr, idString, ip)
+
+	return ip, nil
+}
+
+// RenewIPLease - Extend the lease of an allocation to ttl from now.
+// Leases which already expired can't be renewed
+func (ipa *IPAllocator) RenewIPLease(cluster string, cidr string, idString, IPString string, ttl time.Duration) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalLeaseRenew, Cluster: cluster, Range: cidr, Ident: idString, IP: IPString, Args: []string{ttl.String()}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.RenewIPLease(cluster, cidr, idString, IPString, ttl)
+	}); ok {
+		return err
+	}
+
+	if ttl <= 0 {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip lease ttl"}
+	}
+
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+	IP := ipamNetIP(addr)
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	idx := diffIPIndex(ipr.baseIP(), IP)
+	key := allocKey(idString, idx)
+	if _, ok := ipr.ident[key]; !ok || ipr.identIdx[key] != idx {
+		return &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - key not found", Cluster: cluster, Range: cidr, IP: IP, Ident: idString}
+	}
+
+	exp, ok := ipr.lease[key]
+	if !ok {
+		return &IPAMError{Kind: ErrIPAMLeaseNotFound, Msg: "ip lease not found", Cluster: cluster, Range: cidr, IP: IP, Ident: idString}
+	}
+
+	now := ipa.now()
+	if !now.Before(exp) {
+		return &IPAMError{Kind: ErrIPAMLeaseExpired, Msg: "ip lease expired", Cluster: cluster, Range: cidr, IP: IP, Ident: idString}
+	}
+
+	ipr.lease[key] = now.Add(ttl)
+	return nil
+}
+
+// ListIPLeases - Get the leased allocations of a range
+func (ipa *IPAllocator) ListIPLeases(cluster string, cidr string) ([]IPAMLease, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	leases := make([]IPAMLease, 0, len(ipr.lease))
+	for key := range ipr.lease {
+		leases = append(leases, ipr.leaseInfo(cluster, cidr, key))
+	}
+	sortIPLeases(leases)
+
+	return leases, nil
+}
+
+// sortIPLeases - Sort leases by cluster, range, IP address and ident
+func sortIPLeases(leases []IPAMLease) {
+	sort.Slice(leases, func(i, j int) bool {
+		li, lj := leases[i], leases[j]
+		if li.Cluster != lj.Cluster {
+			return li.Cluster < lj.Cluster
+		}
+		if li.Range != lj.Range {
+			return li.Range < lj.Range
+		}
+		if c := bytes.Compare(li.IP.To16(), lj.IP.To16()); c != 0 {
+			return c < 0
+		}
+		return li.Ident < lj.Ident
+	})
+}
+
+// reclaimLeases - Release all allocations of the range with an expired lease.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) reclaimLeases(cluster string, cidr string, now time.Time) []IPAMLease {
+	var expired []IPAMLease
+
+	for key, exp := range ipr.lease {
+		if now.Before(exp) {
+			continue
+		}
+		expired = append(expired, ipr.leaseInfo(cluster, cidr, key))
+		ipr.dropKey(key)
+	}
+
+	return expired
+}
+
+// ReclaimExpiredIPs - Release all allocations with an expired lease. The expiry hook
+// is called for every reclaimed lease after the allocator locks were released
+func (ipa *IPAllocator) ReclaimExpiredIPs() (expired []IPAMLease) {
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart()
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		if jo != nil {
+			for _, lease := range expired {
+				jo.ents = append(jo.ents, IPAMJournalEntry{Op: IPAMJournalLeaseExpire, Cluster: lease.Cluster,
+					Range: lease.Range, Ident: lease.Ident, IP: lease.IP.String()})
+			}
+		}
+		jo.done(nil)
+	}()
+
+	if ok, err := ipa.stored(evs, nil, func(s *IPAllocator) error {
+		if expired = s.ReclaimExpiredIPs(); len(expired) == 0 {
+			return errIPAMNoChange
+		}
+		return nil
+	}); ok {
+		if err != nil {
+			return nil
+		}
+		ipa.mtx.RLock()
+		evs.leasesExpired(expired)
+		ipa.mtx.RUnlock()
+		return expired
+	}
+
+	ipa.mtx.RLock()
+	now := ipa.now()
+	for name, ipCPool := range ipa.ipBlocks {
+		ipCPool.mtx.RLock()
+		for cidr, ipr := range ipCPool.pool {
+			ipr.mtx.Lock()
+			reclaimed := ipr.reclaimLeases(name, cidr, now)
+			for _, lease := range reclaimed {
+				evs.ipEvent(IPAMEventRelease, name, cidr, ipr, lease.Ident, lease.IP)
+			}
+			expired = append(expired, reclaimed...)
+			ipr.mtx.Unlock()
+		}
+		ipCPool.mtx.RUnlock()
+	}
+	sortIPLeases(expired)
+	evs.leasesExpired(expired)
+	ipa.mtx.RUnlock()
+
+	return expired
+}
+
+// StartIPLeaseGC - Reclaim expired leases periodically till the returned stop function is called
+func (ipa *IPAllocator) StartIPLeaseGC(interval time.Duration) func() {
+	var once sync.Once
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ipa.ReclaimExpiredIPs()
+			}
+		}
+	}()
+
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IPAMRange - IP range of the allocator, either a CIDR prefix or an inclusive
+// "a-b" range of IP addresses. The zero value is not a valid range
+type IPAMRange struct {
+	prefix netip.Prefix
+	start  netip.Addr
+	end    netip.Addr
+}
+
+// IPAMPrefixRange - Get the range of a CIDR prefix. Host bits are kept, so that
+// allocation from a prefix like 10.0.0.10/24 starts at 10.0.0.10
+func IPAMPrefixRange(prefix netip.Prefix) IPAMRange {
+	return IPAMRange{prefix: prefix}
+}
+
+// IPAMAddrRange - Get the range of IP addresses from start to end
+func IPAMAddrRange(start, end netip.Addr) IPAMRange {
+	return IPAMRange{start: start, end: end}
+}
+
+// ParseIPAMRange - Parse a CIDR prefix or an "a-b" range string
+func ParseIPAMRange(s string) (IPAMRange, error) {
+	if !strings.Contains(s, "-") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return IPAMRange{}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid CIDR", Range: s}
+		}
+		return IPAMPrefixRange(prefix), nil
+	}
+
+	ipBlock := strings.Split(s, "-")
+	if len(ipBlock) != 2 {
+		return IPAMRange{}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip-range", Range: s}
+	}
+	start, err1 := netip.ParseAddr(ipBlock[0])
+	end, err2 := netip.ParseAddr(ipBlock[1])
+	if err1 != nil || err2 != nil || start.Zone() != "" || end.Zone() != "" {
+		return IPAMRange{}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip-range ips", Range: s}
+	}
+
+	r := IPAMAddrRange(start, end)
+	if !r.IsValid() {
+		return IPAMRange{}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip-types ips", Range: s}
+	}
+
+	return r, nil
+}
+
+// IsValid - Check if the range is a valid prefix or a range of addresses of one family.
+// IPv4-mapped IPv6 addresses count as IPv4 addresses
+func (r IPAMRange) IsValid() bool {
+	if r.prefix.IsValid() {
+		return true
+	}
+	if !r.start.IsValid() || !r.end.IsValid() {
+		return false
+	}
+	return r.start.Unmap().Is4() == r.end.Unmap().Is4()
+}
+
+// IsPrefix - Check if the range is a CIDR prefix
+func (r IPAMRange) IsPrefix() bool {
+	return r.prefix.IsValid()
+}
+
+// Prefix - Get the CIDR prefix of the range, which is the zero prefix for an "a-b" range
+func (r IPAMRange) Prefix() netip.Prefix {
+	return r.prefix
+}
+
+// Start - Get the first IP address covered by the range
+func (r IPAMRange) Start() netip.Addr {
+	if r.prefix.IsValid() {
+		return r.prefix.Masked().Addr()
+	}
+	return r.start
+}
+
+// End - Get the last IP address covered by the range
+func (r IPAMRange) End() netip.Addr {
+	if !r.prefix.IsValid() {
+		return r.end
+	}
+	b := r.prefix.Addr().AsSlice()
+	for i := range b {
+		netBits := r.prefix.Bits() - i*8
+		switch {
+		case netBits <= 0:
+			b[i] = 0xff
+		case netBits < 8:
+			b[i] |= 0xff >> netBits
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Contains - Check if an IP address is covered by the range.
+// IPv4-mapped IPv6 addresses count as IPv4 addresses
+func (r IPAMRange) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if r.prefix.IsValid() {
+		prefix := r.prefix
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Contains(addr)
+	}
+	return r.start.Unmap().Compare(addr) <= 0 && addr.Compare(r.end.Unmap()) <= 0
+}
+
+// String - Get the string of the range, which is the key of the range in its cluster
+func (r IPAMRange) String() string {
+	if r.prefix.IsValid() {
+		return r.prefix.String()
+	}
+	if !r.IsValid() {
+		return "invalid IPAMRange"
+	}
+	return r.start.String() + "-" + r.end.String()
+}
+
+// ipamRangeKey - Parse a range string at the entry of the string API. It returns the
+// range along with its canonical string, which is the key of the range in its cluster.
+// On error, the string is returned as it is
+func ipamRangeKey(cidr string) (IPAMRange, string, error) {
+	r, err := ParseIPAMRange(cidr)
+	if err != nil {
+		return IPAMRange{}, cidr, err
+	}
+	return r, r.String(), nil
+}
+
+// parseIPAMAddr - Parse an IP address string as the string API takes it
+func parseIPAMAddr(IPString string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(IPString)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid IP String"}
+	}
+	return addr, nil
+}
+
+// ipamAddr - Convert an IP address of the allocator to a netip.Addr.
+// IPv4 addresses are always returned in their 4-byte form
+func ipamAddr(IP net.IP) netip.Addr {
+	if ip4 := IP.To4(); ip4 != nil {
+		IP = ip4
+	}
+	addr, _ := netip.AddrFromSlice(IP)
+	return addr
+}
+
+// ipamNetIP - Convert a netip.Addr to an IP address of the allocator
+func ipamNetIP(addr netip.Addr) net.IP {
+	return net.IP(addr.AsSlice())
+}
+
+// checkIPAMRange - Check that a range passed to the netip API is valid
+func checkIPAMRange(r IPAMRange) error {
+	if !r.IsValid() {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip range"}
+	}
+	return nil
+}
+
+// checkIPAMAddr - Check that an IP address passed to the netip API is valid
+func checkIPAMAddr(addr netip.Addr) error {
+	if !addr.IsValid() || addr.Zone() != "" {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid IP address"}
+	}
+	return nil
+}
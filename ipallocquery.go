@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"sort"
+	"strconv"
+)
+
+// IPAMAllocInfo - Information about an allocated IP address
+// Idents maps the idents sharing the IP address to their refcounts.
+// An allocation made without an ident is listed as IPAMNoIdent
+type IPAMAllocInfo struct {
+	IP     net.IP
+	Idents map[string]int
+}
+
+// IPAMRangeInfo - Allocation totals of an IP range
+// Excluded counts the addresses held back by exclusions, Quarantined the ones
+// found in use on the network and Utilization is the percentage of addresses in use
+type IPAMRangeInfo struct {
+	Cluster     string
+	Range       string
+	Size        uint64
+	Used        uint64
+	Free        uint64
+	Excluded    uint64
+	Quarantined uint64
+	Utilization float64
+}
+
+// IPAMIdentInfo - Location of an ident allocation
+type IPAMIdentInfo struct {
+	Cluster  string
+	Range    string
+	Ident    string
+	IP       net.IP
+	RefCount int
+}
+
+// ListIPClusters - Get the names of all IP clusters
+func (ipa *IPAllocator) ListIPClusters() []string {
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
+
+	clusters := make([]string, 0, len(ipa.ipBlocks))
+	for name := range ipa.ipBlocks {
+		clusters = append(clusters, name)
+	}
+	sort.Strings(clusters)
+
+	return clusters
+}
+
+// ListIPRanges - Get all IP ranges of a cluster
+func (ipa *IPAllocator) ListIPRanges(cluster string) ([]string, error) {
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
+
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		return nil, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster}
+	}
+
+	ipCPool.mtx.RLock()
+	defer ipCPool.mtx.RUnlock()
+
+	ranges := make([]string, 0, len(ipCPool.pool))
+	for cidr := range ipCPool.pool {
+		ranges = append(ranges, cidr)
+	}
+	sort.Strings(ranges)
+
+	return ranges, nil
+}
+
+// ListAllocatedIPs - Get all allocated IP addresses of a range with their idents
+func (ipa *IPAllocator) ListAllocatedIPs(cluster string, cidr string) ([]IPAMAllocInfo, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return nil, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return nil, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	return ipr.allocatedIPs(), nil
+}
+
+// identString - Get the ident of a key. Allocations made without an ident are
+// keyed by their index and are returned as IPAMNoIdent
+func (ipr *IPRange) identString(key IdentKey) string {
+	if string(key) == strconv.FormatUint(ipr.identIdx[key], 10) {
+		return IPAMNoIdent
+	}
+	return string(key)
+}
+
+// allocatedIPs - Get all allocated IP addresses of the range. Caller must hold ipr.mtx
+func (ipr *IPRange) allocatedIPs() []IPAMAllocInfo {
+	used, _, _ := ipr.freeID.getState()
+
+	idents := make(map[uint64]map[string]int)
+	for key, ref := range ipr.ident {
+		idx := ipr.identIdx[key]
+		if idents[idx] == nil {
+			idents[idx] = make(map[string]int)
+		}
+		idents[idx][ipr.identString(key)] = ref
+	}
+
+	allocs := make([]IPAMAllocInfo, 0, len(used))
+	for _, idx := range used {
+		if _, ok := ipr.held[idx]; ok {
+			continue
+		}
+		if _, ok := ipr.quar[idx]; ok {
+			continue
+		}
+		ai := IPAMAllocInfo{IP: addIPIndex(ipr.baseIP(), idx), Idents: idents[idx]}
+		if ai.Idents == nil {
+			ai.Idents = make(map[string]int)
+		}
+		allocs = append(allocs, ai)
+	}
+
+	return allocs
+}
+
+// GetIPRangeInfo - Get the allocation totals of a range
+func (ipa *IPAllocator) GetIPRangeInfo(cluster string, cidr string) (IPAMRangeInfo, error) {
+	_, cidr, err := ipamRangeKey(cidr)
+	if err != nil {
+		return IPAMRangeInfo{}, ipamContext(err, cluster, cidr)
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return IPAMRangeInfo{}, err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	return ipr.info(cluster, cidr), nil
+}
+
+// info - Get the allocation totals of the range. Caller must hold ipr.mtx
+func (ipr *IPRange) info(cluster string, cidr string) IPAMRangeInfo {
+	ri := IPAMRangeInfo{Cluster: cluster, Range: cidr}
+	ri.Size = ipr.freeID.CounterSize()
+	ri.Free = ipr.freeID.CounterFree()
+	ri.Excluded = uint64(len(ipr.held))
+	ri.Quarantined = uint64(len(ipr.quar))
+	ri.Used = ri.Size - ri.Free - ri.Excluded - ri.Quarantined
+	if ri.Size != 0 {
+		ri.Utilization = float64(ri.Used) * 100 / float64(ri.Size)
+	}
+	return ri
+}
+
+// ListIPRangeInfo - Get the allocation totals of all ranges of a cluster
+func (ipa *IPAllocator) ListIPRangeInfo(cluster string) ([]IPAMRangeInfo, error) {
+	ranges, err := ipa.ListIPRanges(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]IPAMRangeInfo, 0, len(ranges))
+	for _, cidr := range ranges {
+		ri, err := ipa.GetIPRangeInfo(cluster, cidr)
+		if err != nil {
+			// Range deleted in the meantime
+			continue
+		}
+		infos = append(infos, ri)
+	}
+
+	return infos, nil
+}
+
+// idents - Get the idents sharing an allocated index. Caller must hold ipr.mtx
+func (ipr *IPRange) idents(idx uint64) map[string]int {
+	idents := make(map[string]int)
+	for key, ref := range ipr.ident {
+		if ipr.identIdx[key] == idx {
+			idents[ipr.identString(key)] = ref
+		}
+	}
+	return idents
+}
+
+// LookupIP - Get the idents sharing an allocated IP address of a cluster and
+// the range it was allocated from
+func (ipa *IPAllocator) LookupIP(cluster string, IPString string) (IPAMAllocInfo, string, error) {
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return IPAMAllocInfo{}, "", ipamContext(err, cluster, "")
+	}
+	IP := ipamNetIP(addr)
+
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
+
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		return IPAMAllocInfo{}, "", &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: cluster}
+	}
+
+	ipCPool.mtx.RLock()
+	defer ipCPool.mtx.RUnlock()
+
+	for cidr, ipr := range ipCPool.pool {
+		if !ipr.Contains(IP) {
+			continue
+		}
+
+		ipr.mtx.Lock()
+		defer ipr.mtx.Unlock()
+
+		idx := diffIPIndex(ipr.baseIP(), IP)
+		if _, ok := ipr.users[idx]; !ok {
+			return IPAMAllocInfo{}, cidr, &IPAMError{Kind: ErrIPAMIPNotAllocated, Msg: "ip not allocated", Cluster: cluster, Range: cidr, IP: IP}
+		}
+
+		return IPAMAllocInfo{IP: addIPIndex(ipr.baseIP(), idx), Idents: ipr.idents(idx)}, cidr, nil
+	}
+
+	return IPAMAllocInfo{}, "", &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, IP: IP}
+}
+
+// LookupIdent - Get the allocations of an ident in all clusters and ranges
+func (ipa *IPAllocator) LookupIdent(idString string) ([]IPAMIdentInfo, error) {
+	var infos []IPAMIdentInfo
+
+	if idString == IPAMNoIdent {
+		return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam ident"}
+	}
+
+	key := getIdentKey(idString)
+
+	ipa.mtx.RLock()
+	for name, ipCPool := range ipa.ipBlocks {
+		ipCPool.mtx.RLock()
+		for cidr, ipr := range ipCPool.pool {
+			ipr.mtx.Lock()
+			if ref, ok := ipr.ident[key]; ok {
+				infos = append(infos, IPAMIdentInfo{
+					Cluster:  name,
+					Range:    cidr,
+					Ident:    string(key),
+					IP:       addIPIndex(ipr.baseIP(), ipr.identIdx[key]),
+					RefCount: ref,
+				})
+			}
+			ipr.mtx.Unlock()
+		}
+		ipCPool.mtx.RUnlock()
+	}
+	ipa.mtx.RUnlock()
+
+	if len(infos) == 0 {
+		return nil, &IPAMError{Kind: ErrIPAMIdentNotFound, Msg: "ip Range - Ident not found", Ident: idString}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Cluster != infos[j].Cluster {
+			return infos[i].Cluster < infos[j].Cluster
+		}
+		return infos[i].Range < infos[j].Range
+	})
+
+	return infos, nil
+}
@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+)
+
+// resizeIndex - Get the index in the resized range of an index of the range.
+// It returns false if the IP address can't be allocated from the resized range
+func (ipr *IPRange) resizeIndex(newIPR *IPRange, idx uint64) (uint64, bool) {
+	nIdx := diffIPIndex(newIPR.baseIP(), addIPIndex(ipr.baseIP(), idx))
+	C := newIPR.freeID
+	if nIdx == ^uint64(0) || nIdx < C.begin || nIdx-C.begin >= C.len {
+		return 0, false
+	}
+	return nIdx, true
+}
+
+// resizeTo - Move the complete state of the range to the resized range. Caller must hold ipr.mtx
+func (ipr *IPRange) resizeTo(newIPR *IPRange) error {
+	var nUsed []uint64
+	var nFree []uint64
+
+	used, free, next := ipr.freeID.getState()
+	for _, idx := range used {
+		_, held := ipr.held[idx]
+		_, quar := ipr.quar[idx]
+		nIdx, ok := ipr.resizeIndex(newIPR, idx)
+		if !ok {
+			if held || quar {
+				continue
+			}
+			return &IPAMError{Kind: ErrIPAMRangeInUse, Msg: "ip range resize drops IP in use", IP: addIPIndex(ipr.baseIP(), idx)}
+		}
+		nUsed = append(nUsed, nIdx)
+		if held {
+			newIPR.held[nIdx] = struct{}{}
+		}
+		if quar {
+			newIPR.quar[nIdx] = struct{}{}
+		}
+	}
+
+	// The order of returned addresses can only be kept if the resized range has
+	// no new addresses below the ones handed out so far
+	C := newIPR.freeID
+	nNext := C.begin
+	oBegin := addIPIndex(ipr.baseIP(), ipr.freeID.begin).To16()
+	nBegin := addIPIndex(newIPR.baseIP(), C.begin).To16()
+	if bytes.Compare(nBegin, oBegin) >= 0 {
+		nextIP := addIPIndex(ipr.baseIP(), next)
+		if bytes.Compare(nextIP.To16(), nBegin) > 0 {
+			nNext = diffIPIndex(newIPR.baseIP(), nextIP)
+			if nNext == ^uint64(0) || nNext-C.begin > C.len {
+				nNext = C.begin + C.len
+			}
+		}
+		for _, idx := range free {
+			if nIdx, ok := ipr.resizeIndex(newIPR, idx); ok && nIdx < nNext {
+				nFree = append(nFree, nIdx)
+			}
+		}
+	}
+
+	if err := C.setState(nUsed, nFree, nNext); err != nil {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip range resize counter failure"}
+	}
+
+	for key, ref := range ipr.ident {
+		nIdx, _ := ipr.resizeIndex(newIPR, ipr.identIdx[key])
+		nKey := key
+		if ipr.identString(key) == IPAMNoIdent {
+			nKey = allocKey(IPAMNoIdent, nIdx)
+		}
+		newIPR.ident[nKey] = ref
+		newIPR.identIdx[nKey] = nIdx
+		newIPR.users[nIdx]++
+		if exp, ok := ipr.lease[key]; ok {
+			newIPR.lease[nKey] = exp
+		}
+	}
+
+	if ipr.fOK {
+		newIPR.first, newIPR.fOK = ipr.resizeIndex(newIPR, ipr.first)
+	}
+
+	for name, exs := range ipr.excl {
+		for _, ex := range exs {
+			nEx, err := newIPR.newExclusion(ex.spec)
+			if err != nil {
+				return err
+			}
+			newIPR.excl[name] = append(newIPR.excl[name], nEx)
+			// Addresses which only became part of the range are held back as well
+			newIPR.holdExclusion(nEx)
+		}
+	}
+
+	newIPR.prio = ipr.prio
+	newIPR.sharing = ipr.sharing
+	newIPR.strategy = ipr.strategy
+	newIPR.wmark = ipr.wmark
+	newIPR.seq = ipr.seq
+
+	return nil
+}
+
+// ResizeIPRange - Grow or shrink a range of a cluster in place, keeping all its
+// allocations. The range is replaced by newCidr, which can be a CIDR with another
+// prefix length or a start-end range with other bounds. Resizing fails if IP
+// addresses in use would not be part of the resized range anymore
+func (ipa *IPAllocator) ResizeIPRange(cluster string, cidr string, newCidr string) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+	newR, newCidr, err := ipamRangeKey(newCidr)
+	if err != nil {
+		return ipamContext(err, cluster, newCidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRangeResize, Cluster: cluster, Range: cidr, Args: []string{newCidr}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.ResizeIPRange(cluster, cidr, newCidr)
+	}); ok {
+		return err
+	}
+
+	newIPR, err := newIPRange(newR)
+	if err != nil {
+		return ipamContext(err, cluster, newCidr)
+	}
+
+	// Resizing is rare, so the allocator is locked exclusively instead of
+	// locking clusters for the overlap checks
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	ipCPool := ipa.ipBlocks[cluster]
+	if ipCPool == nil {
+		return &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "no such IP Cluster Pool", Cluster: cluster}
+	}
+
+	ipr := ipCPool.pool[cidr]
+	if ipr == nil {
+		return &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: cluster, Range: cidr}
+	}
+
+	if ipr.isV6() != newIPR.isV6() {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip-types ips", Cluster: cluster, Range: newCidr}
+	}
+
+	if newCidr != cidr && ipCPool.pool[newCidr] != nil {
+		return &IPAMError{Kind: ErrIPAMRangeExists, Msg: "existing IP Pool", Cluster: cluster, Range: newCidr}
+	}
+
+	if ipa.xOverlap && ipa.storePart {
+		return errIPAMStoreScope
+	}
+
+	for name, pool := range ipa.ipBlocks {
+		if name != cluster && !ipa.xOverlap {
+			continue
+		}
+		if err := pool.checkOverlap(name, newCidr, newIPR, ipr); err != nil {
+			return err
+		}
+	}
+
+	if err := ipr.resizeTo(newIPR); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	delete(ipCPool.pool, cidr)
+	ipCPool.pool[newCidr] = newIPR
+	evs.watermarks(cluster, newCidr, newIPR)
+
+	return nil
+}
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+	"strconv"
+)
+
+// IPAMSharing - How idents of a range share IP addresses
+type IPAMSharing uint8
+
+// IP address sharing modes
+const (
+	// IPAMShareFirst - All idents share the first IP address allocated from the range
+	IPAMShareFirst IPAMSharing = iota
+	// IPAMSharePort - Idents made with MakeIPAMIdent share an IP address as long as
+	// they don't use the same port and protocol
+	IPAMSharePort
+)
+
+// SetIPRangeSharing - Set how idents share IP addresses in a range.
+// The mode applies to allocations made after it was set
+func (ipa *IPAllocator) SetIPRangeSharing(cluster string, cidr string, mode IPAMSharing) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRangeSharing, Cluster: cluster, Range: cidr, Args: []string{strconv.Itoa(int(mode))}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.SetIPRangeSharing(cluster, cidr, mode)
+	}); ok {
+		return err
+	}
+
+	if mode != IPAMShareFirst && mode != IPAMSharePort {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip sharing mode", Cluster: cluster, Range: cidr}
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	ipr.sharing = mode
+	return nil
+}
+
+// identPort - Get the port and protocol of an ident
+func identPort(idString string) (uint32, string, error) {
+	_, port, proto, err := ParseIPAMIdent(string(getIdentKey(idString)))
+	if err != nil {
+		return 0, "", &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ipam ident without port", Ident: idString}
+	}
+	return port, proto, nil
+}
+
+// portConflicts - Get the indices shared by idents which an ident can't share because of
+// a port conflict, along with all indices shared by idents. Caller must hold ipr.mtx
+func (ipr *IPRange) portConflicts(port uint32, proto string) (map[uint64]struct{}, map[uint64]struct{}) {
+	conflict := make(map[uint64]struct{})
+	shared := make(map[uint64]struct{})
+
+	for key, idx := range ipr.identIdx {
+		if ipr.identString(key) == IPAMNoIdent {
+			// IP addresses allocated without an ident are never shared
+			conflict[idx] = struct{}{}
+			continue
+		}
+		shared[idx] = struct{}{}
+		kPort, kProto, err := identPort(string(key))
+		if err != nil || (kPort == port && kProto == proto) {
+			conflict[idx] = struct{}{}
+		}
+	}
+
+	return conflict, shared
+}
+
+// portIndex - Get the lowest IP address an ident can share without a port conflict,
+// or a new one if there is none. Caller must hold ipr.mtx
+func (ipr *IPRange) portIndex(idString string) (uint64, error) {
+	port, proto, err := identPort(idString)
+	if err != nil {
+		return 0, err
+	}
+
+	conflict, shared := ipr.portConflicts(port, proto)
+
+	found := false
+	var newIndex uint64
+	for idx := range shared {
+		if _, ok := conflict[idx]; ok {
+			continue
+		}
+		if !found || idx < newIndex {
+			newIndex = idx
+			found = true
+		}
+	}
+	if found {
+		return newIndex, nil
+	}
+
+	newIndex, err = ipr.newIndex(idString)
+	if err != nil {
+		return 0, &IPAMError{Kind: ErrIPAMPoolExhausted, Msg: "ip Alloc counter failure", Ident: idString}
+	}
+	return newIndex, nil
+}
+
+// portReserve - Reserve an IP address for an ident, sharing it with other idents if
+// there is no port conflict. Caller must hold ipr.mtx
+func (ipr *IPRange) portReserve(idString string, IP net.IP, idx uint64, alloc bool) error {
+	port, proto, err := identPort(idString)
+	if err != nil {
+		return err
+	}
+
+	if ipr.users[idx] > 0 {
+		conflict, _ := ipr.portConflicts(port, proto)
+		if _, ok := conflict[idx]; ok {
+			return &IPAMError{Kind: ErrIPAMIPInUse, Msg: "ip port in use", IP: IP, Ident: idString}
+		}
+		return nil
+	}
+
+	if ipr.isExcluded(idx) {
+		return &IPAMError{Kind: ErrIPAMIPExcluded, Msg: "ip excluded from range", IP: IP, Ident: idString}
+	}
+	if err := ipr.reserveIndex(idString, idx, alloc); err != nil {
+		return &IPAMError{Kind: ErrIPAMIPInUse, Msg: "ip reserve counter failure", IP: IP, Ident: idString}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// IPAMStateVersion - Version of the IPAM state format
+const IPAMStateVersion = 1
+
+// IPAMIdentState - State of an ident in an IP range
+// Ident is empty for IP addresses allocated without an ident and
+// Expiry is only set for leased allocations
+type IPAMIdentState struct {
+	Ident    string     `json:"ident"`
+	IP       string     `json:"ip"`
+	RefCount int        `json:"refCount"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+}
+
+// IPAMRangeState - State of an IP range
+// First is the IP address shared by idents in this range, Next is the first
+// address which was never handed out and Free holds the returned addresses
+// in the order they will be reused. Quarantined addresses are part of Allocated
+type IPAMRangeState struct {
+	Range       string              `json:"range"`
+	Priority    int                 `json:"priority,omitempty"`
+	Sharing     IPAMSharing         `json:"sharing,omitempty"`
+	Strategy    IPAMStrategy        `json:"strategy,omitempty"`
+	First       string              `json:"first,omitempty"`
+	Next        string              `json:"next,omitempty"`
+	Allocated   []string            `json:"allocated,omitempty"`
+	Free        []string            `json:"free,omitempty"`
+	Idents      []IPAMIdentState    `json:"idents,omitempty"`
+	Exclusions  map[string][]string `json:"exclusions,omitempty"`
+	Quarantined []string            `json:"quarantined,omitempty"`
+}
+
+// IPAMClusterState - State of an IP cluster pool
+// Ranges are listed in the order they are used for cluster wide allocation
+type IPAMClusterState struct {
+	Name   string           `json:"name"`
+	Ranges []IPAMRangeState `json:"ranges"`
+}
+
+// IPAMState - Complete state of an IP allocator
+type IPAMState struct {
+	Version  int                `json:"version"`
+	Clusters []IPAMClusterState `json:"clusters"`
+}
+
+// getState - Get the state of the range. Caller must hold ipr.mtx
+func (ipr *IPRange) getState(cidr string) IPAMRangeState {
+	rs := IPAMRangeState{Range: cidr, Priority: ipr.prio, Sharing: ipr.sharing, Strategy: ipr.strategy}
+	baseIP := ipr.baseIP()
+
+	if ipr.fOK {
+		rs.First = addIPIndex(baseIP, ipr.first).String()
+	}
+
+	used, free, next := ipr.freeID.getState()
+	if next-ipr.freeID.begin < ipr.freeID.len {
+		rs.Next = addIPIndex(baseIP, next).String()
+	}
+	for _, idx := range used {
+		rs.Allocated = append(rs.Allocated, addIPIndex(baseIP, idx).String())
+	}
+	for _, idx := range free {
+		rs.Free = append(rs.Free, addIPIndex(baseIP, idx).String())
+	}
+
+	for key, ref := range ipr.ident {
+		idx := ipr.identIdx[key]
+		is := IPAMIdentState{Ident: ipr.identString(key), IP: addIPIndex(baseIP, idx).String(), RefCount: ref}
+		if exp, ok := ipr.lease[key]; ok {
+			is.Expiry = &exp
+		}
+		rs.Idents = append(rs.Idents, is)
+	}
+	sort.Slice(rs.Idents, func(i, j int) bool {
+		if rs.Idents[i].Ident != rs.Idents[j].Ident {
+			return rs.Idents[i].Ident < rs.Idents[j].Ident
+		}
+		return rs.Idents[i].IP < rs.Idents[j].IP
+	})
+
+	if len(ipr.excl) != 0 {
+		rs.Exclusions = ipr.exclusions()
+	}
+
+	for idx := range ipr.quar {
+		rs.Quarantined = append(rs.Quarantined, addIPIndex(baseIP, idx).String())
+	}
+	sort.Strings(rs.Quarantined)
+
+	return rs
+}
+
+// stateIPIndex - Convert an IP string of the range state to its index
+func (ipr *IPRange) stateIPIndex(IPString string) (uint64, error) {
+	addr, err := parseIPAMAddr(IPString)
+	if err != nil {
+		return 0, err
+	}
+	IP := ipamNetIP(addr)
+	if !ipr.Contains(IP) {
+		return 0, &IPAMError{Kind: ErrIPAMOutOfBounds, Msg: "ip string out of bounds"}
+	}
+	return diffIPIndex(ipr.baseIP(), IP), nil
+}
+
+// setState - Restore the state of a new range
+func (ipr *IPRange) setState(rs *IPAMRangeState) error {
+	var used []uint64
+	var free []uint64
+
+	next := ipr.freeID.begin + ipr.freeID.len
+	if rs.Next != "" {
+		idx, err := ipr.stateIPIndex(rs.Next)
+		if err != nil {
+			return err
+		}
+		next = idx
+	}
+
+	for _, IPString := range rs.Allocated {
+		idx, err := ipr.stateIPIndex(IPString)
+		if err != nil {
+			return err
+		}
+		used = append(used, idx)
+	}
+
+	for _, IPString := range rs.Free {
+		idx, err := ipr.stateIPIndex(IPString)
+		if err != nil {
+			return err
+		}
+		free = append(free, idx)
+	}
+
+	if err := ipr.freeID.setState(used, free, next); err != nil {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "ip range state counter failure", Range: rs.Range}
+	}
+
+	if rs.First != "" {
+		idx, err := ipr.stateIPIndex(rs.First)
+		if err != nil {
+			return err
+		}
+		ipr.first = idx
+		ipr.fOK = true
+	}
+
+	for _, is := range rs.Idents {
+		idx, err := ipr.stateIPIndex(is.IP)
+		if err != nil {
+			return err
+		}
+		key := allocKey(is.Ident, idx)
+		if _, ok := ipr.ident[key]; ok || is.RefCount <= 0 {
+			return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip range ident state"}
+		}
+		ipr.ident[key] = is.RefCount
+		ipr.identIdx[key] = idx
+		ipr.users[idx]++
+		if is.Expiry != nil {
+			ipr.lease[key] = *is.Expiry
+		}
+	}
+	ipr.prio = rs.Priority
+	if rs.Sharing != IPAMShareFirst && rs.Sharing != IPAMSharePort {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip sharing mode"}
+	}
+	ipr.sharing = rs.Sharing
+	if rs.Strategy > IPAMStrategySticky {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip allocation strategy"}
+	}
+	ipr.strategy = rs.Strategy
+
+	for name, excls := range rs.Exclusions {
+		for _, excl := range excls {
+			ex, err := ipr.newExclusion(excl)
+			if err != nil {
+				return err
+			}
+			ipr.excl[name] = append(ipr.excl[name], ex)
+		}
+	}
+
+	inUse := make(map[uint64]struct{}, len(used))
+	for _, idx := range used {
+		inUse[idx] = struct{}{}
+	}
+	for _, IPString := range rs.Quarantined {
+		idx, err := ipr.stateIPIndex(IPString)
+		if err != nil {
+			return err
+		}
+		if _, ok := inUse[idx]; !ok || ipr.users[idx] != 0 {
+			return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip range quarantine state"}
+		}
+		ipr.quar[idx] = struct{}{}
+	}
+
+	// Excluded addresses in use without an ident are the held back ones
+	for _, idx := range used {
+		if _, ok := ipr.quar[idx]; ok {
+			continue
+		}
+		if _, ok := ipr.users[idx]; !ok && ipr.isExcluded(idx) {
+			ipr.held[idx] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// GetState - Get a snapshot of the complete allocator state
+func (ipa *IPAllocator) GetState() *IPAMState {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	return ipa.getState()
+}
+
+// getState - Get a snapshot of the allocator state. Caller must hold ipa.mtx
+func (ipa *IPAllocator) getState() *IPAMState {
+	st := &IPAMState{Version: IPAMStateVersion}
+
+	for name, ipCPool := range ipa.ipBlocks {
+		st.Clusters = append(st.Clusters, ipCPool.getState(name))
+	}
+	sort.Slice(st.Clusters, func(i, j int) bool { return st.Clusters[i].Name < st.Clusters[j].Name })
+
+	return st
+}
+
+// getState - Get the state of the cluster. Caller must own the cluster exclusively
+func (ipCPool *IPClusterPool) getState(name string) IPAMClusterState {
+	cs := IPAMClusterState{Name: name, Ranges: []IPAMRangeState{}}
+	for _, cidr := range ipCPool.sortedRanges() {
+		cs.Ranges = append(cs.Ranges, ipCPool.pool[cidr].getState(cidr))
+	}
+	return cs
+}
+
+// newIPBlocks - Build the clusters of an allocator from its state
+func newIPBlocks(st *IPAMState) (map[string]*IPClusterPool, error) {
+	if st == nil || st.Version != IPAMStateVersion {
+		return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "unsupported ipam state version"}
+	}
+
+	ipBlocks := make(map[string]*IPClusterPool)
+	ipBlocks[IPClusterDefault] = &IPClusterPool{pool: make(map[string]*IPRange)}
+
+	for i := range st.Clusters {
+		cs := &st.Clusters[i]
+		ipCPool := ipBlocks[cs.Name]
+		if ipCPool == nil {
+			ipCPool = &IPClusterPool{name: cs.Name, pool: make(map[string]*IPRange)}
+			ipBlocks[cs.Name] = ipCPool
+		}
+
+		for j := range cs.Ranges {
+			rs := &cs.Ranges[j]
+			r, cidr, err := ipamRangeKey(rs.Range)
+			if err != nil {
+				return nil, ipamContext(err, cs.Name, cidr)
+			}
+			if ipCPool.pool[cidr] != nil {
+				return nil, &IPAMError{Kind: ErrIPAMRangeExists, Msg: "existing IP Pool"}
+			}
+			ipr, err := newIPRange(r)
+			if err != nil {
+				return nil, err
+			}
+			if err := ipr.setState(rs); err != nil {
+				return nil, err
+			}
+			ipCPool.seq++
+			ipr.seq = ipCPool.seq
+			ipCPool.pool[cidr] = ipr
+		}
+	}
+
+	return ipBlocks, nil
+}
+
+// IpAllocatorFromState - Create a new allocator from a snapshot taken with GetState
+func IpAllocatorFromState(st *IPAMState) (*IPAllocator, error) {
+	ipBlocks, err := newIPBlocks(st)
+	if err != nil {
+		return nil, err
+	}
+
+	ipa := IpAllocatorNew()
+	ipa.ipBlocks = ipBlocks
+	return ipa, nil
+}
+
+// ExportState - Export the complete allocator state as JSON
+func (ipa *IPAllocator) ExportState() ([]byte, error) {
+	return json.Marshal(ipa.GetState())
+}
+
+// IpAllocatorImport - Create a new allocator from JSON exported with ExportState
+func IpAllocatorImport(data []byte) (*IPAllocator, error) {
+	st := new(IPAMState)
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return IpAllocatorFromState(st)
+}
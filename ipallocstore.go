@@ -0,0 +1,630 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// IPAMStoreMaxTries - Maximum number of times a mutation is retried after losing
+// a compare-and-swap on the store to another allocator
+const IPAMStoreMaxTries = 16
+
+// IPAMStoreRecord - Versioned record of an IPAM store. There is a record per IP cluster,
+// keyed by its name, whose Data holds the state of the cluster or is nil if there is none
+type IPAMStoreRecord struct {
+	Key     string
+	Version uint64
+	Data    []byte
+}
+
+// IPAMStore - Versioned records holding the allocator state shared by allocators.
+// Load returns the records of keys, or all records if keys is nil. A missing record
+// is returned at version 0 with nil Data. CompareAndSwap replaces the records only if
+// all of them are still at their version, which is then incremented. Else it fails
+// with ErrIPAMStoreConflict and replaces none of them
+type IPAMStore interface {
+	Load(keys []string) ([]IPAMStoreRecord, error)
+	CompareAndSwap(recs []IPAMStoreRecord) error
+}
+
+// errIPAMNoChange - Returned by a mutation which left the allocator unchanged
+var errIPAMNoChange = errors.New("ipam no change")
+
+// errIPAMStoreScope - Returned by a mutation applied to some clusters, which needs all of them
+var errIPAMStoreScope = errors.New("ipam store scope")
+
+// SetIPAMStore - Share the allocator state through a store. If the store has no record
+// yet, it is initialized with the current state, else the current state is replaced with
+// the one of the store. Every mutation is then applied to the latest records of the clusters
+// it changes and written back before it takes effect. Queries use the state as of the last
+// mutation of a cluster or SyncIPAMStore. A nil store makes the allocator local again
+func (ipa *IPAllocator) SetIPAMStore(store IPAMStore) error {
+	ipa.smtx.Lock()
+	defer ipa.smtx.Unlock()
+
+	if store == nil {
+		ipa.mtx.Lock()
+		ipa.store = nil
+		ipa.storeVer = nil
+		ipa.mtx.Unlock()
+		return nil
+	}
+
+	for try := 0; try < IPAMStoreMaxTries; try++ {
+		recs, err := store.Load(nil)
+		if err != nil {
+			return err
+		}
+
+		if len(recs) != 0 {
+			s, err := ipa.scratch(recs, false)
+			if err != nil {
+				return err
+			}
+			ipa.adopt(s, store, recs, true)
+			return nil
+		}
+
+		st := ipa.GetState()
+		for i := range st.Clusters {
+			rec, err := clusterRecord(&st.Clusters[i], 0)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+		}
+		err = store.CompareAndSwap(recs)
+		if errors.Is(err, ErrIPAMStoreConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		ipa.mtx.Lock()
+		ipa.store = store
+		ipa.storeVer = make(map[string]uint64, len(recs))
+		for _, rec := range recs {
+			ipa.storeVer[rec.Key] = rec.Version + 1
+		}
+		ipa.mtx.Unlock()
+		return nil
+	}
+
+	return &IPAMError{Kind: ErrIPAMStoreConflict, Msg: "ipam store update conflict"}
+}
+
+// SyncIPAMStore - Refresh the allocator state from the store. Only the clusters
+// whose records changed since they were last seen are rebuilt
+func (ipa *IPAllocator) SyncIPAMStore() error {
+	ipa.smtx.Lock()
+	defer ipa.smtx.Unlock()
+
+	ipa.mtx.RLock()
+	store := ipa.store
+	ipa.mtx.RUnlock()
+	if store == nil {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "no ipam store"}
+	}
+
+	recs, err := store.Load(nil)
+	if err != nil {
+		return err
+	}
+
+	var changed []IPAMStoreRecord
+	ipa.mtx.RLock()
+	for _, rec := range recs {
+		if rec.Version != ipa.storeVer[rec.Key] {
+			changed = append(changed, rec)
+		}
+	}
+	ipa.mtx.RUnlock()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	s, err := ipa.scratch(changed, true)
+	if err != nil {
+		return err
+	}
+	ipa.adopt(s, store, changed, false)
+
+	return nil
+}
+
+// clusterRecord - Get the store record of a cluster state at a version
+func clusterRecord(cs *IPAMClusterState, ver uint64) (IPAMStoreRecord, error) {
+	data, err := json.Marshal(&IPAMState{Version: IPAMStateVersion, Clusters: []IPAMClusterState{*cs}})
+	if err != nil {
+		return IPAMStoreRecord{}, err
+	}
+	return IPAMStoreRecord{Key: cs.Name, Version: ver, Data: data}, nil
+}
+
+// scratch - Build a private allocator from store records, which has the settings and
+// watermark levels of the allocator. A scoped allocator only has the clusters of the
+// records, else it also has the default cluster. Caller must hold ipa.smtx
+func (ipa *IPAllocator) scratch(recs []IPAMStoreRecord, scoped bool) (*IPAllocator, error) {
+	s := IpAllocatorNew()
+	s.storePart = scoped
+	if scoped {
+		delete(s.ipBlocks, IPClusterDefault)
+	}
+
+	for _, rec := range recs {
+		if rec.Data == nil {
+			if rec.Key == IPClusterDefault {
+				s.ipBlocks[rec.Key] = &IPClusterPool{pool: make(map[string]*IPRange)}
+			}
+			continue
+		}
+		st := new(IPAMState)
+		if err := json.Unmarshal(rec.Data, st); err != nil {
+			return nil, err
+		}
+		if len(st.Clusters) != 1 || st.Clusters[0].Name != rec.Key {
+			return nil, &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam store record", Cluster: rec.Key}
+		}
+		ipBlocks, err := newIPBlocks(st)
+		if err != nil {
+			return nil, err
+		}
+		s.ipBlocks[rec.Key] = ipBlocks[rec.Key]
+	}
+
+	ipa.mtx.RLock()
+	defer ipa.mtx.RUnlock()
+
+	s.clock = ipa.clock
+	s.xOverlap = ipa.xOverlap
+	s.conflict = ipa.conflict
+	s.wmarks = ipa.wmarks
+	s.wmHyst = ipa.wmHyst
+
+	for name, ipCPool := range s.ipBlocks {
+		old := ipa.ipBlocks[name]
+		if old == nil {
+			continue
+		}
+		for cidr, ipr := range ipCPool.pool {
+			if oldIPR := old.pool[cidr]; oldIPR != nil {
+				ipr.wmark = oldIPR.wmark
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// storeRecords - Get the records to write back for the clusters of a private allocator
+// built from loaded. Unless check is set, the records of unchanged clusters are left out.
+// A scoped allocator fails with errIPAMStoreScope if a cluster was added which it didn't load
+func (ipa *IPAllocator) storeRecords(loaded []IPAMStoreRecord, check bool) ([]IPAMStoreRecord, error) {
+	old := make(map[string]IPAMStoreRecord, len(loaded))
+	for _, rec := range loaded {
+		old[rec.Key] = rec
+	}
+
+	st := ipa.GetState()
+	recs := make([]IPAMStoreRecord, 0, len(st.Clusters))
+	for i := range st.Clusters {
+		oldRec, ok := old[st.Clusters[i].Name]
+		if !ok && ipa.storePart {
+			return nil, errIPAMStoreScope
+		}
+		rec, err := clusterRecord(&st.Clusters[i], oldRec.Version)
+		if err != nil {
+			return nil, err
+		}
+		if !check && bytes.Equal(rec.Data, oldRec.Data) {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// adopt - Take over the clusters of a private allocator along with the versions of their
+// records. With all set, the state is replaced as a whole. Caller must hold ipa.smtx
+func (ipa *IPAllocator) adopt(s *IPAllocator, store IPAMStore, recs []IPAMStoreRecord, all bool) {
+	ipa.mtx.Lock()
+	defer ipa.mtx.Unlock()
+
+	if all || ipa.storeVer == nil {
+		ipa.storeVer = make(map[string]uint64, len(recs))
+	}
+	if all {
+		ipa.ipBlocks = s.ipBlocks
+	}
+	for _, rec := range recs {
+		if ipCPool := s.ipBlocks[rec.Key]; ipCPool != nil {
+			ipa.ipBlocks[rec.Key] = ipCPool
+		} else if rec.Key != IPClusterDefault {
+			delete(ipa.ipBlocks, rec.Key)
+		}
+		ipa.storeVer[rec.Key] = rec.Version
+	}
+	ipa.store = store
+}
+
+// storeLock - Serialize the mutations of clusters through the store within the allocator,
+// so that they don't lose compare-and-swaps to each other. Mutations of distinct clusters
+// run in parallel, while a mutation of all clusters, which is a nil clusters, runs alone.
+// It returns the function to unlock them
+func (ipa *IPAllocator) storeLock(clusters []string) func() {
+	if clusters == nil {
+		ipa.smtx.Lock()
+		return ipa.smtx.Unlock
+	}
+
+	ipa.smtx.RLock()
+
+	mtxs := make([]*sync.Mutex, 0, len(clusters))
+	ipa.mtx.Lock()
+	if ipa.skeys == nil {
+		ipa.skeys = make(map[string]*sync.Mutex)
+	}
+	for _, cluster := range clusters {
+		mtx := ipa.skeys[cluster]
+		if mtx == nil {
+			mtx = new(sync.Mutex)
+			ipa.skeys[cluster] = mtx
+		}
+		mtxs = append(mtxs, mtx)
+	}
+	ipa.mtx.Unlock()
+
+	for _, mtx := range mtxs {
+		mtx.Lock()
+	}
+
+	return func() {
+		for i := len(mtxs) - 1; i >= 0; i-- {
+			mtxs[i].Unlock()
+		}
+		ipa.smtx.RUnlock()
+	}
+}
+
+// stored - Apply a mutation of clusters through the store. The mutation is applied to a
+// private allocator built from the latest records of the clusters, whose records are then
+// written back and adopted. A mutation which turns out to need all clusters, like a range
+// checked for overlaps with all of them, is retried with all of them. A nil clusters
+// mutates all clusters, but only writes back the ones which changed. Events are queued to
+// evs once the records were written, so that they are only delivered after the store locks
+// were released. It returns false if no store is set, in which case the mutation must be
+// applied locally
+func (ipa *IPAllocator) stored(evs *ipamEvents, clusters []string, mutate func(s *IPAllocator) error) (bool, error) {
+	ipa.mtx.RLock()
+	store := ipa.store
+	ipa.mtx.RUnlock()
+	if store == nil {
+		return false, nil
+	}
+
+	check := clusters != nil
+	if clusters != nil {
+		// Clusters are locked in order
+		keys := make([]string, 0, len(clusters))
+		for _, cluster := range clusters {
+			keys = append(keys, cluster)
+		}
+		sort.Strings(keys)
+		clusters = keys[:0]
+		for i, key := range keys {
+			if i == 0 || key != keys[i-1] {
+				clusters = append(clusters, key)
+			}
+		}
+	}
+
+	for {
+		unlock := ipa.storeLock(clusters)
+		ipa.mtx.RLock()
+		store = ipa.store
+		ipa.mtx.RUnlock()
+		if store == nil {
+			unlock()
+			return false, nil
+		}
+
+		err := ipa.storeApply(store, evs, clusters, check, mutate)
+		unlock()
+		if clusters != nil && errors.Is(err, errIPAMStoreScope) {
+			clusters = nil
+			continue
+		}
+		return true, err
+	}
+}
+
+// storeApply - Apply a mutation through the store like stored, retrying it as long as
+// it loses compare-and-swaps to other allocators. Caller must hold the store locks
+func (ipa *IPAllocator) storeApply(store IPAMStore, evs *ipamEvents, clusters []string, check bool, mutate func(s *IPAllocator) error) error {
+	for try := 0; try < IPAMStoreMaxTries; try++ {
+		recs, err := store.Load(clusters)
+		if err != nil {
+			return err
+		}
+		s, err := ipa.scratch(recs, clusters != nil)
+		if err != nil {
+			return err
+		}
+
+		var sEvs []IPAMEvent
+		s.evHook = func(ev IPAMEvent) { sEvs = append(sEvs, ev) }
+
+		if err := mutate(s); err != nil {
+			if err == errIPAMNoChange {
+				err = nil
+			}
+			return err
+		}
+
+		recs, err = s.storeRecords(recs, check)
+		if err != nil {
+			return err
+		}
+		err = store.CompareAndSwap(recs)
+		if errors.Is(err, ErrIPAMStoreConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i := range recs {
+			recs[i].Version++
+		}
+
+		ipa.adopt(s, store, recs, false)
+
+		ipa.mtx.RLock()
+		for _, ev := range sEvs {
+			evs.add(ev)
+		}
+		ipa.mtx.RUnlock()
+
+		return nil
+	}
+
+	return &IPAMError{Kind: ErrIPAMStoreConflict, Msg: "ipam store update conflict"}
+}
+
+// IPAMMemStore - IPAM store kept in memory, which allocators of a process can share
+type IPAMMemStore struct {
+	mtx  sync.Mutex
+	recs map[string]IPAMStoreRecord
+}
+
+// IPAMMemStoreNew - Create a new empty in-memory IPAM store
+func IPAMMemStoreNew() *IPAMMemStore {
+	ms := new(IPAMMemStore)
+	ms.recs = make(map[string]IPAMStoreRecord)
+	return ms
+}
+
+// Load - Get the records of keys, or all records if keys is nil
+func (ms *IPAMMemStore) Load(keys []string) ([]IPAMStoreRecord, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if keys == nil {
+		for key := range ms.recs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	recs := make([]IPAMStoreRecord, 0, len(keys))
+	for _, key := range keys {
+		rec := ms.recs[key]
+		recs = append(recs, IPAMStoreRecord{Key: key, Version: rec.Version, Data: append([]byte(nil), rec.Data...)})
+	}
+	return recs, nil
+}
+
+// CompareAndSwap - Replace the records if all of them are still at their version
+func (ms *IPAMMemStore) CompareAndSwap(recs []IPAMStoreRecord) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	for _, rec := range recs {
+		if ms.recs[rec.Key].Version != rec.Version {
+			return ErrIPAMStoreConflict
+		}
+	}
+	for _, rec := range recs {
+		ms.recs[rec.Key] = IPAMStoreRecord{Key: rec.Key, Version: rec.Version + 1, Data: append([]byte(nil), rec.Data...)}
+	}
+
+	return nil
+}
+
+// ipamFileRecord - Record of a file IPAM store
+type ipamFileRecord struct {
+	Version uint64          `json:"version"`
+	State   json.RawMessage `json:"state"`
+}
+
+// ipamFileRecordExt - File name extension of the records of a file IPAM store
+const ipamFileRecordExt = ".json"
+
+// IPAMFileStore - IPAM store kept in a local directory, which allocators of different
+// processes can share. Every record is a file, which is written to a temporary file and
+// renamed over the record. Loads and updates are serialized with a lock on a ".lock" file
+// of the directory. A crash in the middle of an update of several records may leave only
+// some of them updated
+type IPAMFileStore struct {
+	path string
+}
+
+// IPAMFileStoreNew - Create a new IPAM store backed by the directory at path
+func IPAMFileStoreNew(path string) *IPAMFileStore {
+	return &IPAMFileStore{path: path}
+}
+
+// lock - Lock the store with a flock operation. It returns the lock file to unlock
+// with Close, or nil if the store directory does not exist yet and create is unset
+func (fs *IPAMFileStore) lock(how int, create bool) (*os.File, error) {
+	if create {
+		if err := os.MkdirAll(fs.path, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	lock, err := os.OpenFile(filepath.Join(fs.path, ".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if errors.Is(err, os.ErrNotExist) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// recordPath - Get the path of the file of a record
+func (fs *IPAMFileStore) recordPath(key string) string {
+	return filepath.Join(fs.path, url.PathEscape(key)+ipamFileRecordExt)
+}
+
+// load - Get the record of a key. Caller must hold the store lock
+func (fs *IPAMFileStore) load(key string) (IPAMStoreRecord, error) {
+	data, err := os.ReadFile(fs.recordPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return IPAMStoreRecord{Key: key}, nil
+	}
+	if err != nil {
+		return IPAMStoreRecord{}, err
+	}
+
+	rec := new(ipamFileRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return IPAMStoreRecord{}, err
+	}
+	if string(rec.State) == "null" {
+		rec.State = nil
+	}
+
+	return IPAMStoreRecord{Key: key, Version: rec.Version, Data: rec.State}, nil
+}
+
+// Load - Get the records of keys, or all records if keys is nil
+func (fs *IPAMFileStore) Load(keys []string) ([]IPAMStoreRecord, error) {
+	lock, err := fs.lock(syscall.LOCK_SH, false)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		recs := make([]IPAMStoreRecord, 0, len(keys))
+		for _, key := range keys {
+			recs = append(recs, IPAMStoreRecord{Key: key})
+		}
+		return recs, nil
+	}
+	defer lock.Close()
+
+	if keys == nil {
+		ents, err := os.ReadDir(fs.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range ents {
+			name, ok := strings.CutSuffix(ent.Name(), ipamFileRecordExt)
+			if !ok {
+				continue
+			}
+			key, err := url.PathUnescape(name)
+			if err != nil {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	recs := make([]IPAMStoreRecord, 0, len(keys))
+	for _, key := range keys {
+		rec, err := fs.load(key)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// CompareAndSwap - Replace the records if all of them are still at their version
+func (fs *IPAMFileStore) CompareAndSwap(recs []IPAMStoreRecord) error {
+	lock, err := fs.lock(syscall.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	for _, rec := range recs {
+		cur, err := fs.load(rec.Key)
+		if err != nil {
+			return err
+		}
+		if cur.Version != rec.Version {
+			return ErrIPAMStoreConflict
+		}
+	}
+
+	tmps := make([]string, 0, len(recs))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+
+	for _, rec := range recs {
+		data, err := json.Marshal(&ipamFileRecord{Version: rec.Version + 1, State: rec.Data})
+		if err != nil {
+			return err
+		}
+
+		tmp, err := os.CreateTemp(fs.path, ".tmp*")
+		if err != nil {
+			return err
+		}
+		tmps = append(tmps, tmp.Name())
+
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+	}
+
+	for i, rec := range recs {
+		if err := os.Rename(tmps[i], fs.recordPath(rec.Key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
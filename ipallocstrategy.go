@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+)
+
+// IPAMStrategy - How new IP addresses are picked from a range
+type IPAMStrategy uint8
+
+// IP address allocation strategies
+const (
+	// IPAMStrategyFIFO - Addresses never used come first, returned ones are reused in the order they were returned
+	IPAMStrategyFIFO IPAMStrategy = iota
+	// IPAMStrategyLowest - The lowest free address is used
+	IPAMStrategyLowest
+	// IPAMStrategyRandom - A random free address is used
+	IPAMStrategyRandom
+	// IPAMStrategySticky - A hash of the ident picks the preferred address, so that an ident
+	// tends to get the same address again. Allocations without an ident fall back to FIFO.
+	// With IPAMShareFirst, the ident which makes the shared IP address picks it
+	IPAMStrategySticky
+)
+
+// ipamRandomTries - Number of random addresses tried before falling back to FIFO
+const ipamRandomTries = 16
+
+// SetIPRangeStrategy - Set how new IP addresses are picked from a range
+func (ipa *IPAllocator) SetIPRangeStrategy(cluster string, cidr string, strategy IPAMStrategy) (err error) {
+	if _, cidr, err = ipamRangeKey(cidr); err != nil {
+		return ipamContext(err, cluster, cidr)
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(IPAMJournalEntry{Op: IPAMJournalRangeStrategy, Cluster: cluster, Range: cidr, Args: []string{strconv.Itoa(int(strategy))}})
+	if err != nil {
+		return err
+	}
+	defer func() { err = jo.done(err) }()
+
+	if ok, err := ipa.stored(evs, []string{cluster}, func(s *IPAllocator) error {
+		return s.SetIPRangeStrategy(cluster, cidr, strategy)
+	}); ok {
+		return err
+	}
+
+	if strategy > IPAMStrategySticky {
+		return &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ip allocation strategy", Cluster: cluster, Range: cidr}
+	}
+
+	ipCPool, ipr, err := ipa.getIPRange(cluster, cidr)
+	if err != nil {
+		return err
+	}
+	defer ipa.putIPRange(ipCPool, ipr)
+
+	ipr.strategy = strategy
+	return nil
+}
+
+// newIndex - Get a new index following the allocation strategy of the range.
+// The strategies besides FIFO fall back to FIFO if their pick is in use.
+// Caller must hold ipr.mtx
+func (ipr *IPRange) newIndex(idString string) (uint64, error) {
+	C := ipr.freeID
+
+	switch ipr.strategy {
+	case IPAMStrategyLowest:
+		return C.GetLowestCounter()
+	case IPAMStrategyRandom:
+		if C.CounterFree() != 0 {
+			for i := 0; i < ipamRandomTries; i++ {
+				idx := C.begin + rand.Uint64()%C.len
+				if C.ReserveCounter(idx) == nil {
+					return idx, nil
+				}
+			}
+		}
+	case IPAMStrategySticky:
+		if idString != "" {
+			idx := ipr.stickyIndex(idString)
+			if C.ReserveCounter(idx) == nil {
+				return idx, nil
+			}
+		}
+	}
+
+	return C.GetCounter()
+}
+
+// stickyIndex - Get the preferred index of an ident. Caller must hold ipr.mtx
+func (ipr *IPRange) stickyIndex(idString string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(getIdentKey(idString)))
+	return ipr.freeID.begin + h.Sum64()%ipr.freeID.len
+}
+
+// takeIndex - Take an index newIndex handed out to the ident out of the counter
+// the way newIndex did, which keeps the order of the free indices when allocations
+// are replayed. Caller must hold ipr.mtx
+func (ipr *IPRange) takeIndex(idString string, idx uint64) error {
+	C := ipr.freeID
+
+	switch ipr.strategy {
+	case IPAMStrategyRandom:
+		return C.ReserveCounter(idx)
+	case IPAMStrategySticky:
+		if idString != "" && idx == ipr.stickyIndex(idString) {
+			return C.ReserveCounter(idx)
+		}
+	}
+
+	return C.takeCounter(idx)
+}
@@ -0,0 +1,287 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// IPAMOpType - Type of an IPAM batch operation
+type IPAMOpType uint8
+
+// IPAM batch operation types
+const (
+	IPAMOpAllocate IPAMOpType = iota
+	IPAMOpReserve
+	IPAMOpRelease
+)
+
+// IPAMOp - An operation of an IPAM batch. IP is not used for allocations
+type IPAMOp struct {
+	Type    IPAMOpType
+	Cluster string
+	Range   string
+	Ident   string
+	IP      string
+}
+
+// IPAMBatchError - Error of the operation which caused a batch to be rejected
+type IPAMBatchError struct {
+	Index int
+	Err   error
+}
+
+// Error - Get the error message along with the index of the failed operation
+func (e *IPAMBatchError) Error() string {
+	return "ipam batch op " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+// Unwrap - Get the error of the failed operation
+func (e *IPAMBatchError) Unwrap() error {
+	return e.Err
+}
+
+// ipamSnapshot - Saved state of the ranges changed by a batch
+type ipamSnapshot map[*IPClusterPool]map[string]IPAMRangeState
+
+// save - Save the state of a range, unless it was saved already
+func (snap ipamSnapshot) save(ipCPool *IPClusterPool, cidr string, ipr *IPRange) {
+	if snap[ipCPool] == nil {
+		snap[ipCPool] = make(map[string]IPAMRangeState)
+	}
+	if _, ok := snap[ipCPool][cidr]; !ok {
+		snap[ipCPool][cidr] = ipr.getState(cidr)
+	}
+}
+
+// restore - Put back the saved ranges. Ranges which can't be rebuilt from their
+// saved state are left as they are and their errors are returned
+func (snap ipamSnapshot) restore() error {
+	var errs []error
+
+	for ipCPool, ranges := range snap {
+		for cidr, rs := range ranges {
+			ipr, err := newIPRange(ipCPool.pool[cidr].rng)
+			if err == nil {
+				err = ipr.setState(&rs)
+			}
+			if err != nil {
+				errs = append(errs, ipamContext(err, ipCPool.name, cidr))
+				continue
+			}
+			ipr.seq = ipCPool.pool[cidr].seq
+			ipr.wmark = ipCPool.pool[cidr].wmark
+			ipCPool.pool[cidr] = ipr
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyOp - Apply an operation of a batch. Allocations are conflict checked with the
+// results in probed and it returns if the allocated IP address still has to be probed.
+// Caller must hold ipa.mtx exclusively
+func (ipa *IPAllocator) applyOp(op *IPAMOp, snap ipamSnapshot, probed map[string]bool) (net.IP, bool, error) {
+	ipCPool := ipa.ipBlocks[op.Cluster]
+	if ipCPool == nil {
+		return nil, false, &IPAMError{Kind: ErrIPAMClusterNotFound, Msg: "ip Cluster not found", Cluster: op.Cluster}
+	}
+
+	ipr := ipCPool.pool[op.Range]
+	if ipr == nil {
+		return nil, false, &IPAMError{Kind: ErrIPAMRangeNotFound, Msg: "no such IP Range", Cluster: op.Cluster, Range: op.Range}
+	}
+
+	var IP net.IP
+	if op.Type != IPAMOpAllocate {
+		addr, err := parseIPAMAddr(op.IP)
+		if err != nil {
+			return nil, false, ipamContext(err, op.Cluster, op.Range)
+		}
+		IP = ipamNetIP(addr)
+	}
+
+	snap.save(ipCPool, op.Range, ipr)
+
+	var err error
+	unprobed := false
+	switch op.Type {
+	case IPAMOpAllocate:
+		IP, unprobed, err = ipa.allocateProbed(ipr, op.Ident, probed)
+	case IPAMOpReserve:
+		err = ipr.reserveIP(op.Ident, IP, false)
+	case IPAMOpRelease:
+		err = ipr.deAllocateIP(op.Ident, IP)
+	default:
+		err = &IPAMError{Kind: ErrIPAMInvalidInput, Msg: "invalid ipam op"}
+	}
+	if err != nil {
+		return nil, false, ipamContext(err, op.Cluster, op.Range)
+	}
+
+	return IP, unprobed, nil
+}
+
+// applyOps - Apply the operations of a batch. It returns the indexes of the allocations
+// whose IP addresses still have to be probed. On error, the operations applied are left
+// for the caller to roll back. Caller must hold ipa.mtx exclusively
+func (ipa *IPAllocator) applyOps(ops []IPAMOp, snap ipamSnapshot, probed map[string]bool) ([]net.IP, []int, error) {
+	var unprobed []int
+
+	ips := make([]net.IP, 0, len(ops))
+	for i := range ops {
+		IP, probe, err := ipa.applyOp(&ops[i], snap, probed)
+		if err != nil {
+			return nil, nil, &IPAMBatchError{Index: i, Err: err}
+		}
+		if probe {
+			unprobed = append(unprobed, i)
+		}
+		ips = append(ips, IP)
+	}
+
+	return ips, unprobed, nil
+}
+
+// batchEvents - Queue the events of an applied batch. Caller must hold ipa.mtx
+func (ipa *IPAllocator) batchEvents(evs *ipamEvents, ops []IPAMOp, ips []net.IP) {
+	for i, op := range ops {
+		typ := IPAMEventAllocate
+		if op.Type == IPAMOpRelease {
+			typ = IPAMEventRelease
+		}
+		evs.add(IPAMEvent{Type: typ, Cluster: op.Cluster, Range: op.Range, Ident: op.Ident, IP: ips[i]})
+	}
+	done := make(map[*IPRange]struct{})
+	for _, op := range ops {
+		ipr := ipa.ipBlocks[op.Cluster].pool[op.Range]
+		if _, ok := done[ipr]; !ok {
+			evs.watermarks(op.Cluster, op.Range, ipr)
+			done[ipr] = struct{}{}
+		}
+	}
+}
+
+// journalBatch - Get the journal entries of a batch
+func journalBatch(ops []IPAMOp) []IPAMJournalEntry {
+	ents := make([]IPAMJournalEntry, 0, len(ops))
+	for _, op := range ops {
+		ent := IPAMJournalEntry{Cluster: op.Cluster, Range: op.Range, Ident: op.Ident, IP: op.IP}
+		switch op.Type {
+		case IPAMOpAllocate:
+			ent.Op = IPAMJournalAllocate
+		case IPAMOpReserve:
+			ent.Op = IPAMJournalReserve
+		default:
+			ent.Op = IPAMJournalRelease
+		}
+		ents = append(ents, ent)
+	}
+	return ents
+}
+
+// ApplyBatch - Apply a batch of operations atomically. It returns the IP address of
+// every operation, which is the allocated one for allocations. If any operation fails,
+// the whole batch is rejected with an IPAMBatchError and the allocator is left unchanged.
+// Events are only raised for batches which were applied
+func (ipa *IPAllocator) ApplyBatch(ops []IPAMOp) (ips []net.IP, err error) {
+	ops = append([]IPAMOp(nil), ops...)
+	for i := range ops {
+		if _, ops[i].Range, err = ipamRangeKey(ops[i].Range); err != nil {
+			return nil, &IPAMBatchError{Index: i, Err: ipamContext(err, ops[i].Cluster, ops[i].Range)}
+		}
+	}
+
+	evs := ipa.newEvents()
+	defer evs.emit()
+
+	jo, err := ipa.journalStart(journalBatch(ops)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = jo.done(err, ips...) }()
+
+	clusters := make([]string, 0, len(ops))
+	for _, op := range ops {
+		clusters = append(clusters, op.Cluster)
+	}
+	if ok, err := ipa.stored(evs, clusters, func(s *IPAllocator) (err error) {
+		ips, err = s.ApplyBatch(ops)
+		return err
+	}); ok {
+		return ips, err
+	}
+
+	// The new IP addresses of a batch are conflict checked without holding the allocator
+	// locks. The batch is applied and rolled back to find them, till all are checked
+	probed := make(map[string]bool)
+	for try := 0; ; try++ {
+		ipa.mtx.Lock()
+		snap := make(ipamSnapshot)
+		ips, unprobed, err := ipa.applyOps(ops, snap, probed)
+		if err == nil && len(unprobed) == 0 {
+			ipa.batchEvents(evs, ops, ips)
+			ipa.mtx.Unlock()
+			return ips, nil
+		}
+		rerr := snap.restore()
+		cc := ipa.conflict
+		ipa.mtx.Unlock()
+
+		if rerr != nil {
+			return nil, errors.Join(err, rerr)
+		} else if err != nil {
+			return nil, err
+		}
+		if try+1 > IPAMMaxConflictTries {
+			return nil, &IPAMBatchError{Index: unprobed[0], Err: &IPAMError{Kind: ErrIPAMIPConflict,
+				Msg: "ip conflict check failure", Cluster: ops[unprobed[0]].Cluster, Range: ops[unprobed[0]].Range, Ident: ops[unprobed[0]].Ident}}
+		}
+
+		for _, i := range unprobed {
+			probed[ips[i].String()] = probeConflict(cc, ips[i])
+		}
+	}
+}
+
+// IPAMTxn - IPAM operations staged to be committed together
+type IPAMTxn struct {
+	ipa *IPAllocator
+	ops []IPAMOp
+}
+
+// NewTxn - Start a new IPAM transaction
+func (ipa *IPAllocator) NewTxn() *IPAMTxn {
+	return &IPAMTxn{ipa: ipa}
+}
+
+// AllocateNewIP - Stage the allocation of a new IP address
+func (tx *IPAMTxn) AllocateNewIP(cluster string, cidr string, idString string) {
+	tx.ops = append(tx.ops, IPAMOp{Type: IPAMOpAllocate, Cluster: cluster, Range: cidr, Ident: idString})
+}
+
+// ReserveIP - Stage the reservation of an IP address
+func (tx *IPAMTxn) ReserveIP(cluster string, cidr string, idString string, IPString string) {
+	tx.ops = append(tx.ops, IPAMOp{Type: IPAMOpReserve, Cluster: cluster, Range: cidr, Ident: idString, IP: IPString})
+}
+
+// DeAllocateIP - Stage the deallocation of an IP address
+func (tx *IPAMTxn) DeAllocateIP(cluster string, cidr string, idString string, IPString string) {
+	tx.ops = append(tx.ops, IPAMOp{Type: IPAMOpRelease, Cluster: cluster, Range: cidr, Ident: idString, IP: IPString})
+}
+
+// Commit - Apply the staged operations atomically, as done by ApplyBatch.
+// The transaction is emptied, even if it was rejected
+func (tx *IPAMTxn) Commit() ([]net.IP, error) {
+	ops := tx.ops
+	tx.ops = nil
+	return tx.ipa.ApplyBatch(ops)
+}
+
+// Discard - Drop the staged operations
+func (tx *IPAMTxn) Discard() {
+	tx.ops = nil
+}
@@ -4,8 +4,18 @@
 package loxilib
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Tk struct {
@@ -335,6 +345,102 @@ func TestCounter(t *testing.T) {
 	if idx == 0 {
 		t.Fatalf("reservation failed Counter %d", 1)
 	}
+
+	// Taking the next counter must leave the counter as GetCounter does
+	cR = NewCounter(0, 5)
+	cR.ReserveCounter(1)
+	if cR.takeCounter(0) != nil || cR.takeCounter(2) != nil || cR.takeCounter(2) == nil || cR.PutCounter(2) != nil {
+		t.Fatalf("failed to take valid Counter %d", 2)
+	}
+	for _, exp := range []uint64{3, 4, 2} {
+		idx, err = cR.GetCounter()
+		if err != nil || idx != exp {
+			t.Fatalf("Counter order mismatch after take %d:%d:%v", exp, idx, err)
+		}
+	}
+
+	// Counters reserved above next and freed before next gets there are handed
+	// out in sequence, the ones freed after it got there are reused last
+	cR = NewCounter(0, 5)
+	if cR.ReserveCounter(3) != nil || cR.ReserveCounter(3) == nil || cR.PutCounter(3) != nil || cR.PutCounter(3) == nil {
+		t.Fatalf("failed to reserve and put Counter %d above next", 3)
+	}
+	if cR.ReserveCounter(4) != nil || cR.CounterFree() != 4 {
+		t.Fatalf("failed to reserve Counter %d above next:%d", 4, cR.CounterFree())
+	}
+	for _, exp := range []uint64{0, 1, 2, 3} {
+		idx, err = cR.GetCounter()
+		if err != nil || idx != exp {
+			t.Fatalf("Counter order mismatch after reserve above next %d:%d:%v", exp, idx, err)
+		}
+	}
+	if _, err = cR.GetCounter(); err == nil {
+		t.Fatalf("Counter get passed unexpectedly with Counter %d reserved", 4)
+	}
+	if cR.PutCounter(4) != nil || cR.PutCounter(1) != nil {
+		t.Fatalf("failed to put valid Counters %d %d", 4, 1)
+	}
+	for _, exp := range []uint64{4, 1} {
+		idx, err = cR.GetCounter()
+		if err != nil || idx != exp {
+			t.Fatalf("Counter order mismatch after put of reserved %d:%d:%v", exp, idx, err)
+		}
+	}
+
+	// Counters at the top of the uint64 space wrap around to the free list
+	// once next reaches the end
+	top := ^uint64(0) - 3
+	cR = NewCounter(top, 3)
+	for i := uint64(0); i < 3; i++ {
+		idx, err = cR.GetCounter()
+		if err != nil || idx != top+i {
+			t.Fatalf("Counter get got %d of expected %d:%v", idx, top+i, err)
+		}
+	}
+	if cR.PutCounter(top+2) != nil || cR.PutCounter(top) != nil || cR.PutCounter(^uint64(0)) == nil {
+		t.Fatalf("Counter put mismatch at the top of the counter space")
+	}
+	for _, exp := range []uint64{top + 2, top} {
+		idx, err = cR.GetCounter()
+		if err != nil || idx != exp {
+			t.Fatalf("Counter wrap-around order mismatch %d:%d:%v", exp, idx, err)
+		}
+	}
+	if _, err = cR.GetCounter(); err == nil || cR.CounterFree() != 0 {
+		t.Fatalf("Counter get passed unexpectedly after wrap-around")
+	}
+}
+
+func TestCounterLowest(t *testing.T) {
+	cR := NewCounter(10, 8)
+
+	for i := 0; i < 6; i++ {
+		cR.GetCounter()
+	}
+	for _, id := range []uint64{14, 11, 13} {
+		cR.PutCounter(id)
+	}
+
+	idx, err := cR.GetLowestCounter()
+	if idx != 11 || err != nil {
+		t.Fatalf("Counter get lowest got %d of expected %d", idx, 11)
+	}
+
+	cR.PutCounter(12)
+	cR.PutCounter(11)
+	cR.ReserveCounter(11)
+
+	for _, exp := range []uint64{12, 13, 14, 16, 17} {
+		idx, err = cR.GetLowestCounter()
+		if idx != exp || err != nil {
+			t.Fatalf("Counter get lowest got %d of expected %d", idx, exp)
+		}
+	}
+
+	_, err = cR.GetLowestCounter()
+	if err == nil {
+		t.Fatalf("Counter get lowest passed unexpectedly")
+	}
 }
 
 func TestIfStat(t *testing.T) {
@@ -347,6 +453,7 @@ func TestIfStat(t *testing.T) {
 }
 
 func TestIPAlloc(t *testing.T) {
+	t.Parallel()
 	ipa := IpAllocatorNew()
 	proto := "tcp"
 
@@ -406,7 +513,12 @@ func TestIPAlloc(t *testing.T) {
 	}
 
 	err = ipa.DeleteIPRange(IPClusterDefault, "11.11.11.0/31")
-	if err != nil {
+	if err == nil {
+		t.Fatal("Deleted IP Range 11.11.11.0/31 with IPs in use")
+	}
+
+	evicted, err := ipa.DeleteIPRangeForce(IPClusterDefault, "11.11.11.0/31")
+	if err != nil || len(evicted) != 2 {
 		t.Fatal("Failed to delete IP Alloc for 11.11.11.0/31 - Check Alloc Algo")
 	}
 
@@ -504,7 +616,7 @@ func TestIPAlloc(t *testing.T) {
 		t.Fatalf("IP Alloc failed - 4ffe::1:%s", ip1.String())
 	}
 
-	err = ipa.DeleteIPRange(IPClusterDefault, "4ffe::/64")
+	_, err = ipa.DeleteIPRangeForce(IPClusterDefault, "4ffe::/64")
 	if err != nil {
 		t.Fatal("Failed to delete IP Alloc for 4ffe::/64 - Check Alloc Algo")
 	}
@@ -561,7 +673,7 @@ func TestIPAlloc(t *testing.T) {
 		t.Fatalf("IP Alloc failed for 74.125.227.24:%s", ip1.String())
 	}
 
-	err = ipa.DeleteIPRange(IPClusterDefault, "74.125.227.24/29")
+	_, err = ipa.DeleteIPRangeForce(IPClusterDefault, "74.125.227.24/29")
 	if err != nil {
 		t.Fatalf("IP Delete Range failed for 74.125.227.24/29:%s", err)
 	}
@@ -996,6 +1108,2381 @@ func TestIPAlloc(t *testing.T) {
 	}
 }
 
+func TestIPAllocParallel(t *testing.T) {
+	t.Parallel()
+	ipa := IpAllocatorNew()
+	clusters := []string{IPClusterDefault, "pool1", "pool2", "pool3"}
+	cidrs := []string{"31.31.31.0/24", "32.32.32.0/24", "33.33.33.1-33.33.33.200", "3ffe:cafe::/120"}
+
+	var wg sync.WaitGroup
+	for i := range clusters {
+		err := ipa.AddIPRange(clusters[i], cidrs[i])
+		if err != nil {
+			t.Fatalf("Failed to add IP Range for %s:%s", cidrs[i], err)
+		}
+	}
+
+	var mtx sync.Mutex
+	allocs := make(map[string]int)
+	for i := range clusters {
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(cluster, cidr string) {
+				defer wg.Done()
+				for n := 0; n < 50; n++ {
+					ip, err := ipa.AllocateNewIP(cluster, cidr, IPAMNoIdent)
+					if err != nil {
+						t.Errorf("IP Alloc failed for %s:%s", cidr, err)
+						return
+					}
+					mtx.Lock()
+					allocs[cluster+"|"+ip.String()]++
+					mtx.Unlock()
+				}
+			}(clusters[i], cidrs[i])
+		}
+	}
+	wg.Wait()
+
+	if len(allocs) != len(clusters)*4*50 {
+		t.Fatalf("IP Alloc returned duplicate IPs %d:%d", len(allocs), len(clusters)*4*50)
+	}
+
+	for key := range allocs {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			cIP := strings.Split(key, "|")
+			for i := range clusters {
+				if clusters[i] != cIP[0] {
+					continue
+				}
+				err := ipa.DeAllocateIP(cIP[0], cidrs[i], IPAMNoIdent, cIP[1])
+				if err != nil {
+					t.Errorf("IP DeAlloc failed for %s:%s", cIP[1], err)
+				}
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	for i := range clusters {
+		wg.Add(1)
+		go func(cluster, cidr string) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				ident := MakeIPAMIdent("", uint32(n), "tcp")
+				_, err := ipa.AllocateNewIP(cluster, cidr, ident)
+				if err != nil {
+					t.Errorf("Shared IP Alloc failed for %s:%s", cidr, err)
+				}
+			}
+		}(clusters[i], cidrs[i])
+	}
+	wg.Wait()
+
+	for i := range clusters {
+		for n := 0; n < 150; n++ {
+			_, err := ipa.AllocateNewIP(clusters[i], cidrs[i], IPAMNoIdent)
+			if err != nil {
+				t.Fatalf("IP Alloc after release failed for %s:%d:%s", cidrs[i], n, err)
+			}
+		}
+	}
+}
+
+func TestIPAllocLargePool(t *testing.T) {
+	ipa := IpAllocatorNew()
+
+	err := ipa.AddIPRange(IPClusterDefault, "10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("Failed to add IP Range for 10.0.0.0/8:%s", err)
+	}
+
+	sz, err := ipa.GetIPRangeSize(IPClusterDefault, "10.0.0.0/8")
+	if err != nil || sz != (1<<24)-2 {
+		t.Fatalf("Invalid IP Range size for 10.0.0.0/8:%d:%s", sz, err)
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, "10.0.0.0/8", IPAMNoIdent, "10.255.255.254")
+	if err != nil {
+		t.Fatalf("Failed to reserve IP 10.255.255.254:%s", err)
+	}
+
+	err = ipa.AddIPRange(IPClusterDefault, "3ffe:cafe::/64")
+	if err != nil {
+		t.Fatalf("Failed to add IP Range for 3ffe:cafe::/64:%s", err)
+	}
+
+	sz, err = ipa.GetIPRangeSize(IPClusterDefault, "3ffe:cafe::/64")
+	if err != nil || sz != ^uint64(0)-1 {
+		t.Fatalf("Invalid IP Range size for 3ffe:cafe::/64:%d:%s", sz, err)
+	}
+
+	for i := 1; i <= 250; i++ {
+		ip, err := ipa.AllocateNewIP(IPClusterDefault, "3ffe:cafe::/64", IPAMNoIdent)
+		if err != nil {
+			t.Fatalf("IP Alloc failed for 3ffe:cafe::/64:%d:%s", i, err)
+		}
+		if i == 250 && ip.String() != "3ffe:cafe::fa" {
+			t.Fatalf("IP Alloc failed for 3ffe:cafe::/64:%s", ip.String())
+		}
+	}
+
+	// Pools larger than the index space are refused rather than truncated
+	for _, cidr := range []string{"4ffe:cafe::/48", "::/63", "5ffe::1-5ffe::1:0:0:0:1"} {
+		err = ipa.AddIPRange(IPClusterDefault, cidr)
+		if !errors.Is(err, ErrIPAMInvalidInput) || !strings.Contains(err.Error(), "too large") {
+			t.Fatalf("Truncated IP Range added for %s:%v", cidr, err)
+		}
+	}
+
+	err = ipa.AddIPRange(IPClusterDefault, "5ffe::1-5ffe::ffff:ffff:ffff:ffff")
+	if err != nil {
+		t.Fatalf("Failed to add IP Range for 5ffe::1-5ffe::ffff:ffff:ffff:ffff:%s", err)
+	}
+	_, _, err = ipa.LookupIP(IPClusterDefault, "10.0.0.1")
+	if !errors.Is(err, ErrIPAMIPNotAllocated) || strings.Contains(err.Error(), "5ffe") {
+		t.Fatalf("IPv4 address looked up in IPv6 range:%v", err)
+	}
+	err = ipa.ReserveIP(IPClusterDefault, "5ffe::1-5ffe::ffff:ffff:ffff:ffff", IPAMNoIdent, "5ffe::1:0:0:0:0")
+	if !errors.Is(err, ErrIPAMOutOfBounds) {
+		t.Fatalf("Reserved IP beyond the end of range 5ffe::1-5ffe::ffff:ffff:ffff:ffff:%v", err)
+	}
+
+	cR := NewCounter(1, ^uint64(0)-1)
+	err = cR.ReserveCounter(^uint64(0) - 1)
+	if err != nil {
+		t.Fatalf("failed to reserve valid Counter %d:%s", ^uint64(0)-1, err)
+	}
+	err = cR.ReserveCounter(^uint64(0))
+	if err == nil {
+		t.Fatalf("Able to reserve invalid Counter %d", ^uint64(0))
+	}
+	if cR.CounterFree() != ^uint64(0)-2 {
+		t.Fatalf("Invalid free Counters %d", cR.CounterFree())
+	}
+}
+
+func TestIPAllocIndex(t *testing.T) {
+	ipa := IpAllocatorNew()
+	ranges := []struct {
+		cidr  string
+		first string
+		size  int
+	}{
+		{"10.0.0.200-10.0.1.50", "10.0.0.200", 107},
+		{"10.0.255.250-10.1.1.5", "10.0.255.250", 268},
+		{"20.0.0.0/22", "20.0.0.0", 1024},
+		{"30.0.0.0/16", "30.0.0.1", 65534},
+		{"3ffe::fff0-3ffe::1:0010", "3ffe::fff0", 33},
+		{"4ffe::ffff:ff00-4ffe::1:0:1ff", "4ffe::ffff:ff00", 768},
+		{"5ffe::/112", "5ffe::1", 65534},
+	}
+
+	for _, r := range ranges {
+		err := ipa.AddIPRange(IPClusterDefault, r.cidr)
+		if err != nil {
+			t.Fatalf("Failed to add IP Range for %s:%s", r.cidr, err)
+		}
+
+		sz, err := ipa.GetIPRangeSize(IPClusterDefault, r.cidr)
+		if err != nil || sz != uint64(r.size) {
+			t.Fatalf("Invalid IP Range size for %s:%d:%d", r.cidr, sz, r.size)
+		}
+
+		first := new(big.Int).SetBytes(net.ParseIP(r.first).To16())
+		iplen := len(net.ParseIP(r.first).To16())
+		for n := 0; n < r.size; n++ {
+			ip, err := ipa.AllocateNewIP(IPClusterDefault, r.cidr, IPAMNoIdent)
+			if err != nil {
+				t.Fatalf("IP Alloc failed for %s:%d:%s", r.cidr, n, err)
+			}
+
+			eb := new(big.Int).Add(first, big.NewInt(int64(n))).FillBytes(make([]byte, iplen))
+			if !net.IP(eb).Equal(ip) {
+				t.Fatalf("IP Alloc for %s:%d got %s expected %s", r.cidr, n, ip.String(), net.IP(eb).String())
+			}
+		}
+
+		_, err = ipa.AllocateNewIP(IPClusterDefault, r.cidr, IPAMNoIdent)
+		if err == nil {
+			t.Fatalf("IP Alloc unexpected success for exhausted %s", r.cidr)
+		}
+
+		for n := 0; n < r.size; n++ {
+			eb := new(big.Int).Add(first, big.NewInt(int64(n))).FillBytes(make([]byte, iplen))
+			err = ipa.DeAllocateIP(IPClusterDefault, r.cidr, IPAMNoIdent, net.IP(eb).String())
+			if err != nil {
+				t.Fatalf("IP DeAlloc failed for %s:%s:%s", r.cidr, net.IP(eb).String(), err)
+			}
+			err = ipa.ReserveIP(IPClusterDefault, r.cidr, IPAMNoIdent, net.IP(eb).String())
+			if err != nil {
+				t.Fatalf("IP Reserve failed for %s:%s:%s", r.cidr, net.IP(eb).String(), err)
+			}
+		}
+
+		eb := new(big.Int).Add(first, big.NewInt(int64(r.size))).FillBytes(make([]byte, iplen))
+		err = ipa.ReserveIP(IPClusterDefault, r.cidr, IPAMNoIdent, net.IP(eb).String())
+		if err == nil {
+			t.Fatalf("IP Reserve unexpected success for %s:%s", r.cidr, net.IP(eb).String())
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, base := range []string{"0.0.0.1", "10.255.255.255", "::1", "3ffe::ffff:ffff:ffff:fff0"} {
+		baseIP := net.ParseIP(base)
+		if baseIP.To4() != nil {
+			baseIP = baseIP.To4()
+		}
+		for n := 0; n < 1000; n++ {
+			idx := rnd.Uint64()
+			if baseIP.To4() != nil {
+				idx >>= 40
+			}
+			ip := addIPIndex(baseIP, idx)
+			eb := new(big.Int).Add(new(big.Int).SetBytes(baseIP), new(big.Int).SetUint64(idx))
+			if new(big.Int).SetBytes(ip).Cmp(eb) != 0 {
+				t.Fatalf("addIPIndex %s:%d got %s", base, idx, ip.String())
+			}
+			if diffIPIndex(baseIP, ip) != idx {
+				t.Fatalf("diffIPIndex %s:%s got %d expected %d", base, ip.String(), diffIPIndex(baseIP, ip), idx)
+			}
+		}
+		if diffIPIndex(addIPIndex(baseIP, 1), baseIP) != ^uint64(0) {
+			t.Fatalf("diffIPIndex unexpected success for %s", base)
+		}
+	}
+}
+
+func TestIPAllocState(t *testing.T) {
+	ipa := IpAllocatorNew()
+	proto := "tcp"
+
+	ipa.AddIPRange(IPClusterDefault, "40.40.40.0/24")
+	ipa.AddIPRange("poolx", "41.41.41.1-41.41.41.10")
+	ipa.AddIPRange("poolx", "4ffe::/120")
+	ipa.AddIPRange("pooly", "42.42.42.0/30")
+
+	for i := 0; i < 5; i++ {
+		ipa.AllocateNewIP(IPClusterDefault, "40.40.40.0/24", IPAMNoIdent)
+	}
+	ipa.DeAllocateIP(IPClusterDefault, "40.40.40.0/24", IPAMNoIdent, "40.40.40.3")
+	ipa.DeAllocateIP(IPClusterDefault, "40.40.40.0/24", IPAMNoIdent, "40.40.40.1")
+	ipa.ReserveIP(IPClusterDefault, "40.40.40.0/24", IPAMNoIdent, "40.40.40.100")
+
+	ipa.ReserveIP("poolx", "41.41.41.1-41.41.41.10", IPAMNoIdent, "41.41.41.5")
+	ipa.AllocateNewIP("poolx", "41.41.41.1-41.41.41.10", MakeIPAMIdent("svc1", 80, proto))
+	ipa.AllocateNewIP("poolx", "41.41.41.1-41.41.41.10", MakeIPAMIdent("svc2", 80, proto))
+	ipa.AllocateNewIP("poolx", "4ffe::/120", MakeIPAMIdent("svc3", 443, proto))
+	ipa.AllocateNewIP("poolx", "4ffe::/120", IPAMNoIdent)
+
+	data, err := ipa.ExportState()
+	if err != nil {
+		t.Fatalf("Failed to export IPAM state:%s", err)
+	}
+
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state:%s", err)
+	}
+
+	data1, err := ipa1.ExportState()
+	if err != nil || string(data) != string(data1) {
+		t.Fatalf("IPAM state mismatch after import:\n%s\n%s", string(data), string(data1))
+	}
+
+	ops := []struct {
+		cluster string
+		cidr    string
+		ident   string
+	}{
+		{IPClusterDefault, "40.40.40.0/24", IPAMNoIdent},
+		{IPClusterDefault, "40.40.40.0/24", IPAMNoIdent},
+		{IPClusterDefault, "40.40.40.0/24", IPAMNoIdent},
+		{IPClusterDefault, "40.40.40.0/24", MakeIPAMIdent("svc4", 80, proto)},
+		{"poolx", "41.41.41.1-41.41.41.10", MakeIPAMIdent("svc5", 80, proto)},
+		{"poolx", "41.41.41.1-41.41.41.10", IPAMNoIdent},
+		{"poolx", "4ffe::/120", MakeIPAMIdent("svc6", 80, proto)},
+		{"pooly", "42.42.42.0/30", IPAMNoIdent},
+	}
+
+	for _, op := range ops {
+		ip, err := ipa.AllocateNewIP(op.cluster, op.cidr, op.ident)
+		ip1, err1 := ipa1.AllocateNewIP(op.cluster, op.cidr, op.ident)
+		if (err == nil) != (err1 == nil) || !ip.Equal(ip1) {
+			t.Fatalf("IP Alloc mismatch after import for %s:%s:%s", op.cidr, ip.String(), ip1.String())
+		}
+	}
+
+	err = ipa1.DeAllocateIP("poolx", "41.41.41.1-41.41.41.10", MakeIPAMIdent("svc1", 80, proto), "41.41.41.1")
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed after import:%s", err)
+	}
+
+	_, err = IpAllocatorImport([]byte(`{"version":99,"clusters":[]}`))
+	if err == nil {
+		t.Fatalf("Imported unsupported IPAM state version")
+	}
+
+	_, err = IpAllocatorImport([]byte(`{"version":1,"clusters":[{"name":"default","ranges":[{"range":"43.43.43.0/24","next":"43.43.43.3","allocated":["43.43.43.1"]}]}]}`))
+	if err == nil {
+		t.Fatalf("Imported inconsistent IPAM state")
+	}
+}
+
+func TestIPAllocQuery(t *testing.T) {
+	ipa := IpAllocatorNew()
+	proto := "tcp"
+
+	ipa.AddIPRange(IPClusterDefault, "50.50.50.0/24")
+	ipa.AddIPRange("poolx", "51.51.51.1-51.51.51.4")
+	ipa.AddIPRange("poolx", "5ffe::/64")
+
+	clusters := ipa.ListIPClusters()
+	if len(clusters) != 2 || clusters[0] != IPClusterDefault || clusters[1] != "poolx" {
+		t.Fatalf("IP cluster list mismatch %v", clusters)
+	}
+
+	ranges, err := ipa.ListIPRanges("poolx")
+	if err != nil || len(ranges) != 2 || ranges[0] != "51.51.51.1-51.51.51.4" || ranges[1] != "5ffe::/64" {
+		t.Fatalf("IP range list mismatch %v:%s", ranges, err)
+	}
+
+	_, err = ipa.ListIPRanges("pooly")
+	if err == nil {
+		t.Fatalf("IP range list unexpected success for pooly")
+	}
+
+	ipa.AllocateNewIP("poolx", "51.51.51.1-51.51.51.4", MakeIPAMIdent("svc1", 80, proto))
+	ipa.AllocateNewIP("poolx", "51.51.51.1-51.51.51.4", MakeIPAMIdent("svc2", 80, proto))
+	ipa.AllocateNewIP("poolx", "51.51.51.1-51.51.51.4", IPAMNoIdent)
+	ipa.ReserveIP("poolx", "51.51.51.1-51.51.51.4", IPAMNoIdent, "51.51.51.4")
+
+	allocs, err := ipa.ListAllocatedIPs("poolx", "51.51.51.1-51.51.51.4")
+	if err != nil || len(allocs) != 3 {
+		t.Fatalf("IP alloc list mismatch %v:%s", allocs, err)
+	}
+
+	if allocs[0].IP.String() != "51.51.51.1" || len(allocs[0].Idents) != 2 ||
+		allocs[0].Idents[MakeIPAMIdent("svc1", 80, proto)] != 1 || allocs[0].Idents[MakeIPAMIdent("svc2", 80, proto)] != 1 {
+		t.Fatalf("IP alloc list mismatch %s:%v", allocs[0].IP.String(), allocs[0].Idents)
+	}
+
+	if allocs[1].IP.String() != "51.51.51.2" || allocs[1].Idents[IPAMNoIdent] != 1 {
+		t.Fatalf("IP alloc list mismatch %s:%v", allocs[1].IP.String(), allocs[1].Idents)
+	}
+
+	if allocs[2].IP.String() != "51.51.51.4" || allocs[2].Idents[IPAMNoIdent] != 1 {
+		t.Fatalf("IP alloc list mismatch %s:%v", allocs[2].IP.String(), allocs[2].Idents)
+	}
+
+	ri, err := ipa.GetIPRangeInfo("poolx", "51.51.51.1-51.51.51.4")
+	if err != nil || ri.Size != 4 || ri.Used != 3 || ri.Free != 1 || ri.Utilization != 75 {
+		t.Fatalf("IP range info mismatch %v:%s", ri, err)
+	}
+
+	ipa.DeAllocateIP("poolx", "51.51.51.1-51.51.51.4", IPAMNoIdent, "51.51.51.2")
+
+	infos, err := ipa.ListIPRangeInfo("poolx")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("IP range info list mismatch %v:%s", infos, err)
+	}
+
+	if infos[0].Range != "51.51.51.1-51.51.51.4" || infos[0].Used != 2 || infos[0].Free != 2 {
+		t.Fatalf("IP range info mismatch %v", infos[0])
+	}
+
+	if infos[1].Range != "5ffe::/64" || infos[1].Used != 0 || infos[1].Size != ^uint64(0)-1 {
+		t.Fatalf("IP range info mismatch %v", infos[1])
+	}
+
+	_, err = ipa.GetIPRangeInfo("poolx", "52.52.52.0/24")
+	if err == nil {
+		t.Fatalf("IP range info unexpected success for 52.52.52.0/24")
+	}
+}
+
+func TestIPAllocCluster(t *testing.T) {
+	ipa := IpAllocatorNew()
+
+	ipa.AddIPRange("poolx", "60.60.60.1-60.60.60.2")
+	ipa.AddIPRange("poolx", "6ffe::/126")
+	ipa.AddIPRange("poolx", "61.61.61.1-61.61.61.2")
+	ipa.AddIPRange("poolx", "62.62.62.1-62.62.62.2")
+
+	err := ipa.SetIPRangePriority("poolx", "62.62.62.1-62.62.62.2", -1)
+	if err != nil {
+		t.Fatalf("Failed to set IP range priority:%s", err)
+	}
+
+	expected := []struct {
+		ip   string
+		cidr string
+	}{
+		{"62.62.62.1", "62.62.62.1-62.62.62.2"},
+		{"62.62.62.2", "62.62.62.1-62.62.62.2"},
+		{"60.60.60.1", "60.60.60.1-60.60.60.2"},
+		{"60.60.60.2", "60.60.60.1-60.60.60.2"},
+		{"61.61.61.1", "61.61.61.1-61.61.61.2"},
+		{"61.61.61.2", "61.61.61.1-61.61.61.2"},
+	}
+
+	for _, e := range expected {
+		ip, cidr, err := ipa.AllocateIPFromCluster("poolx", false, IPAMNoIdent)
+		if err != nil || ip.String() != e.ip || cidr != e.cidr {
+			t.Fatalf("Cluster IP Alloc got %s:%s expected %s:%s:%v", ip.String(), cidr, e.ip, e.cidr, err)
+		}
+	}
+
+	_, _, err = ipa.AllocateIPFromCluster("poolx", false, IPAMNoIdent)
+	if err == nil {
+		t.Fatalf("Cluster IP Alloc unexpected success for exhausted poolx")
+	}
+
+	ip, cidr, err := ipa.AllocateIPFromCluster("poolx", true, IPAMNoIdent)
+	if err != nil || ip.String() != "6ffe::" || cidr != "6ffe::/126" {
+		t.Fatalf("Cluster IP Alloc got %s:%s:%v", ip.String(), cidr, err)
+	}
+
+	err = ipa.DeAllocateIPFromCluster("poolx", IPAMNoIdent, "60.60.60.2")
+	if err != nil {
+		t.Fatalf("Cluster IP DeAlloc failed for 60.60.60.2:%s", err)
+	}
+
+	err = ipa.DeAllocateIPFromCluster("poolx", IPAMNoIdent, "60.60.60.2")
+	if err == nil {
+		t.Fatalf("Cluster IP DeAlloc unexpected success for 60.60.60.2")
+	}
+
+	err = ipa.DeAllocateIPFromCluster("poolx", IPAMNoIdent, "63.63.63.1")
+	if err == nil {
+		t.Fatalf("Cluster IP DeAlloc unexpected success for 63.63.63.1")
+	}
+
+	ident := MakeIPAMIdent("svc1", 80, "tcp")
+	ip, cidr, err = ipa.AllocateIPFromCluster("poolx", false, ident)
+	if err != nil || ip.String() != "62.62.62.1" || cidr != "62.62.62.1-62.62.62.2" {
+		t.Fatalf("Cluster shared IP Alloc got %s:%s:%v", ip.String(), cidr, err)
+	}
+
+	_, _, err = ipa.AllocateIPFromCluster("poolx", false, ident)
+	if err == nil {
+		t.Fatalf("Cluster IP Alloc unexpected success for existing ident")
+	}
+
+	ipa.SetIPRangePriority("poolx", "62.62.62.1-62.62.62.2", 0)
+	ipa.AddIPRange("pooly", "64.64.64.1-64.64.64.2")
+	ipa.SetIPRangePriority("pooly", "64.64.64.1-64.64.64.2", 10)
+	ipa.AddIPRange("pooly", "65.65.65.1-65.65.65.2")
+
+	ip, cidr, err = ipa.AllocateIPFromCluster("pooly", false, IPAMNoIdent)
+	if err != nil || ip.String() != "65.65.65.1" || cidr != "65.65.65.1-65.65.65.2" {
+		t.Fatalf("Cluster IP Alloc got %s:%s:%v", ip.String(), cidr, err)
+	}
+
+	ipa1, err := IpAllocatorFromState(ipa.GetState())
+	if err != nil {
+		t.Fatalf("Failed to restore IPAM state:%s", err)
+	}
+
+	ip, cidr, err = ipa1.AllocateIPFromCluster("poolx", false, IPAMNoIdent)
+	if err != nil || ip.String() != "60.60.60.2" || cidr != "60.60.60.1-60.60.60.2" {
+		t.Fatalf("Cluster IP Alloc after restore got %s:%s:%v", ip.String(), cidr, err)
+	}
+
+	ipa1.DeAllocateIPFromCluster("pooly", IPAMNoIdent, "65.65.65.1")
+	ipa1.ReserveIP("pooly", "65.65.65.1-65.65.65.2", IPAMNoIdent, "65.65.65.2")
+	ipa1.ReserveIP("pooly", "65.65.65.1-65.65.65.2", IPAMNoIdent, "65.65.65.1")
+	ip, cidr, err = ipa1.AllocateIPFromCluster("pooly", false, IPAMNoIdent)
+	if err != nil || ip.String() != "64.64.64.1" || cidr != "64.64.64.1-64.64.64.2" {
+		t.Fatalf("Cluster IP Alloc after restore got %s:%s:%v", ip.String(), cidr, err)
+	}
+
+	// Errors other than an exhausted range are not skipped over
+	ipa1.SetIPRangeSharing("pooly", "65.65.65.1-65.65.65.2", IPAMSharePort)
+	_, _, err = ipa1.AllocateIPFromCluster("pooly", false, "svc9")
+	if !errors.Is(err, ErrIPAMInvalidInput) || !strings.Contains(err.Error(), "65.65.65.1-65.65.65.2") {
+		t.Fatalf("Cluster IP Alloc error mismatch for ident without port:%v", err)
+	}
+}
+
+func TestIPAllocExclusion(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "70.70.70.1-70.70.70.6"
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+
+	ip, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if ip.String() != "70.70.70.1" {
+		t.Fatalf("IP Alloc failed for %s:%s", cidr, ip.String())
+	}
+
+	err := ipa.AddIPRangeExclusion(IPClusterDefault, cidr, "gw", "70.70.70.1")
+	if err != nil {
+		t.Fatalf("Failed to add IP exclusion 70.70.70.1:%s", err)
+	}
+
+	err = ipa.AddIPRangeExclusion(IPClusterDefault, cidr, "vrrp", "70.70.70.2-70.70.70.3")
+	if err != nil {
+		t.Fatalf("Failed to add IP exclusion 70.70.70.2-70.70.70.3:%s", err)
+	}
+
+	err = ipa.AddIPRangeExclusion(IPClusterDefault, cidr, "vrrp", "70.70.70.2-70.70.70.3")
+	if err == nil {
+		t.Fatalf("Added duplicate IP exclusion 70.70.70.2-70.70.70.3")
+	}
+
+	err = ipa.AddIPRangeExclusion(IPClusterDefault, cidr, "vip", "71.71.71.1")
+	if err == nil {
+		t.Fatalf("Added out of bounds IP exclusion 71.71.71.1")
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "70.70.70.3")
+	if err == nil {
+		t.Fatalf("Reserved excluded IP 70.70.70.3")
+	}
+
+	ri, _ := ipa.GetIPRangeInfo(IPClusterDefault, cidr)
+	if ri.Used != 1 || ri.Excluded != 2 || ri.Free != 3 {
+		t.Fatalf("IP range info mismatch %v", ri)
+	}
+
+	err = ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, "70.70.70.1")
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for 70.70.70.1:%s", err)
+	}
+
+	allocs, _ := ipa.ListAllocatedIPs(IPClusterDefault, cidr)
+	if len(allocs) != 0 {
+		t.Fatalf("Excluded IPs listed as allocations %v", allocs)
+	}
+
+	excluded, _ := ipa.ListExcludedIPs(IPClusterDefault, cidr)
+	if len(excluded) != 3 || excluded[0].String() != "70.70.70.1" || excluded[2].String() != "70.70.70.3" {
+		t.Fatalf("Excluded IP list mismatch %v", excluded)
+	}
+
+	excls, _ := ipa.ListIPRangeExclusions(IPClusterDefault, cidr)
+	if len(excls) != 2 || excls["gw"][0] != "70.70.70.1" || excls["vrrp"][0] != "70.70.70.2-70.70.70.3" {
+		t.Fatalf("IP exclusion list mismatch %v", excls)
+	}
+
+	for _, expected := range []string{"70.70.70.4", "70.70.70.5", "70.70.70.6"} {
+		ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil || ip.String() != expected {
+			t.Fatalf("IP Alloc for %s got %s expected %s", cidr, ip.String(), expected)
+		}
+	}
+
+	_, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err == nil {
+		t.Fatalf("Allocated excluded IP from %s", cidr)
+	}
+
+	ipa1, err := IpAllocatorFromState(ipa.GetState())
+	if err != nil {
+		t.Fatalf("Failed to restore IPAM state:%s", err)
+	}
+
+	ri, _ = ipa1.GetIPRangeInfo(IPClusterDefault, cidr)
+	if ri.Used != 3 || ri.Excluded != 3 || ri.Free != 0 {
+		t.Fatalf("IP range info mismatch after restore %v", ri)
+	}
+
+	err = ipa.DeleteIPRangeExclusion(IPClusterDefault, cidr, "vrrp", "")
+	if err != nil {
+		t.Fatalf("Failed to delete IP exclusion vrrp:%s", err)
+	}
+
+	err = ipa.DeleteIPRangeExclusion(IPClusterDefault, cidr, "vrrp", "")
+	if err == nil {
+		t.Fatalf("Deleted non-existent IP exclusion vrrp")
+	}
+
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err != nil || ip.String() != "70.70.70.2" {
+		t.Fatalf("IP Alloc failed after exclusion removal %s:%v", ip.String(), err)
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "70.70.70.3")
+	if err != nil {
+		t.Fatalf("IP Reserve failed after exclusion removal:%s", err)
+	}
+
+	ipa.AddIPRange(IPClusterDefault, "7ffe::/64")
+	err = ipa.AddIPRangeExclusion(IPClusterDefault, "7ffe::/64", "static", "7ffe::/120")
+	if err != nil {
+		t.Fatalf("Failed to add IP exclusion 7ffe::/120:%s", err)
+	}
+
+	err = ipa.AddIPRangeExclusion(IPClusterDefault, "7ffe::/64", "static", "7ffe::/96")
+	if err == nil {
+		t.Fatalf("Added too large IP exclusion 7ffe::/96")
+	}
+
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, "7ffe::/64", IPAMNoIdent)
+	if err != nil || ip.String() != "7ffe::100" {
+		t.Fatalf("IP Alloc failed with exclusion %s:%v", ip.String(), err)
+	}
+}
+
+func TestIPAllocOverlap(t *testing.T) {
+	ipa := IpAllocatorNew()
+
+	ranges := []struct {
+		cluster string
+		cidr    string
+		ok      bool
+	}{
+		{IPClusterDefault, "90.90.90.0/24", true},
+		{IPClusterDefault, "90.90.90.10-90.90.90.20", false},
+		{IPClusterDefault, "90.90.0.0/16", false},
+		{IPClusterDefault, "90.90.89.250-90.90.90.0", false},
+		{IPClusterDefault, "90.90.91.0-90.90.91.20", true},
+		{IPClusterDefault, "90.90.91.20/32", false},
+		{IPClusterDefault, "90.90.91.21/32", true},
+		{IPClusterDefault, "::ffff:90.90.90.0/120", false},
+		{IPClusterDefault, "::ffff:90.90.93.0/120", true},
+		{"poolx", "90.90.90.0/24", true},
+		{"poolx", "90.90.90.128/25", false},
+	}
+
+	for _, r := range ranges {
+		err := ipa.AddIPRange(r.cluster, r.cidr)
+		if (err == nil) != r.ok {
+			t.Fatalf("IP range overlap check mismatch for %s:%s:%v", r.cluster, r.cidr, err)
+		}
+	}
+
+	err := ipa.AddIPRange(IPClusterDefault, "90.90.90.5-90.90.90.6")
+	if err == nil || !strings.Contains(err.Error(), "90.90.90.0/24") {
+		t.Fatalf("IP range overlap error does not name the conflicting range:%v", err)
+	}
+
+	ipa.SetIPRangeOverlapCheck(true)
+
+	err = ipa.AddIPRange("pooly", "90.90.91.10-90.90.91.11")
+	if err == nil || !strings.Contains(err.Error(), IPClusterDefault) {
+		t.Fatalf("IP range overlap across clusters not detected:%v", err)
+	}
+
+	err = ipa.AddIPRange("pooly", "90.90.92.0/24")
+	if err != nil {
+		t.Fatalf("Failed to add IP range 90.90.92.0/24:%s", err)
+	}
+
+	ipa.SetIPRangeOverlapCheck(false)
+
+	err = ipa.AddIPRange("poolz", "90.90.92.0/24")
+	if err != nil {
+		t.Fatalf("Failed to add IP range 90.90.92.0/24 to another cluster:%s", err)
+	}
+}
+
+func TestIPAllocDelete(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "91.91.91.10-91.91.91.50"
+	proto := "tcp"
+
+	err := ipa.AddIPRange("poolx", cidr)
+	if err != nil {
+		t.Fatalf("Failed to add IP range %s:%s", cidr, err)
+	}
+
+	ip1, _ := ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	ip2, _ := ipa.AllocateNewIP("poolx", cidr, MakeIPAMIdent("svc1", 80, proto))
+	ip3, _ := ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	if !ip2.Equal(ip1) || ip3.String() != "91.91.91.11" {
+		t.Fatalf("IP alloc mismatch for %s:%s:%s:%s", cidr, ip1.String(), ip2.String(), ip3.String())
+	}
+
+	err = ipa.DeleteIPRange("poolx", "91.91.91.10-91.91.91")
+	if err == nil {
+		t.Fatalf("Deleted invalid IP range")
+	}
+
+	err = ipa.DeleteIPRange("poolx", cidr)
+	if err == nil {
+		t.Fatalf("Deleted IP range %s with IPs in use", cidr)
+	}
+
+	err = ipa.DeAllocateIP("poolx", cidr, IPAMNoIdent, ip3.String())
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for %s:%s", ip3.String(), err)
+	}
+
+	evicted, err := ipa.DeleteIPRangeForce("poolx", cidr)
+	if err != nil || len(evicted) != 1 || !evicted[0].IP.Equal(ip1) || len(evicted[0].Idents) != 2 ||
+		evicted[0].Idents[MakeIPAMIdent("svc1", 80, proto)] != 1 {
+		t.Fatalf("IP range force delete mismatch for %s:%v:%v", cidr, evicted, err)
+	}
+
+	err = ipa.AddIPRange("poolx", cidr)
+	if err != nil {
+		t.Fatalf("Failed to re-add IP range %s:%s", cidr, err)
+	}
+
+	ip, err := ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	if err != nil || !ip.Equal(ip1) {
+		t.Fatalf("IP alloc failed after re-adding %s:%v", cidr, err)
+	}
+
+	err = ipa.DeAllocateIP("poolx", cidr, IPAMNoIdent, ip1.String())
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for %s:%s", ip1.String(), err)
+	}
+
+	err = ipa.DeleteIPRange("poolx", cidr)
+	if err != nil {
+		t.Fatalf("Failed to delete unused IP range %s:%s", cidr, err)
+	}
+
+	err = ipa.DeleteIPRange("poolx", cidr)
+	if err == nil {
+		t.Fatalf("Deleted IP range %s twice", cidr)
+	}
+}
+
+func TestIPAllocResize(t *testing.T) {
+	ipa := IpAllocatorNew()
+	proto := "tcp"
+
+	ipa.AddIPRange(IPClusterDefault, "92.92.92.0/30")
+	ipa.AddIPRange(IPClusterDefault, "92.92.92.16/28")
+
+	ip1, _ := ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/30", IPAMNoIdent)
+	ip2, _ := ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/30", MakeIPAMIdent("svc1", 80, proto))
+	ip3, _ := ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/30", IPAMNoIdent)
+	if ip1.String() != "92.92.92.0" || !ip2.Equal(ip1) || ip3.String() != "92.92.92.1" {
+		t.Fatalf("IP alloc mismatch for 92.92.92.0/30:%s:%s:%s", ip1.String(), ip2.String(), ip3.String())
+	}
+	ipa.DeAllocateIP(IPClusterDefault, "92.92.92.0/30", IPAMNoIdent, ip3.String())
+
+	err := ipa.ResizeIPRange(IPClusterDefault, "92.92.92.0/30", "92.92.92.0/27")
+	if err == nil {
+		t.Fatalf("IP range resized over an existing range")
+	}
+
+	err = ipa.ResizeIPRange(IPClusterDefault, "92.92.92.0/30", "92.92.92.0/29")
+	if err != nil {
+		t.Fatalf("Failed to grow IP range 92.92.92.0/30:%s", err)
+	}
+
+	_, err = ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/30", IPAMNoIdent)
+	if err == nil {
+		t.Fatalf("IP alloc from IP range before resize")
+	}
+
+	// Addresses which were never handed out come first, followed by returned ones
+	for _, exp := range []string{"92.92.92.2", "92.92.92.3", "92.92.92.4", "92.92.92.5", "92.92.92.6", "92.92.92.7", "92.92.92.1"} {
+		ip, err := ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/29", IPAMNoIdent)
+		if err != nil || ip.String() != exp {
+			t.Fatalf("IP alloc mismatch after grow:%s:%s:%v", ip.String(), exp, err)
+		}
+	}
+
+	ip, err := ipa.AllocateNewIP(IPClusterDefault, "92.92.92.0/29", MakeIPAMIdent("svc2", 80, proto))
+	if err != nil || !ip.Equal(ip1) {
+		t.Fatalf("Shared IP lost after grow:%s:%v", ip.String(), err)
+	}
+
+	err = ipa.ResizeIPRange(IPClusterDefault, "92.92.92.0/29", "92.92.92.0/30")
+	if err == nil || !strings.Contains(err.Error(), "92.92.92.4") {
+		t.Fatalf("IP range shrink did not fail on IPs in use:%v", err)
+	}
+
+	for _, IPString := range []string{"92.92.92.4", "92.92.92.5", "92.92.92.6", "92.92.92.7"} {
+		ipa.DeAllocateIP(IPClusterDefault, "92.92.92.0/29", IPAMNoIdent, IPString)
+	}
+
+	err = ipa.ResizeIPRange(IPClusterDefault, "92.92.92.0/29", "92.92.92.0/30")
+	if err != nil {
+		t.Fatalf("Failed to shrink IP range 92.92.92.0/29:%s", err)
+	}
+
+	err = ipa.DeAllocateIP(IPClusterDefault, "92.92.92.0/30", MakeIPAMIdent("svc1", 80, proto), ip1.String())
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for svc1 after shrink:%s", err)
+	}
+
+	cidr := "93.93.93.10-93.93.93.11"
+	ipa.AddIPRange("poolx", cidr)
+	ipa.AddIPRangeExclusion("poolx", cidr, "gw", "93.93.93.11")
+	ip, _ = ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	if ip.String() != "93.93.93.10" {
+		t.Fatalf("IP alloc mismatch for %s:%s", cidr, ip.String())
+	}
+
+	err = ipa.ResizeIPRange("poolx", cidr, "93.93.93.9-93.93.93.12")
+	if err != nil {
+		t.Fatalf("Failed to grow IP range %s:%s", cidr, err)
+	}
+
+	cidr = "93.93.93.9-93.93.93.12"
+	for _, exp := range []string{"93.93.93.9", "93.93.93.12"} {
+		ip, err = ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+		if err != nil || ip.String() != exp {
+			t.Fatalf("IP alloc mismatch after grow:%s:%s:%v", ip.String(), exp, err)
+		}
+	}
+
+	_, err = ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	if err == nil {
+		t.Fatalf("Excluded IP allocated after grow")
+	}
+
+	err = ipa.DeAllocateIP("poolx", cidr, IPAMNoIdent, "93.93.93.10")
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for 93.93.93.10 after grow:%s", err)
+	}
+
+	data, _ := ipa.ExportState()
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state after resize:%s", err)
+	}
+	data1, _ := ipa1.ExportState()
+	if string(data) != string(data1) {
+		t.Fatalf("IPAM state mismatch after resize:\n%s\n%s", string(data), string(data1))
+	}
+}
+
+func TestIPAllocErrors(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "94.94.94.1-94.94.94.2"
+	ident := MakeIPAMIdent("svc1", 80, "tcp")
+
+	ipa.AddIPRange("poolx", cidr)
+	ipa.AllocateNewIP("poolx", cidr, ident)
+	ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+
+	_, err := ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	if !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("IP alloc error mismatch:%v", err)
+	}
+
+	var ipamErr *IPAMError
+	if !errors.As(err, &ipamErr) || ipamErr.Cluster != "poolx" || ipamErr.Range != cidr {
+		t.Fatalf("IP alloc error context mismatch:%v", err)
+	}
+
+	_, err = ipa.AllocateNewIP("poolx", cidr, ident)
+	if !errors.Is(err, ErrIPAMIdentExists) || !errors.As(err, &ipamErr) || ipamErr.Ident != ident {
+		t.Fatalf("IP alloc error mismatch for existing ident:%v", err)
+	}
+
+	err = ipa.ReserveIP("poolx", cidr, IPAMNoIdent, "94.94.94.9")
+	if !errors.Is(err, ErrIPAMOutOfBounds) || !errors.As(err, &ipamErr) || ipamErr.IP.String() != "94.94.94.9" {
+		t.Fatalf("IP reserve error mismatch:%v", err)
+	}
+
+	err = ipa.ReserveIP("poolx", cidr, IPAMNoIdent, "94.94.94.2")
+	if !errors.Is(err, ErrIPAMIPInUse) {
+		t.Fatalf("IP reserve error mismatch for IP in use:%v", err)
+	}
+
+	err = ipa.DeAllocateIP("poolx", cidr, MakeIPAMIdent("svc2", 80, "tcp"), "94.94.94.1")
+	if !errors.Is(err, ErrIPAMIdentNotFound) {
+		t.Fatalf("IP DeAlloc error mismatch:%v", err)
+	}
+
+	_, err = ipa.AllocateNewIP("poolx", "94.94.95.0/24", IPAMNoIdent)
+	if !errors.Is(err, ErrIPAMRangeNotFound) || !errors.As(err, &ipamErr) || ipamErr.Range != "94.94.95.0/24" {
+		t.Fatalf("IP alloc error mismatch for missing range:%v", err)
+	}
+
+	err = ipa.DeAllocateIP("pooly", cidr, IPAMNoIdent, "94.94.94.1")
+	if !errors.Is(err, ErrIPAMClusterNotFound) {
+		t.Fatalf("IP DeAlloc error mismatch for missing cluster:%v", err)
+	}
+
+	err = ipa.AddIPRange("poolx", "94.94.94.0/24")
+	if !errors.Is(err, ErrIPAMRangeExists) {
+		t.Fatalf("IP range add error mismatch for overlap:%v", err)
+	}
+
+	err = ipa.AddIPRange("poolx", "94.94.94.300/24")
+	if !errors.Is(err, ErrIPAMInvalidInput) {
+		t.Fatalf("IP range add error mismatch for invalid CIDR:%v", err)
+	}
+
+	err = ipa.DeleteIPRange("poolx", cidr)
+	if !errors.Is(err, ErrIPAMRangeInUse) || !strings.Contains(err.Error(), cidr) {
+		t.Fatalf("IP range delete error mismatch:%v", err)
+	}
+}
+
+func TestIPAllocLookup(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "95.95.95.0/24"
+	svc1 := MakeIPAMIdent("svc|ns1", 80, "TCP")
+	svc2 := MakeIPAMIdent("svc2", 443, "tcp")
+
+	name, id, proto, err := ParseIPAMIdent(svc1)
+	if err != nil || name != "svc|ns1" || id != 80 || proto != "tcp" {
+		t.Fatalf("IPAM ident parse mismatch for %s:%s:%d:%s:%v", svc1, name, id, proto, err)
+	}
+
+	for _, ident := range []string{"svc1", "svc1|80", "svc1|x|tcp", "svc1|4294967296|tcp"} {
+		_, _, _, err = ParseIPAMIdent(ident)
+		if !errors.Is(err, ErrIPAMInvalidInput) {
+			t.Fatalf("Invalid IPAM ident %s parsed:%v", ident, err)
+		}
+	}
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	ipa.AddIPRange("poolx", cidr)
+	ip1, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, svc1)
+	ipa.AllocateNewIP(IPClusterDefault, cidr, svc2)
+	ip2, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	ip3, _ := ipa.AllocateNewIP("poolx", cidr, IPAMNoIdent)
+	ipa.AllocateNewIP("poolx", cidr, svc2)
+
+	ai, r, err := ipa.LookupIP(IPClusterDefault, ip1.String())
+	if err != nil || r != cidr || !ai.IP.Equal(ip1) || len(ai.Idents) != 2 || ai.Idents[svc1] != 1 || ai.Idents[svc2] != 1 {
+		t.Fatalf("IP lookup mismatch for %s:%v:%s:%v", ip1.String(), ai, r, err)
+	}
+
+	ai, _, err = ipa.LookupIP(IPClusterDefault, ip2.String())
+	if err != nil || len(ai.Idents) != 1 || ai.Idents[IPAMNoIdent] != 1 {
+		t.Fatalf("IP lookup mismatch for %s:%v:%v", ip2.String(), ai, err)
+	}
+
+	_, _, err = ipa.LookupIP(IPClusterDefault, "95.95.95.100")
+	if !errors.Is(err, ErrIPAMIPNotAllocated) {
+		t.Fatalf("IP lookup mismatch for unallocated IP:%v", err)
+	}
+
+	_, _, err = ipa.LookupIP(IPClusterDefault, "96.96.96.1")
+	if !errors.Is(err, ErrIPAMRangeNotFound) {
+		t.Fatalf("IP lookup mismatch for IP without range:%v", err)
+	}
+
+	infos, err := ipa.LookupIdent(svc2)
+	if err != nil || len(infos) != 2 || infos[0].Cluster != IPClusterDefault || !infos[0].IP.Equal(ip1) ||
+		infos[1].Cluster != "poolx" || infos[1].Range != cidr || !infos[1].IP.Equal(ip3) {
+		t.Fatalf("Ident lookup mismatch for %s:%v:%v", svc2, infos, err)
+	}
+
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc1, ip1.String())
+	_, err = ipa.LookupIdent(svc1)
+	if !errors.Is(err, ErrIPAMIdentNotFound) {
+		t.Fatalf("Ident lookup mismatch for deallocated %s:%v", svc1, err)
+	}
+}
+
+func TestIPAllocPortSharing(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "97.97.97.1-97.97.97.20"
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	err := ipa.SetIPRangeSharing(IPClusterDefault, cidr, IPAMSharePort)
+	if err != nil {
+		t.Fatalf("Failed to set IP sharing for %s:%s", cidr, err)
+	}
+
+	allocs := []struct {
+		ident string
+		ip    string
+	}{
+		{MakeIPAMIdent("svc1", 80, "tcp"), "97.97.97.1"},
+		{MakeIPAMIdent("svc2", 443, "tcp"), "97.97.97.1"},
+		{MakeIPAMIdent("svc3", 80, "tcp"), "97.97.97.2"},
+		{MakeIPAMIdent("svc4", 80, "udp"), "97.97.97.1"},
+		{IPAMNoIdent, "97.97.97.3"},
+		{MakeIPAMIdent("svc5", 443, "tcp"), "97.97.97.2"},
+		{MakeIPAMIdent("svc6", 443, "tcp"), "97.97.97.4"},
+	}
+
+	for _, a := range allocs {
+		ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, a.ident)
+		if err != nil || ip.String() != a.ip {
+			t.Fatalf("IP alloc mismatch with port sharing for %s:%s:%s:%v", a.ident, ip.String(), a.ip, err)
+		}
+	}
+
+	_, err = ipa.AllocateNewIP(IPClusterDefault, cidr, "svc7")
+	if !errors.Is(err, ErrIPAMInvalidInput) {
+		t.Fatalf("IP alloc with port sharing for ident without port:%v", err)
+	}
+
+	err = ipa.DeAllocateIP(IPClusterDefault, cidr, MakeIPAMIdent("svc1", 80, "tcp"), "97.97.97.1")
+	if err != nil {
+		t.Fatalf("IP DeAlloc failed for svc1:%s", err)
+	}
+
+	ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc8", 80, "tcp"))
+	if err != nil || ip.String() != "97.97.97.1" {
+		t.Fatalf("IP alloc mismatch with port sharing for svc8:%s:%v", ip.String(), err)
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, cidr, MakeIPAMIdent("svc9", 80, "tcp"), "97.97.97.2")
+	if !errors.Is(err, ErrIPAMIPInUse) {
+		t.Fatalf("IP reserved with port conflict:%v", err)
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, cidr, MakeIPAMIdent("svc9", 8080, "tcp"), "97.97.97.3")
+	if !errors.Is(err, ErrIPAMIPInUse) {
+		t.Fatalf("IP reserved on IP allocated without ident:%v", err)
+	}
+
+	err = ipa.ReserveIP(IPClusterDefault, cidr, MakeIPAMIdent("svc9", 80, "tcp"), "97.97.97.10")
+	if err != nil {
+		t.Fatalf("IP reserve failed with port sharing:%s", err)
+	}
+
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc10", 22, "tcp"))
+	if err != nil || ip.String() != "97.97.97.1" {
+		t.Fatalf("IP alloc mismatch with port sharing for svc10:%s:%v", ip.String(), err)
+	}
+
+	data, _ := ipa.ExportState()
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state with port sharing:%s", err)
+	}
+
+	for _, a := range []*IPAllocator{ipa, ipa1} {
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc11", 80, "tcp"))
+		if err != nil || ip.String() != "97.97.97.4" {
+			t.Fatalf("IP alloc mismatch with port sharing for svc11:%s:%v", ip.String(), err)
+		}
+	}
+}
+
+func TestIPAllocDualStack(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr4 := "98.98.98.1-98.98.98.2"
+	cidr6 := "5ffe::1-5ffe::2"
+	svc1 := MakeIPAMIdent("svc1", 80, "tcp")
+
+	ipa.AddIPRange("poolx", cidr4)
+	ipa.AddIPRange("poolx", cidr6)
+
+	_, _, err := ipa.AllocateDualStackIP("poolx", cidr6, cidr4, svc1)
+	if !errors.Is(err, ErrIPAMInvalidInput) {
+		t.Fatalf("Dual-stack IP alloc with swapped ranges:%v", err)
+	}
+
+	ip4, ip6, err := ipa.AllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent)
+	if err != nil || ip4.String() != "98.98.98.1" || ip6.String() != "5ffe::1" {
+		t.Fatalf("Dual-stack IP alloc failed:%v:%v:%v", ip4, ip6, err)
+	}
+
+	ipa.ReserveIP("poolx", cidr6, IPAMNoIdent, "5ffe::2")
+
+	// IPv6 range is exhausted, so the IPv4 address must not be allocated
+	_, _, err = ipa.AllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent)
+	if !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("Dual-stack IP alloc mismatch for exhausted range:%v", err)
+	}
+
+	ip, err := ipa.AllocateNewIP("poolx", cidr4, IPAMNoIdent)
+	if err != nil || ip.String() != "98.98.98.2" {
+		t.Fatalf("IPv4 address leaked by failed dual-stack IP alloc:%s:%v", ip.String(), err)
+	}
+
+	err = ipa.DeAllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent, ip4.String(), "5ffe::3")
+	if err == nil {
+		t.Fatalf("Dual-stack IP DeAlloc succeeded with wrong IPv6 address")
+	}
+
+	err = ipa.DeAllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent, ip4.String(), ip6.String())
+	if err != nil {
+		t.Fatalf("Dual-stack IP DeAlloc failed:%s", err)
+	}
+
+	// Idents share the IPv4 address but need a free IPv6 address
+	ip4, ip6, err = ipa.AllocateDualStackIP("poolx", cidr4, cidr6, svc1)
+	if err != nil || ip4.String() != "98.98.98.1" || ip6.String() != "5ffe::1" {
+		t.Fatalf("Dual-stack IP alloc failed for svc1:%v:%v:%v", ip4, ip6, err)
+	}
+
+	_, _, err = ipa.AllocateDualStackIP("poolx", cidr4, cidr6, svc1)
+	if !errors.Is(err, ErrIPAMIdentExists) {
+		t.Fatalf("Dual-stack IP alloc mismatch for existing ident:%v", err)
+	}
+
+	err = ipa.DeAllocateDualStackIP("poolx", cidr4, cidr6, svc1, ip4.String(), ip6.String())
+	if err != nil {
+		t.Fatalf("Dual-stack IP DeAlloc failed for svc1:%s", err)
+	}
+
+	_, err = ipa.LookupIdent(svc1)
+	if !errors.Is(err, ErrIPAMIdentNotFound) {
+		t.Fatalf("Dual-stack IP DeAlloc left svc1 allocated:%v", err)
+	}
+
+	// A failed IPv6 allocation releases the IPv4 address again. IP addresses are
+	// conflict checked without the allocator locks held
+	cidr4 = "98.98.99.1-98.98.99.3"
+	ipa.AddIPRange("poolx", cidr4)
+	fc := &fakeConflictChecker{inUse: map[string]bool{"98.98.99.1": true, "5ffe::1": true}}
+	fc.probe = func() { ipa.AddIPRange("cl1", "100.68.0.0/24") }
+	ipa.SetIPConflictChecker(fc)
+	runWithTimeout(t, "Dual-stack IP conflict check", func() {
+		_, _, err = ipa.AllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent)
+	})
+	if !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("Dual-stack IP alloc mismatch with IPv6 conflicts:%v", err)
+	}
+	if ips, _ := ipa.ListQuarantinedIPs("poolx", cidr6); len(ips) != 1 || ips[0].String() != "5ffe::1" {
+		t.Fatalf("Dual-stack IPv6 conflict not quarantined:%v", ips)
+	}
+	if ri, _ := ipa.GetIPRangeInfo("poolx", cidr4); ri.Used != 0 || ri.Quarantined != 1 {
+		t.Fatalf("IPv4 address leaked by failed dual-stack IP alloc:%v", ri)
+	}
+
+	ipa.ReleaseQuarantinedIP("poolx", cidr6, "5ffe::1")
+	fc.inUse = map[string]bool{"98.98.99.3": true}
+	ip4, ip6, err = ipa.AllocateDualStackIP("poolx", cidr4, cidr6, IPAMNoIdent)
+	if err != nil || ip4.String() != "98.98.99.2" || ip6.String() != "5ffe::1" {
+		t.Fatalf("Dual-stack IP alloc with IPv4 conflict mismatch:%v:%v:%v", ip4, ip6, err)
+	}
+	ipa.SetIPConflictChecker(nil)
+}
+
+func TestIPAllocBatch(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "99.99.99.0/24"
+	cidr1 := "99.99.100.1-99.99.100.2"
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	ipa.AddIPRange("poolx", cidr1)
+	ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+
+	tx := ipa.NewTxn()
+	tx.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "99.99.99.10")
+	tx.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc1", 80, "tcp"))
+	tx.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, "99.99.99.1")
+	tx.AllocateNewIP("poolx", cidr1, IPAMNoIdent)
+	ips, err := tx.Commit()
+	if err != nil || len(ips) != 4 || !ips[0].Equal(net.ParseIP("99.99.99.10")) ||
+		ips[1].String() != "99.99.99.1" || ips[3].String() != "99.99.100.1" {
+		t.Fatalf("IPAM transaction commit mismatch:%v:%v", ips, err)
+	}
+
+	before, _ := ipa.ExportState()
+
+	ops := []IPAMOp{
+		{Type: IPAMOpAllocate, Cluster: IPClusterDefault, Range: cidr, Ident: MakeIPAMIdent("svc2", 80, "tcp")},
+		{Type: IPAMOpRelease, Cluster: IPClusterDefault, Range: cidr, Ident: MakeIPAMIdent("svc1", 80, "tcp"), IP: "99.99.99.1"},
+		{Type: IPAMOpReserve, Cluster: IPClusterDefault, Range: cidr, IP: "99.99.99.20"},
+		{Type: IPAMOpAllocate, Cluster: "poolx", Range: cidr1},
+		{Type: IPAMOpAllocate, Cluster: "poolx", Range: cidr1},
+	}
+	_, err = ipa.ApplyBatch(ops)
+
+	var batchErr *IPAMBatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 4 || !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("IPAM batch error mismatch:%v", err)
+	}
+
+	after, _ := ipa.ExportState()
+	if string(before) != string(after) {
+		t.Fatalf("IPAM state changed by rejected batch:\n%s\n%s", string(before), string(after))
+	}
+
+	ip, err := ipa.AllocateNewIP("poolx", cidr1, IPAMNoIdent)
+	if err != nil || ip.String() != "99.99.100.2" {
+		t.Fatalf("IP alloc mismatch after rejected batch:%s:%v", ip.String(), err)
+	}
+
+	tx.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "99.99.99.30")
+	tx.Discard()
+	_, err = tx.Commit()
+	if err != nil {
+		t.Fatalf("Empty IPAM transaction commit failed:%s", err)
+	}
+
+	err = ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, "99.99.99.30")
+	if err == nil {
+		t.Fatalf("Discarded IPAM transaction op applied")
+	}
+}
+
+func TestIPAllocStrategy(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "100.64.0.0/24"
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	for i := 0; i < 4; i++ {
+		ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	}
+	ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, "100.64.0.3")
+	ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, "100.64.0.2")
+
+	ip, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if ip.String() != "100.64.0.5" {
+		t.Fatalf("IP alloc mismatch with FIFO strategy:%s", ip.String())
+	}
+
+	err := ipa.SetIPRangeStrategy(IPClusterDefault, cidr, IPAMStrategyLowest)
+	if err != nil {
+		t.Fatalf("Failed to set IP allocation strategy:%s", err)
+	}
+
+	for _, exp := range []string{"100.64.0.2", "100.64.0.3", "100.64.0.6"} {
+		ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil || ip.String() != exp {
+			t.Fatalf("IP alloc mismatch with lowest strategy:%s:%s:%v", ip.String(), exp, err)
+		}
+	}
+
+	ipa.SetIPRangeStrategy(IPClusterDefault, cidr, IPAMStrategyRandom)
+	seen := make(map[string]struct{})
+	for i := 0; i < 50; i++ {
+		ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil {
+			t.Fatalf("IP alloc failed with random strategy:%s", err)
+		}
+		if _, ok := seen[ip.String()]; ok {
+			t.Fatalf("IP alloc with random strategy handed out %s twice", ip.String())
+		}
+		seen[ip.String()] = struct{}{}
+	}
+
+	cidr = "100.65.0.0/16"
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	ipa.SetIPRangeSharing(IPClusterDefault, cidr, IPAMSharePort)
+	ipa.SetIPRangeStrategy(IPClusterDefault, cidr, IPAMStrategySticky)
+
+	svc1 := MakeIPAMIdent("svc1", 80, "tcp")
+	svc2 := MakeIPAMIdent("svc2", 80, "tcp")
+	ip1, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, svc1)
+	ip2, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, svc2)
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc1, ip1.String())
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc2, ip2.String())
+	ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+
+	data, _ := ipa.ExportState()
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state with strategies:%s", err)
+	}
+
+	for _, a := range []*IPAllocator{ipa, ipa1} {
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, svc2)
+		if err != nil || !ip.Equal(ip2) {
+			t.Fatalf("IP alloc with sticky strategy did not return %s:%s:%v", ip2.String(), ip.String(), err)
+		}
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, svc1)
+		if err != nil || !ip.Equal(ip1) {
+			t.Fatalf("IP alloc with sticky strategy did not return %s:%s:%v", ip1.String(), ip.String(), err)
+		}
+	}
+
+	// Sticky strategy with the default IPAMShareFirst sharing
+	cidr = "172.31.0.0/16"
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	ipa.SetIPRangeStrategy(IPClusterDefault, cidr, IPAMStrategySticky)
+
+	ip1, _ = ipa.AllocateNewIP(IPClusterDefault, cidr, svc1)
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc1, ip1.String())
+	ip2, _ = ipa.AllocateNewIP(IPClusterDefault, cidr, svc2)
+	if ip2.Equal(ip1) {
+		t.Fatalf("IP alloc with sticky strategy reused %s of a deleted ident", ip1.String())
+	}
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, svc1)
+	if err != nil || !ip.Equal(ip2) {
+		t.Fatalf("IP alloc with sticky strategy did not share %s:%s:%v", ip2.String(), ip.String(), err)
+	}
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc1, ip.String())
+	ipa.DeAllocateIP(IPClusterDefault, cidr, svc2, ip2.String())
+
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, svc1)
+	if err != nil || !ip.Equal(ip1) {
+		t.Fatalf("IP alloc with sticky strategy did not return %s:%s:%v", ip1.String(), ip.String(), err)
+	}
+}
+
+func TestIPAllocEvents(t *testing.T) {
+	var evs []IPAMEvent
+
+	ipa := IpAllocatorNew()
+	ipa.SetIPAMEventHook(func(ev IPAMEvent) {
+		// Hooks are called without allocator locks held
+		ipa.ListIPClusters()
+		evs = append(evs, ev)
+	})
+
+	err := ipa.SetIPAMWatermarks([]float64{100, 50}, 25)
+	if err != nil {
+		t.Fatalf("Failed to set IPAM watermarks:%s", err)
+	}
+	if ipa.SetIPAMWatermarks([]float64{120}, 0) == nil {
+		t.Fatalf("Invalid IPAM watermark set unexpectedly")
+	}
+
+	cidr := "100.66.0.0/30"
+	ipa.AddIPRange(IPClusterDefault, cidr)
+	if len(evs) != 1 || evs[0].Type != IPAMEventRangeAdded || evs[0].Range != cidr {
+		t.Fatalf("IPAM range added event mismatch:%v", evs)
+	}
+
+	var ips []net.IP
+	for i := 0; i < 4; i++ {
+		ip, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		ips = append(ips, ip)
+	}
+	if _, err := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent); err == nil {
+		t.Fatalf("IP alloc passed on an exhausted range")
+	}
+
+	exp := []IPAMEventType{IPAMEventRangeAdded, IPAMEventAllocate, IPAMEventAllocate, IPAMEventWatermarkRaised,
+		IPAMEventAllocate, IPAMEventAllocate, IPAMEventWatermarkRaised}
+	if len(evs) != len(exp) {
+		t.Fatalf("IPAM event count mismatch:%d:%d", len(evs), len(exp))
+	}
+	for i := range exp {
+		if evs[i].Type != exp[i] {
+			t.Fatalf("IPAM event %d type mismatch:%d:%d", i, evs[i].Type, exp[i])
+		}
+	}
+	if !evs[1].IP.Equal(ips[0]) || evs[3].Watermark != 50 || evs[6].Watermark != 100 || evs[6].Utilization != 100 {
+		t.Fatalf("IPAM event mismatch:%v", evs)
+	}
+
+	// 100% is cleared below 75% and 50% below 25%
+	evs = nil
+	for i := 0; i < 3; i++ {
+		ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, ips[i].String())
+	}
+	exp = []IPAMEventType{IPAMEventRelease, IPAMEventRelease, IPAMEventWatermarkCleared, IPAMEventRelease}
+	if len(evs) != len(exp) {
+		t.Fatalf("IPAM event count mismatch:%d:%d", len(evs), len(exp))
+	}
+	for i := range exp {
+		if evs[i].Type != exp[i] {
+			t.Fatalf("IPAM event %d type mismatch:%d:%d", i, evs[i].Type, exp[i])
+		}
+	}
+	if evs[2].Watermark != 100 || evs[2].Utilization != 50 {
+		t.Fatalf("IPAM watermark cleared event mismatch:%v", evs[2])
+	}
+
+	// A failed batch raises no events
+	evs = nil
+	tx := ipa.NewTxn()
+	tx.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	tx.DeAllocateIP(IPClusterDefault, cidr, "svc1", ips[3].String())
+	if _, err := tx.Commit(); err == nil || len(evs) != 0 {
+		t.Fatalf("IPAM batch mismatch:%v:%v", err, evs)
+	}
+
+	for i := 0; i < 3; i++ {
+		tx.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	}
+	if _, err := tx.Commit(); err != nil || len(evs) != 4 || evs[3].Watermark != 100 {
+		t.Fatalf("IPAM batch event mismatch:%v:%v", err, evs)
+	}
+
+	evs = nil
+	ipa.DeleteIPRangeForce(IPClusterDefault, cidr)
+	if len(evs) != 1 || evs[0].Type != IPAMEventRangeDeleted {
+		t.Fatalf("IPAM range deleted event mismatch:%v", evs)
+	}
+}
+
+type fakeConflictChecker struct {
+	inUse   map[string]bool
+	checked []string
+	probe   func()
+}
+
+func (fc *fakeConflictChecker) CheckConflict(IP net.IP) (bool, error) {
+	fc.checked = append(fc.checked, IP.String())
+	if fc.probe != nil {
+		fc.probe()
+	}
+	return fc.inUse[IP.String()], nil
+}
+
+func TestIPAllocConflict(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "100.67.0.0/24"
+	ipa.AddIPRange(IPClusterDefault, cidr)
+
+	fc := &fakeConflictChecker{inUse: map[string]bool{"100.67.0.2": true, "100.67.0.3": true}}
+	ipa.SetIPConflictChecker(fc)
+
+	ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err != nil || ip.String() != "100.67.0.1" {
+		t.Fatalf("IP alloc with conflict check failed:%s:%v", ip.String(), err)
+	}
+
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err != nil || ip.String() != "100.67.0.4" {
+		t.Fatalf("IP alloc did not skip conflicting IPs:%s:%v", ip.String(), err)
+	}
+
+	// Idents sharing the IP address are not checked again
+	fc.checked = nil
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, "svc1")
+	if err != nil || ip.String() != "100.67.0.1" || len(fc.checked) != 0 {
+		t.Fatalf("IP alloc shared IP mismatch:%s:%v:%v", ip.String(), err, fc.checked)
+	}
+
+	ips, _ := ipa.ListQuarantinedIPs(IPClusterDefault, cidr)
+	if len(ips) != 2 || ips[0].String() != "100.67.0.2" || ips[1].String() != "100.67.0.3" {
+		t.Fatalf("Quarantined IPs mismatch:%v", ips)
+	}
+
+	ri, _ := ipa.GetIPRangeInfo(IPClusterDefault, cidr)
+	if ri.Used != 2 || ri.Quarantined != 2 {
+		t.Fatalf("IP range info mismatch with quarantine:%v", ri)
+	}
+
+	if err := ipa.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "100.67.0.2"); !errors.Is(err, ErrIPAMIPInUse) {
+		t.Fatalf("IP reserve of quarantined IP passed unexpectedly:%v", err)
+	}
+
+	data, _ := ipa.ExportState()
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state with quarantine:%s", err)
+	}
+	ips, _ = ipa1.ListQuarantinedIPs(IPClusterDefault, cidr)
+	if len(ips) != 2 {
+		t.Fatalf("Quarantined IPs mismatch after import:%v", ips)
+	}
+
+	fc.inUse = nil
+	if err := ipa.ReleaseQuarantinedIP(IPClusterDefault, cidr, "100.67.0.3"); err != nil {
+		t.Fatalf("Failed to release quarantined IP:%s", err)
+	}
+	if err := ipa.ReleaseQuarantinedIP(IPClusterDefault, cidr, "100.67.0.3"); !errors.Is(err, ErrIPAMIPNotAllocated) {
+		t.Fatalf("Release of IP not quarantined passed unexpectedly:%v", err)
+	}
+	if err := ipa.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "100.67.0.3"); err != nil {
+		t.Fatalf("Failed to reserve released quarantined IP:%s", err)
+	}
+
+	fc.inUse = make(map[string]bool)
+	for i := 5; i < 5+IPAMMaxConflictTries; i++ {
+		fc.inUse[fmt.Sprintf("100.67.0.%d", i)] = true
+	}
+	_, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if !errors.Is(err, ErrIPAMIPConflict) {
+		t.Fatalf("IP alloc passed with conflicting IPs only:%v", err)
+	}
+	ip, err = ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err != nil || ip.String() != fmt.Sprintf("100.67.0.%d", 5+IPAMMaxConflictTries) {
+		t.Fatalf("IP alloc after conflicts mismatch:%s:%v", ip.String(), err)
+	}
+
+	// Batches are checked without the allocator locks held
+	fc.inUse = map[string]bool{"100.67.0.15": true}
+	fc.probe = func() { ipa.AddIPRange("cl1", "100.68.0.0/24") }
+	runWithTimeout(t, "IP batch conflict check", func() {
+		ips, err = ipa.ApplyBatch([]IPAMOp{{Type: IPAMOpAllocate, Cluster: IPClusterDefault, Range: cidr},
+			{Type: IPAMOpAllocate, Cluster: IPClusterDefault, Range: cidr}})
+	})
+	if err != nil || len(ips) != 2 || ips[0].String() != "100.67.0.14" || ips[1].String() != "100.67.0.16" {
+		t.Fatalf("IP batch alloc with conflict check mismatch:%v:%v", ips, err)
+	}
+	if ips, _ := ipa.ListQuarantinedIPs(IPClusterDefault, cidr); len(ips) != 2+IPAMMaxConflictTries || ips[len(ips)-1].String() != "100.67.0.15" {
+		t.Fatalf("Quarantined IPs mismatch after batch:%v", ips)
+	}
+}
+
+// runWithTimeout - Run f and fail if it doesn't return in time, like when it deadlocks
+func runWithTimeout(t *testing.T, name string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return", name)
+	}
+}
+
+func TestIPAllocStore(t *testing.T) {
+	stores := []IPAMStore{IPAMMemStoreNew(), IPAMFileStoreNew(filepath.Join(t.TempDir(), "ipam"))}
+
+	for _, store := range stores {
+		cidr := "100.68.0.0/24"
+
+		ipa1 := IpAllocatorNew()
+		ipa1.AddIPRange(IPClusterDefault, cidr)
+		if err := ipa1.SetIPAMStore(store); err != nil {
+			t.Fatalf("Failed to set IPAM store:%s", err)
+		}
+
+		// A new allocator takes over the state of the store
+		ipa2 := IpAllocatorNew()
+		if err := ipa2.SetIPAMStore(store); err != nil {
+			t.Fatalf("Failed to set IPAM store:%s", err)
+		}
+		if _, err := ipa2.GetIPRangeSize(IPClusterDefault, cidr); err != nil {
+			t.Fatalf("IPAM store state not adopted:%s", err)
+		}
+
+		var evs []IPAMEvent
+		ipa2.SetIPAMEventHook(func(ev IPAMEvent) { evs = append(evs, ev) })
+
+		var wg sync.WaitGroup
+		var mtx sync.Mutex
+		seen := make(map[string]struct{})
+		for _, ipa := range []*IPAllocator{ipa1, ipa2} {
+			wg.Add(1)
+			go func(ipa *IPAllocator) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+					if err != nil {
+						t.Errorf("IP alloc through IPAM store failed:%s", err)
+						return
+					}
+					mtx.Lock()
+					if _, ok := seen[ip.String()]; ok {
+						t.Errorf("IP %s allocated twice through IPAM store", ip.String())
+					}
+					seen[ip.String()] = struct{}{}
+					mtx.Unlock()
+				}
+			}(ipa)
+		}
+		wg.Wait()
+
+		if len(evs) != 20 {
+			t.Fatalf("IPAM store event count mismatch:%d", len(evs))
+		}
+
+		// Allocations of the other allocator are only seen after a sync
+		for _, ipa := range []*IPAllocator{ipa1, ipa2} {
+			if err := ipa.SyncIPAMStore(); err != nil {
+				t.Fatalf("Failed to sync IPAM store:%s", err)
+			}
+			ri, _ := ipa.GetIPRangeInfo(IPClusterDefault, cidr)
+			if ri.Used != 40 {
+				t.Fatalf("IPAM store used count mismatch:%d", ri.Used)
+			}
+		}
+
+		// Failed mutations are not written to the store
+		recs, _ := store.Load([]string{IPClusterDefault})
+		ver := recs[0].Version
+		if err := ipa1.DeAllocateIP(IPClusterDefault, cidr, "svc1", "100.68.0.1"); err == nil {
+			t.Fatalf("IP dealloc through IPAM store passed unexpectedly")
+		}
+		if recs, _ := store.Load([]string{IPClusterDefault}); recs[0].Version != ver {
+			t.Fatalf("IPAM store updated by failed mutation:%d:%d", ver, recs[0].Version)
+		}
+
+		if err := store.CompareAndSwap([]IPAMStoreRecord{{Key: IPClusterDefault, Version: ver - 1}}); !errors.Is(err, ErrIPAMStoreConflict) {
+			t.Fatalf("IPAM store stale update passed unexpectedly:%v", err)
+		}
+
+		// Hooks can call back into the allocator, as events are only delivered
+		// once the store lock was released
+		hooked := false
+		ipa1.SetIPAMEventHook(func(ev IPAMEvent) {
+			if ev.Type == IPAMEventAllocate && !hooked {
+				hooked = true
+				if err := ipa1.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "100.68.0.250"); err != nil {
+					t.Errorf("IP reserve from IPAM hook failed:%s", err)
+				}
+			}
+		})
+		runWithTimeout(t, "IPAM store hook", func() {
+			if _, err := ipa1.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent); err != nil {
+				t.Errorf("IP alloc through IPAM store failed:%s", err)
+			}
+		})
+		ipa1.SetIPAMEventHook(nil)
+		if ri, _ := ipa1.GetIPRangeInfo(IPClusterDefault, cidr); ri.Used != 42 {
+			t.Fatalf("IPAM store hook mutation lost:%d", ri.Used)
+		}
+
+		// Mutations only write the records of their clusters
+		recs, _ = store.Load([]string{IPClusterDefault})
+		ver = recs[0].Version
+		if err := ipa2.AddIPRange("cl1", "100.68.1.0/24"); err != nil {
+			t.Fatalf("IPAM store range add failed:%s", err)
+		}
+		recs, _ = store.Load(nil)
+		if len(recs) != 2 || recs[0].Key != "cl1" || recs[0].Version != 1 || recs[1].Version != ver {
+			t.Fatalf("IPAM store records mismatch:%v", recs)
+		}
+
+		// An update of several records is all or nothing
+		if err := store.CompareAndSwap([]IPAMStoreRecord{recs[0], {Key: IPClusterDefault, Version: ver - 1}}); !errors.Is(err, ErrIPAMStoreConflict) {
+			t.Fatalf("IPAM store stale update passed unexpectedly:%v", err)
+		}
+		if recs, _ := store.Load([]string{"cl1"}); recs[0].Version != 1 {
+			t.Fatalf("IPAM store partially updated:%v", recs)
+		}
+
+		// Ranges checked for overlaps with all clusters are checked against all
+		// records, even those of clusters the allocator did not sync yet
+		ipa1.SetIPRangeOverlapCheck(true)
+		if err := ipa1.AddIPRange("cl2", "100.68.1.0/25"); !errors.Is(err, ErrIPAMRangeExists) {
+			t.Fatalf("Overlapping range added through IPAM store:%v", err)
+		}
+		if err := ipa1.AddIPRange("cl2", "100.68.2.0/24"); err != nil {
+			t.Fatalf("IPAM store range add failed:%s", err)
+		}
+		ipa1.SetIPRangeOverlapCheck(false)
+		if recs, _ := store.Load(nil); len(recs) != 3 || recs[0].Version != 2 || recs[1].Version != 1 {
+			t.Fatalf("IPAM store records mismatch:%v", recs)
+		}
+
+		ipa2.DeleteIPRangeForce(IPClusterDefault, cidr)
+		if err := ipa1.AddIPRange(IPClusterDefault, cidr); err != nil {
+			t.Fatalf("IPAM store range add mismatch:%v", err)
+		}
+	}
+}
+
+func TestIPAllocJournal(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fj, err := IPAMFileJournalNew(filepath.Join(t.TempDir(), "ipam.journal"))
+	if err != nil {
+		t.Fatalf("Failed to open IPAM journal file:%s", err)
+	}
+	defer fj.Close()
+
+	for _, journal := range []IPAMJournal{IPAMRingJournalNew(100), fj} {
+		ipa := IpAllocatorNew()
+		ipa.SetClock(func() time.Time { return now })
+		ipa.SetIPAMJournal(journal)
+
+		cidr := "100.69.0.0/24"
+		cidr6 := "6ffe::/120"
+		ipa.AddIPRange(IPClusterDefault, cidr)
+		ipa.AddIPRange(IPClusterDefault, cidr6)
+		ipa.AddIPRange("cl1", "100.70.0.0/28")
+		ipa.SetIPRangeSharing(IPClusterDefault, cidr, IPAMSharePort)
+		ipa.AddIPRangeExclusion(IPClusterDefault, cidr, "gw", "100.69.0.1")
+
+		ip1, _ := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		ipa.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc1", 80, "tcp"))
+		ipa.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc2", 80, "tcp"))
+		ipa.AllocateNewIPWithLease(IPClusterDefault, cidr, MakeIPAMIdent("lease1", 53, "udp"), time.Minute)
+		ipa.AllocateNewIPWithLease(IPClusterDefault, cidr, MakeIPAMIdent("lease2", 53, "udp"), time.Hour)
+		ipa.ReserveIP(IPClusterDefault, cidr, IPAMNoIdent, "100.69.0.100")
+		ipa.DeAllocateIP(IPClusterDefault, cidr, IPAMNoIdent, ip1.String())
+		ipa.AllocateDualStackIP(IPClusterDefault, cidr, cidr6, MakeIPAMIdent("dual1", 443, "tcp"))
+		clIP, _, _ := ipa.AllocateIPFromCluster("cl1", false, "svc3")
+		ipa.AllocateIPFromCluster("cl1", false, "svc4")
+		ipa.DeAllocateIPFromCluster("cl1", "svc3", clIP.String())
+
+		tx := ipa.NewTxn()
+		tx.AllocateNewIP(IPClusterDefault, cidr6, "svc5")
+		tx.ReserveIP(IPClusterDefault, cidr6, IPAMNoIdent, "6ffe::80")
+		tx.Commit()
+
+		// Failed mutations are journaled, but not replayed
+		if err := ipa.DeAllocateIP(IPClusterDefault, cidr, "svc9", "100.69.0.9"); err == nil {
+			t.Fatalf("IP dealloc passed unexpectedly")
+		}
+
+		now = now.Add(2 * time.Minute)
+		if expired := ipa.ReclaimExpiredIPs(); len(expired) != 1 {
+			t.Fatalf("IP lease reclaim mismatch:%v", expired)
+		}
+		ipa.ResizeIPRange("cl1", "100.70.0.0/28", "100.70.0.0/27")
+
+		ents, err := journal.Entries()
+		if err != nil {
+			t.Fatalf("Failed to get IPAM journal entries:%s", err)
+		}
+		if len(ents) != 22 {
+			t.Fatalf("IPAM journal entry count mismatch:%d", len(ents))
+		}
+		if ents[5].Op != IPAMJournalAllocate || ents[5].IP != ip1.String() || ents[5].Result != IPAMJournalResultOK {
+			t.Fatalf("IPAM journal allocate entry mismatch:%v", ents[5])
+		}
+		if ents[19].Op != IPAMJournalRelease || ents[19].Result == IPAMJournalResultOK {
+			t.Fatalf("IPAM journal failed entry mismatch:%v", ents[19])
+		}
+		if ents[20].Op != IPAMJournalLeaseExpire || ents[20].Ident != MakeIPAMIdent("lease1", 53, "udp") || !ents[20].Time.Equal(now) {
+			t.Fatalf("IPAM journal lease expire entry mismatch:%v", ents[20])
+		}
+
+		ipa1, err := IpAllocatorFromJournal(journal)
+		if err != nil {
+			t.Fatalf("Failed to replay IPAM journal:%s", err)
+		}
+		if !reflect.DeepEqual(ipa.GetState(), ipa1.GetState()) {
+			t.Fatalf("IPAM state mismatch after journal replay")
+		}
+		for i := 0; i < 3; i++ {
+			ip, _, _ := ipa.AllocateIPFromCluster("cl1", false, IPAMNoIdent)
+			rIP, _, _ := ipa1.AllocateIPFromCluster("cl1", false, IPAMNoIdent)
+			if !ip.Equal(rIP) {
+				t.Fatalf("IP alloc order mismatch after journal replay:%s:%s", ip.String(), rIP.String())
+			}
+		}
+	}
+
+	// Allocations from a new cluster create it on replay as they did when applied
+	ipa := IpAllocatorNew()
+	journal := IPAMRingJournalNew(100)
+	ipa.SetIPAMJournal(journal)
+	newIP, err := ipa.AllocateNewIP("newpool", "10.9.0.0/24", "svc1")
+	if err != nil {
+		t.Fatalf("IP alloc from new cluster failed:%s", err)
+	}
+	ipa1, err := IpAllocatorFromJournal(journal)
+	if err != nil {
+		t.Fatalf("Failed to replay IPAM journal with new cluster:%s", err)
+	}
+	if !reflect.DeepEqual(ipa.GetState(), ipa1.GetState()) {
+		t.Fatalf("IPAM state mismatch after journal replay with new cluster")
+	}
+	if info, cidr, err := ipa1.LookupIP("newpool", newIP.String()); err != nil || cidr != "10.9.0.0/24" || info.Idents["svc1"] != 1 {
+		t.Fatalf("IP alloc from new cluster not replayed:%v:%v", info, err)
+	}
+
+	// Hooks can call back into the allocator, as they are only called once the
+	// journal lock was released
+	ipa = IpAllocatorNew()
+	ipa.SetClock(func() time.Time { return now })
+	journal = IPAMRingJournalNew(100)
+	ipa.SetIPAMJournal(journal)
+	ipa.AddIPRange(IPClusterDefault, "100.72.0.0/24")
+	ipa.SetIPAMEventHook(func(ev IPAMEvent) {
+		if ev.Type == IPAMEventAllocate && ev.Ident == "svc1" {
+			if err := ipa.ReserveIP(IPClusterDefault, "100.72.0.0/24", IPAMNoIdent, "100.72.0.200"); err != nil {
+				t.Errorf("IP reserve from IPAM event hook failed:%s", err)
+			}
+		}
+	})
+	ipa.SetIPLeaseExpiryHook(func(lease IPAMLease) {
+		if _, err := ipa.AllocateNewIP(IPClusterDefault, "100.72.0.0/24", "svc2"); err != nil {
+			t.Errorf("IP alloc from IPAM lease hook failed:%s", err)
+		}
+	})
+	runWithTimeout(t, "IPAM journal hooks", func() {
+		ipa.AllocateNewIP(IPClusterDefault, "100.72.0.0/24", "svc1")
+		ipa.AllocateNewIPWithLease(IPClusterDefault, "100.72.0.0/24", "lease1", time.Minute)
+		now = now.Add(2 * time.Minute)
+		ipa.ReclaimExpiredIPs()
+	})
+	ents, _ := journal.Entries()
+	ops := make([]IPAMJournalOp, 0, len(ents))
+	for _, ent := range ents {
+		ops = append(ops, ent.Op)
+	}
+	if !reflect.DeepEqual(ops, []IPAMJournalOp{IPAMJournalRangeAdd, IPAMJournalAllocate, IPAMJournalReserve,
+		IPAMJournalAllocate, IPAMJournalLeaseExpire, IPAMJournalAllocate}) {
+		t.Fatalf("IPAM journal of hook mutations mismatch:%v", ops)
+	}
+
+	// A mutation which can't be journaled fails and so do the ones after it, till
+	// a journal is set again
+	fj.Close()
+	ipa = IpAllocatorNew()
+	ipa.SetIPAMJournal(fj)
+	if err := ipa.AddIPRange(IPClusterDefault, "100.73.0.0/24"); !errors.Is(err, ErrIPAMJournal) {
+		t.Fatalf("IP range add passed without journal:%v", err)
+	}
+	if _, err := ipa.AllocateNewIP(IPClusterDefault, "100.73.0.0/24", "svc1"); !errors.Is(err, ErrIPAMJournal) {
+		t.Fatalf("IP alloc passed after journal failure:%v", err)
+	}
+	if info, err := ipa.GetIPRangeInfo(IPClusterDefault, "100.73.0.0/24"); err != nil || info.Used != 0 {
+		t.Fatalf("IP alloc applied after journal failure:%v:%v", info, err)
+	}
+	journal = IPAMRingJournalNew(100)
+	ipa.SetIPAMJournal(journal)
+	if _, err := ipa.AllocateNewIP(IPClusterDefault, "100.73.0.0/24", "svc1"); err != nil {
+		t.Fatalf("IP alloc failed after journal reset:%s", err)
+	}
+	if ents, _ := journal.Entries(); len(ents) != 1 || ents[0].Op != IPAMJournalAllocate || ents[0].Result != IPAMJournalResultOK {
+		t.Fatalf("IPAM journal after reset mismatch:%v", ents)
+	}
+
+	ring := IPAMRingJournalNew(2)
+	for i := 0; i < 3; i++ {
+		ring.Append(IPAMJournalEntry{Op: IPAMJournalRangeAdd, Range: fmt.Sprintf("100.71.%d.0/24", i)})
+	}
+	ents, _ = ring.Entries()
+	if ring.Dropped() != 1 || len(ents) != 2 || ents[0].Range != "100.71.1.0/24" {
+		t.Fatalf("IPAM ring journal mismatch:%d:%v", ring.Dropped(), ents)
+	}
+}
+
+func TestIPAllocNetip(t *testing.T) {
+	for s, want := range map[string]string{
+		"100.70.0.0/24":                "100.70.0.0/24",
+		"100.70.0.10/24":               "100.70.0.10/24",
+		"2001:DB8::/120":               "2001:db8::/120",
+		"100.70.1.1-100.70.1.9":        "100.70.1.1-100.70.1.9",
+		"2001:db8:0::1-2001:db8::00ff": "2001:db8::1-2001:db8::ff",
+	} {
+		r, err := ParseIPAMRange(s)
+		if err != nil || r.String() != want {
+			t.Fatalf("IPAM range %s parsed as %s:%v", s, r.String(), err)
+		}
+	}
+	for _, s := range []string{"", "100.70.0.0", "100.70.0.0/33", "1.1.1.1-2.2.2.2-3.3.3.3", "1.1.1.1-2001:db8::1", "fe80::1%eth0-fe80::9"} {
+		if _, err := ParseIPAMRange(s); !errors.Is(err, ErrIPAMInvalidInput) {
+			t.Fatalf("Invalid IPAM range %s parsed:%v", s, err)
+		}
+	}
+
+	r, _ := ParseIPAMRange("100.70.0.10/24")
+	if r.Start() != netip.MustParseAddr("100.70.0.0") || r.End() != netip.MustParseAddr("100.70.0.255") {
+		t.Fatalf("IPAM range %s bounds %s-%s wrong", r, r.Start(), r.End())
+	}
+	if !r.Contains(netip.MustParseAddr("100.70.0.200")) || r.Contains(netip.MustParseAddr("100.70.1.0")) {
+		t.Fatalf("IPAM range %s contains check failed", r)
+	}
+	if !r.Contains(netip.MustParseAddr("::ffff:100.70.0.200")) {
+		t.Fatalf("IPAM range %s contains check failed for IPv4-mapped address", r)
+	}
+	r = IPAMPrefixRange(netip.MustParsePrefix("::ffff:100.70.0.0/120"))
+	if !r.Contains(netip.MustParseAddr("100.70.0.200")) || r.Contains(netip.MustParseAddr("100.70.1.0")) {
+		t.Fatalf("IPAM range %s contains check failed for IPv4 address", r)
+	}
+
+	ipa := IpAllocatorNew()
+	r = IPAMPrefixRange(netip.MustParsePrefix("2001:db8::/120"))
+	if err := ipa.AddRange(IPClusterDefault, r); err != nil {
+		t.Fatalf("Failed to add netip range:%s", err)
+	}
+	addr, err := ipa.AllocateAddr(IPClusterDefault, r, IPAMNoIdent)
+	if err != nil || addr != netip.MustParseAddr("2001:db8::1") {
+		t.Fatalf("netip alloc got %s:%v", addr, err)
+	}
+
+	// The string API finds the same range whatever its spelling
+	ip, err := ipa.AllocateNewIP(IPClusterDefault, "2001:DB8:0::/120", IPAMNoIdent)
+	if err != nil || ip.String() != "2001:db8::2" {
+		t.Fatalf("String alloc from netip range got %s:%v", ip, err)
+	}
+	if err := ipa.DeAllocateAddr(IPClusterDefault, r, IPAMNoIdent, netip.MustParseAddr("2001:db8::2")); err != nil {
+		t.Fatalf("netip dealloc failed:%s", err)
+	}
+	if err := ipa.DeAllocateIP(IPClusterDefault, "2001:0db8::/120", IPAMNoIdent, "2001:db8::1"); err != nil {
+		t.Fatalf("String dealloc from netip range failed:%s", err)
+	}
+
+	// IPv4 addresses come back in their 4-byte form, also from "a-b" ranges
+	r4 := IPAMAddrRange(netip.MustParseAddr("100.70.1.1"), netip.MustParseAddr("100.70.1.9"))
+	if err := ipa.AddIPRange(IPClusterDefault, r4.String()); err != nil {
+		t.Fatalf("Failed to add IPAM range %s:%s", r4, err)
+	}
+	if err := ipa.ReserveAddr(IPClusterDefault, r4, "r4", netip.MustParseAddr("100.70.1.5")); err != nil {
+		t.Fatalf("netip reserve failed:%s", err)
+	}
+	addr, ar, err := ipa.AllocateAddrFromCluster(IPClusterDefault, false, IPAMNoIdent)
+	if err != nil || !addr.Is4() || ar != r4 || !r4.Contains(addr) {
+		t.Fatalf("netip cluster alloc got %s from %s:%v", addr, ar, err)
+	}
+	if err := ipa.DeAllocateAddrFromCluster(IPClusterDefault, IPAMNoIdent, addr); err != nil {
+		t.Fatalf("netip cluster dealloc failed:%s", err)
+	}
+
+	if _, err := ipa.AllocateAddr(IPClusterDefault, IPAMRange{}, IPAMNoIdent); !errors.Is(err, ErrIPAMInvalidInput) {
+		t.Fatalf("Alloc from zero IPAM range:%v", err)
+	}
+
+	// Every string API journals the canonical range and exclusion
+	journal := IPAMRingJournalNew(10)
+	ipa.SetIPAMJournal(journal)
+	ipa.SetIPRangePriority(IPClusterDefault, "2001:DB8:0::/120", 1)
+	ipa.AddIPRangeExclusion(IPClusterDefault, "2001:0db8::/120", "gw", "2001:DB8::10")
+	ipa.SetIPAMJournal(nil)
+	ents, _ := journal.Entries()
+	if len(ents) != 2 || ents[0].Range != "2001:db8::/120" || ents[1].Range != "2001:db8::/120" {
+		t.Fatalf("IPAM journal of range spellings mismatch:%v", ents)
+	}
+	if excls, _ := ipa.ListIPRangeExclusions(IPClusterDefault, "2001:db8::/120"); len(excls["gw"]) != 1 || excls["gw"][0] != "2001:db8::10" {
+		t.Fatalf("IPAM exclusion spelling mismatch:%v", excls)
+	}
+	if _, err := ipa.GetIPRangeInfo(IPClusterDefault, "2001:db8::/129"); !errors.Is(err, ErrIPAMInvalidInput) {
+		t.Fatalf("Range info of invalid range:%v", err)
+	}
+	if err := ipa.DeleteRange(IPClusterDefault, r4); !errors.Is(err, ErrIPAMRangeInUse) {
+		t.Fatalf("Delete of netip range in use:%v", err)
+	}
+	if err := ipa.DeleteIPRange(IPClusterDefault, "2001:db8::0/120"); err != nil {
+		t.Fatalf("Delete of netip range failed:%s", err)
+	}
+}
+
+func TestIDPool(t *testing.T) {
+	idm := IDPoolManagerNew()
+	if err := idm.AddIDPool("vni", 100, 4); err != nil {
+		t.Fatalf("Failed to add ID pool:%s", err)
+	}
+	if err := idm.AddIDPool("vni", 1, 10); !errors.Is(err, ErrIDPoolExists) {
+		t.Fatalf("Duplicate ID pool added:%v", err)
+	}
+	if err := idm.AddIDPool("vlan", ^uint64(0), 2); !errors.Is(err, ErrIDPoolInvalidInput) {
+		t.Fatalf("Wrapping ID pool added:%v", err)
+	}
+	idm.AddIDPool("vlan", 1, 4094)
+
+	// An ident holds one ID, and reserving it again takes another reference
+	id1, err := idm.AllocateID("vni", "tenant1")
+	if err != nil || id1 != 100 {
+		t.Fatalf("ID alloc got %d:%v", id1, err)
+	}
+	if _, err := idm.AllocateID("vni", "tenant1"); !errors.Is(err, ErrIDPoolIdentExists) {
+		t.Fatalf("Second ID allocated for ident:%v", err)
+	}
+	if err := idm.ReserveID("vni", "tenant1", id1); err != nil {
+		t.Fatalf("ID of ident not shared:%s", err)
+	}
+	if id, refs, err := idm.LookupIdent("vni", "tenant1"); err != nil || id != id1 || refs != 2 {
+		t.Fatalf("ID ident lookup got %d/%d:%v", id, refs, err)
+	}
+
+	// Allocations without an ident get IDs of their own
+	id2, _ := idm.AllocateID("vni", IDPoolNoIdent)
+	id3, _ := idm.AllocateID("vni", IDPoolNoIdent)
+	if id2 == id3 || id2 == id1 {
+		t.Fatalf("Anonymous IDs shared:%d %d", id2, id3)
+	}
+
+	if err := idm.ReserveID("vni", "tenant2", id3); !errors.Is(err, ErrIDPoolIDInUse) {
+		t.Fatalf("ID in use reserved:%v", err)
+	}
+	if err := idm.ReserveID("vni", "tenant2", 104); !errors.Is(err, ErrIDPoolOutOfBounds) {
+		t.Fatalf("ID out of bounds reserved:%v", err)
+	}
+	if err := idm.ReserveID("vni", "tenant2", 103); err != nil {
+		t.Fatalf("ID reserve failed:%s", err)
+	}
+	if err := idm.ReserveID("vni", "tenant2", 102); !errors.Is(err, ErrIDPoolIdentExists) {
+		t.Fatalf("Second ID reserved for ident:%v", err)
+	}
+	if _, err := idm.AllocateID("vni", "tenant3"); !errors.Is(err, ErrIDPoolExhausted) {
+		t.Fatalf("ID alloc from exhausted pool:%v", err)
+	}
+
+	ids, _ := idm.ListIDs("vni")
+	if len(ids) != 4 || ids[0].ID != 100 || ids[0].Idents["tenant1"] != 2 || ids[3].Idents["tenant2"] != 1 {
+		t.Fatalf("ID list wrong:%v", ids)
+	}
+
+	if err := idm.ReleaseID("vni", "tenant2", id1); !errors.Is(err, ErrIDPoolIdentNotFound) {
+		t.Fatalf("ID released by other ident:%v", err)
+	}
+	if err := idm.DeleteIDPool("vni"); !errors.Is(err, ErrIDPoolInUse) {
+		t.Fatalf("ID pool in use deleted:%v", err)
+	}
+
+	// The ID of an ident is only returned with its last reference
+	idm.ReleaseID("vni", "tenant1", id1)
+	if info, _ := idm.GetIDPoolInfo("vni"); info.Used != 4 {
+		t.Fatalf("ID returned with references left:%v", info)
+	}
+	idm.ReleaseID("vni", "tenant1", id1)
+	if info, _ := idm.GetIDPoolInfo("vni"); info.Used != 3 || info.Free != 1 {
+		t.Fatalf("ID not returned:%v", info)
+	}
+	if err := idm.ReleaseID("vni", "tenant1", id1); !errors.Is(err, ErrIDPoolIDNotAlloc) {
+		t.Fatalf("ID released twice:%v", err)
+	}
+	if _, _, err := idm.LookupIdent("vni", "tenant1"); !errors.Is(err, ErrIDPoolIdentNotFound) {
+		t.Fatalf("Released ident found:%v", err)
+	}
+
+	for _, id := range []uint64{id2, id3} {
+		if err := idm.ReleaseID("vni", IDPoolNoIdent, id); err != nil {
+			t.Fatalf("Anonymous ID release failed:%s", err)
+		}
+	}
+	idm.ReleaseID("vni", "tenant2", 103)
+	if err := idm.DeleteIDPool("vni"); err != nil {
+		t.Fatalf("ID pool delete failed:%s", err)
+	}
+	if _, err := idm.AllocateID("vni", "tenant1"); !errors.Is(err, ErrIDPoolNotFound) {
+		t.Fatalf("ID alloc from deleted pool:%v", err)
+	}
+	if infos := idm.ListIDPools(); len(infos) != 1 || infos[0].Name != "vlan" || infos[0].Size != 4094 {
+		t.Fatalf("ID pool list wrong:%v", infos)
+	}
+}
+
+func TestPortAlloc(t *testing.T) {
+	if _, err := PortAllocatorNew(2000, 1000, 16); !errors.Is(err, ErrPortAllocInvalidInput) {
+		t.Fatalf("Port allocator with invalid range created:%v", err)
+	}
+
+	// Blocks 1004-1007 and 1008-1009 are only handed out port by port, as one is
+	// partly reserved and the other is short
+	pa, err := PortAllocatorNew(1000, 1009, 4, PortRange{Start: 1004, End: 1004})
+	if err != nil {
+		t.Fatalf("Failed to create port allocator:%s", err)
+	}
+	ip := netip.MustParseAddr("100.72.0.1")
+
+	blk, err := pa.AllocatePortBlock(ip, "tcp", "ep1")
+	if err != nil || blk != (PortRange{Start: 1000, End: 1003}) {
+		t.Fatalf("Port block alloc got %v:%v", blk, err)
+	}
+	if _, err := pa.AllocatePortBlock(ip, "tcp", "ep2"); !errors.Is(err, ErrPortAllocExhausted) {
+		t.Fatalf("Port block alloc from exhausted pool:%v", err)
+	}
+	if blk, err := pa.AllocatePortBlock(ip, "udp", "ep2"); err != nil || blk.Start != 1000 {
+		t.Fatalf("Port block alloc for other protocol got %v:%v", blk, err)
+	}
+
+	for _, want := range []uint16{1005, 1006, 1007, 1008, 1009} {
+		if port, err := pa.AllocatePort(ip, "tcp", "ep2"); err != nil || port != want {
+			t.Fatalf("Port alloc got %d:%v want %d", port, err, want)
+		}
+	}
+	if _, err := pa.AllocatePort(ip, "tcp", "ep2"); !errors.Is(err, ErrPortAllocExhausted) {
+		t.Fatalf("Port alloc from exhausted pool:%v", err)
+	}
+	if err := pa.ReservePort(ip, "tcp", "ep3", 1004); !errors.Is(err, ErrPortAllocReserved) {
+		t.Fatalf("Reserved port handed out:%v", err)
+	}
+	if err := pa.ReservePort(ip, "tcp", "ep3", 1001); !errors.Is(err, ErrPortAllocInUse) {
+		t.Fatalf("Port of a block handed out:%v", err)
+	}
+	if err := pa.ReleasePort(ip, "tcp", "ep1", 1005); !errors.Is(err, ErrPortAllocNotAllocated) {
+		t.Fatalf("Port released by other owner:%v", err)
+	}
+
+	if info := pa.GetPortOwnerInfo("ep2"); info.Blocks != 1 || info.Ports != 5 {
+		t.Fatalf("Port owner info wrong:%v", info)
+	}
+	if info := pa.GetPortUsage(ip, "tcp"); info.Blocks != 1 || info.Ports != 5 || info.FreeBlocks != 0 {
+		t.Fatalf("Port usage wrong:%v", info)
+	}
+
+	// A released block can be split into single ports
+	if err := pa.ReleasePortBlock(ip, "tcp", "ep1", blk); err != nil {
+		t.Fatalf("Port block release failed:%s", err)
+	}
+	if err := pa.ReservePort(ip, "tcp", "ep3", 1002); err != nil {
+		t.Fatalf("Port reserve failed:%s", err)
+	}
+	if _, err := pa.AllocatePortBlock(ip, "tcp", "ep1"); !errors.Is(err, ErrPortAllocExhausted) {
+		t.Fatalf("Port block with a port in use handed out:%v", err)
+	}
+	pa.ReleasePort(ip, "tcp", "ep3", 1002)
+
+	if err := pa.ReleaseOwner("ep2"); err != nil {
+		t.Fatalf("Port owner release failed:%s", err)
+	}
+	if info := pa.GetPortOwnerInfo("ep2"); info.Blocks != 0 || info.Ports != 0 {
+		t.Fatalf("Ports of released owner left:%v", info)
+	}
+	if info := pa.GetPortUsage(ip, "tcp"); info.Ports != 0 || info.FreeBlocks != 1 {
+		t.Fatalf("Port usage after owner release wrong:%v", info)
+	}
+
+	// SNAT IP addresses come from an IP allocator cluster and are returned once drained
+	ipa := IpAllocatorNew()
+	ipa.AddIPRange("snat", "100.72.1.1-100.72.1.2")
+	pa, _ = PortAllocatorNew(PortAllocFirst, PortAllocLast, PortAllocBlockSize, PortRange{Start: 8080, End: 8080})
+	if _, _, err := pa.AllocateSNATPortBlock(false, "tcp", "ep1"); !errors.Is(err, ErrPortAllocNoSNATPool) {
+		t.Fatalf("SNAT port block alloc without cluster:%v", err)
+	}
+	pa.SetSNATCluster(ipa, "snat")
+
+	seen := make(map[netip.Addr]int)
+	for i := 0; i < 124; i++ {
+		sip, _, err := pa.AllocateSNATPortBlock(false, "tcp", fmt.Sprintf("ep%d", i))
+		if err != nil {
+			t.Fatalf("SNAT port block alloc %d failed:%s", i, err)
+		}
+		seen[sip]++
+	}
+	if len(seen) != 2 || seen[netip.MustParseAddr("100.72.1.1")] != 62 {
+		t.Fatalf("SNAT port blocks spread wrong:%v", seen)
+	}
+	if _, _, err := pa.AllocateSNATPortBlock(false, "tcp", "ep124"); !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("SNAT port block alloc with exhausted cluster:%v", err)
+	}
+	sip, port, err := pa.AllocateSNATPort(false, "tcp", "ep0")
+	if err != nil || sip != netip.MustParseAddr("100.72.1.1") || port != 7168 {
+		t.Fatalf("SNAT port alloc got %s:%d:%v", sip, port, err)
+	}
+
+	for i := 62; i < 124; i++ {
+		pa.ReleaseOwner(fmt.Sprintf("ep%d", i))
+	}
+	if ri, _ := ipa.GetIPRangeInfo("snat", "100.72.1.1-100.72.1.2"); ri.Used != 1 {
+		t.Fatalf("Drained SNAT IP not returned:%v", ri)
+	}
+
+	// All ports of an owner are released even if returning the SNAT IP fails
+	ipa.DeAllocateIP("snat", "100.72.1.1-100.72.1.2", IPAMNoIdent, "100.72.1.1")
+	for i := 1; i < 62; i++ {
+		pa.ReleaseOwner(fmt.Sprintf("ep%d", i))
+	}
+	err = pa.ReleaseOwner("ep0")
+	if !errors.Is(err, ErrIPAMIdentNotFound) {
+		t.Fatalf("SNAT IP release error dropped:%v", err)
+	}
+	if info := pa.GetPortOwnerInfo("ep0"); info.Blocks != 0 || info.Ports != 0 {
+		t.Fatalf("Ports left to owner after release:%v", info)
+	}
+}
+
+func TestPrefixAlloc(t *testing.T) {
+	pa, err := PrefixAllocatorNew("10.10.0.0/20")
+	if err != nil {
+		t.Fatalf("Failed to create prefix allocator for 10.10.0.0/20:%s", err)
+	}
+
+	var pfxs []string
+	for i := 0; i < 256; i++ {
+		pfx, err := pa.AllocatePrefix(28)
+		if err != nil {
+			t.Fatalf("Prefix Alloc failed for /28:%d:%s", i, err)
+		}
+		expected := fmt.Sprintf("10.10.%d.%d/28", i/16, (i%16)*16)
+		if pfx.String() != expected {
+			t.Fatalf("Prefix Alloc got %s expected %s", pfx.String(), expected)
+		}
+		pfxs = append(pfxs, pfx.String())
+	}
+
+	_, err = pa.AllocatePrefix(28)
+	if !errors.Is(err, ErrPfxExhausted) {
+		t.Fatalf("Prefix Alloc unexpected result for exhausted 10.10.0.0/20:%v", err)
+	}
+
+	if len(pa.ListFreePrefixes()) != 0 || len(pa.ListAllocatedPrefixes()) != 256 {
+		t.Fatalf("Prefix lists mismatch %v", pa.ListFreePrefixes())
+	}
+
+	for _, pfx := range pfxs {
+		err = pa.FreePrefix(pfx)
+		if err != nil {
+			t.Fatalf("Prefix Free failed for %s:%s", pfx, err)
+		}
+	}
+
+	free := pa.ListFreePrefixes()
+	if len(free) != 1 || free[0] != "10.10.0.0/20" {
+		t.Fatalf("Prefix blocks not merged %v", free)
+	}
+
+	err = pa.FreePrefix("10.10.0.0/28")
+	if !errors.Is(err, ErrPfxNotAllocated) {
+		t.Fatalf("Prefix Free unexpected result for 10.10.0.0/28:%v", err)
+	}
+
+	err = pa.ReservePrefix("10.10.4.0/24")
+	if err != nil {
+		t.Fatalf("Prefix Reserve failed for 10.10.4.0/24:%s", err)
+	}
+
+	err = pa.ReservePrefix("10.10.4.16/28")
+	if !errors.Is(err, ErrPfxInUse) {
+		t.Fatalf("Prefix Reserve unexpected result for 10.10.4.16/28:%v", err)
+	}
+
+	err = pa.ReservePrefix("10.10.4.1/28")
+	if !errors.Is(err, ErrPfxNotAligned) {
+		t.Fatalf("Prefix Reserve unexpected result for unaligned 10.10.4.1/28:%v", err)
+	}
+
+	err = pa.ReservePrefix("10.11.0.0/24")
+	if !errors.Is(err, ErrPfxOutOfBounds) || err.Error() != "prefix out of bounds (block 10.10.0.0/20, prefix 10.11.0.0/24)" {
+		t.Fatalf("Prefix Reserve unexpected result for 10.11.0.0/24:%v", err)
+	}
+
+	free = pa.ListFreePrefixes()
+	expectedFree := []string{"10.10.0.0/22", "10.10.5.0/24", "10.10.6.0/23", "10.10.8.0/21"}
+	if fmt.Sprint(free) != fmt.Sprint(expectedFree) {
+		t.Fatalf("Prefix free list got %v expected %v", free, expectedFree)
+	}
+
+	pfx, err := pa.AllocatePrefix(24)
+	if err != nil || pfx.String() != "10.10.5.0/24" {
+		t.Fatalf("Prefix Alloc for /24 got %v:%v", pfx, err)
+	}
+
+	pfx, err = pa.AllocatePrefix(21)
+	if err != nil || pfx.String() != "10.10.8.0/21" {
+		t.Fatalf("Prefix Alloc for /21 got %v:%v", pfx, err)
+	}
+
+	_, err = pa.AllocatePrefix(21)
+	if err == nil {
+		t.Fatalf("Prefix Alloc unexpected success for /21")
+	}
+
+	_, err = pa.AllocatePrefix(19)
+	if err == nil {
+		t.Fatalf("Prefix Alloc unexpected success for /19")
+	}
+
+	pa6, err := PrefixAllocatorNew("2001:db8::/48")
+	if err != nil {
+		t.Fatalf("Failed to create prefix allocator for 2001:db8::/48:%s", err)
+	}
+
+	pfx, err = pa6.AllocatePrefix(64)
+	if err != nil || pfx.String() != "2001:db8::/64" {
+		t.Fatalf("Prefix Alloc for /64 got %v:%v", pfx, err)
+	}
+
+	pfx, err = pa6.AllocatePrefix(64)
+	if err != nil || pfx.String() != "2001:db8:0:1::/64" {
+		t.Fatalf("Prefix Alloc for /64 got %v:%v", pfx, err)
+	}
+
+	pfx, err = pa6.AllocatePrefix(56)
+	if err != nil || pfx.String() != "2001:db8:0:100::/56" {
+		t.Fatalf("Prefix Alloc for /56 got %v:%v", pfx, err)
+	}
+
+	pa6.FreePrefix("2001:db8::/64")
+	pa6.FreePrefix("2001:db8:0:1::/64")
+	pa6.FreePrefix("2001:db8:0:100::/56")
+
+	free = pa6.ListFreePrefixes()
+	if len(free) != 1 || free[0] != "2001:db8::/48" {
+		t.Fatalf("Prefix blocks not merged %v", free)
+	}
+}
+
+func TestIPAllocLease(t *testing.T) {
+	ipa := IpAllocatorNew()
+	cidr := "80.80.80.1-80.80.80.4"
+	proto := "tcp"
+
+	now := time.Unix(1000, 0)
+	ipa.SetClock(func() time.Time { return now })
+
+	var reclaimed []IPAMLease
+	ipa.SetIPLeaseExpiryHook(func(lease IPAMLease) {
+		reclaimed = append(reclaimed, lease)
+	})
+
+	ipa.AddIPRange(IPClusterDefault, cidr)
+
+	ip1, err := ipa.AllocateNewIPWithLease(IPClusterDefault, cidr, IPAMNoIdent, 10*time.Second)
+	if err != nil || ip1.String() != "80.80.80.1" {
+		t.Fatalf("IP lease alloc failed for %s:%s:%v", cidr, ip1.String(), err)
+	}
+
+	ip2, err := ipa.AllocateNewIPWithLease(IPClusterDefault, cidr, MakeIPAMIdent("svc1", 80, proto), 20*time.Second)
+	if err != nil || !ip2.Equal(ip1) {
+		t.Fatalf("IP lease alloc failed for svc1:%s:%v", ip2.String(), err)
+	}
+
+	ip3, err := ipa.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+	if err != nil || ip3.String() != "80.80.80.2" {
+		t.Fatalf("IP alloc failed for %s:%s:%v", cidr, ip3.String(), err)
+	}
+
+	_, err = ipa.AllocateNewIPWithLease(IPClusterDefault, cidr, IPAMNoIdent, 0)
+	if err == nil {
+		t.Fatalf("IP lease alloc succeeded with zero ttl")
+	}
+
+	err = ipa.RenewIPLease(IPClusterDefault, cidr, IPAMNoIdent, ip3.String(), time.Second)
+	if err == nil {
+		t.Fatalf("IP lease renewed for allocation without lease")
+	}
+
+	now = now.Add(5 * time.Second)
+	err = ipa.RenewIPLease(IPClusterDefault, cidr, IPAMNoIdent, ip1.String(), 30*time.Second)
+	if err != nil {
+		t.Fatalf("IP lease renew failed for %s:%s", ip1.String(), err)
+	}
+
+	leases, err := ipa.ListIPLeases(IPClusterDefault, cidr)
+	if err != nil || len(leases) != 2 || !leases[0].Expiry.Equal(time.Unix(1035, 0)) {
+		t.Fatalf("IP lease list mismatch:%v:%v", leases, err)
+	}
+
+	// svc1 expires, but the shared IP address stays with the no-ident lease
+	now = now.Add(20 * time.Second)
+	expired := ipa.ReclaimExpiredIPs()
+	if len(expired) != 1 || expired[0].Ident != MakeIPAMIdent("svc1", 80, proto) || len(reclaimed) != 1 {
+		t.Fatalf("IP lease reclaim mismatch:%v", expired)
+	}
+
+	err = ipa.RenewIPLease(IPClusterDefault, cidr, MakeIPAMIdent("svc1", 80, proto), ip2.String(), time.Second)
+	if err == nil {
+		t.Fatalf("IP lease renewed after reclaim")
+	}
+
+	ip, err := ipa.AllocateNewIP(IPClusterDefault, cidr, MakeIPAMIdent("svc2", 80, proto))
+	if err != nil || !ip.Equal(ip1) {
+		t.Fatalf("IP alloc for svc2 did not share %s:%s:%v", ip1.String(), ip.String(), err)
+	}
+
+	data, err := ipa.ExportState()
+	if err != nil {
+		t.Fatalf("Failed to export IPAM state:%s", err)
+	}
+
+	ipa1, err := IpAllocatorImport(data)
+	if err != nil {
+		t.Fatalf("Failed to import IPAM state:%s", err)
+	}
+	ipa1.SetClock(func() time.Time { return now })
+
+	// Expired lease is not renewed, but reclaimed
+	now = now.Add(10 * time.Second)
+	err = ipa1.RenewIPLease(IPClusterDefault, cidr, IPAMNoIdent, ip1.String(), time.Second)
+	if err == nil {
+		t.Fatalf("Expired IP lease renewed")
+	}
+
+	for _, a := range []*IPAllocator{ipa, ipa1} {
+		expired = a.ReclaimExpiredIPs()
+		if len(expired) != 1 || !expired[0].IP.Equal(ip1) || expired[0].Ident != IPAMNoIdent {
+			t.Fatalf("IP lease reclaim mismatch:%v", expired)
+		}
+
+		err = a.DeAllocateIP(IPClusterDefault, cidr, MakeIPAMIdent("svc2", 80, proto), ip1.String())
+		if err != nil {
+			t.Fatalf("IP DeAlloc failed for svc2:%s", err)
+		}
+
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil || ip.String() != "80.80.80.3" {
+			t.Fatalf("IP alloc mismatch after reclaim:%s:%v", ip.String(), err)
+		}
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil || ip.String() != "80.80.80.4" {
+			t.Fatalf("IP alloc mismatch after reclaim:%s:%v", ip.String(), err)
+		}
+		ip, err = a.AllocateNewIP(IPClusterDefault, cidr, IPAMNoIdent)
+		if err != nil || !ip.Equal(ip1) {
+			t.Fatalf("Reclaimed IP not reused:%s:%v", ip.String(), err)
+		}
+	}
+
+	if len(reclaimed) != 2 {
+		t.Fatalf("IP lease expiry hook mismatch:%v", reclaimed)
+	}
+
+	ipa2 := IpAllocatorNew()
+	ipa2.AddIPRange(IPClusterDefault, cidr)
+	ipa2.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	gcDone := make(chan IPAMLease, 1)
+	ipa2.SetIPLeaseExpiryHook(func(lease IPAMLease) { gcDone <- lease })
+	ipa2.AllocateNewIPWithLease(IPClusterDefault, cidr, IPAMNoIdent, time.Second)
+	ipa2.SetClock(func() time.Time { return time.Unix(1001, 0) })
+
+	stop := ipa2.StartIPLeaseGC(time.Millisecond)
+	defer stop()
+	select {
+	case lease := <-gcDone:
+		if lease.IP.String() != "80.80.80.1" {
+			t.Fatalf("IP lease GC reclaimed %s", lease.IP.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("IP lease GC did not reclaim the lease")
+	}
+}
+
 func TestProber(t *testing.T) {
 	sOk := L4ServiceProber("sctp", "192.168.20.58:8080", "", "", "")
 	t.Logf("sctp prober test1 %v", sOk)
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -172,6 +173,65 @@ func ArpPing(DIP net.IP, SIP net.IP, ifName string) (int, error) {
 	return 0, nil
 }
 
+// ArpProbe - sends a arp request given the DIP, SIP and interface name and waits
+// till timeout for a reply from DIP. It returns true if a reply was received
+func ArpProbe(DIP net.IP, SIP net.IP, ifName string, timeout time.Duration) (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(Htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return false, errors.New("af-packet-err")
+	}
+	defer syscall.Close(fd)
+
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return false, errors.New("intf-err")
+	}
+
+	// Listen before sending the request so that no reply is missed
+	ll := syscall.SockaddrLinklayer{
+		Protocol: Htons(syscall.ETH_P_ARP),
+		Ifindex:  ifi.Index,
+	}
+	if err := syscall.Bind(fd, &ll); err != nil {
+		return false, errors.New("bind-err")
+	}
+
+	if _, err := ArpPing(DIP, SIP, ifName); err != nil {
+		return false, err
+	}
+
+	dip := DIP.To4()
+	buf := make([]byte, 128)
+	deadline := time.Now().Add(timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false, nil
+		}
+
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if tv.Sec == 0 && tv.Usec == 0 {
+			tv.Usec = 1
+		}
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, errors.New("sockopt-err")
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return false, errors.New("recv-err")
+		}
+
+		// OpCode reply with DIP as senderProtoAddr
+		if n >= 28 && binary.BigEndian.Uint16(buf[6:8]) == 2 && bytes.Equal(buf[14:18], dip) {
+			return true, nil
+		}
+	}
+}
+
 // NetGetIfiStats - Get OS statistics for a given interface
 func NetGetIfiStats(ifName string, ifs *IfiStat) int {
 	file, err := os.Open(OsIfStatFile)
@@ -0,0 +1,301 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Prefix allocator error kinds, which are the Kind of a PfxAllocError
+var (
+	ErrPfxInvalidInput = errors.New("pfxalloc invalid input")
+	ErrPfxOutOfBounds  = errors.New("pfxalloc prefix out of bounds")
+	ErrPfxNotAligned   = errors.New("pfxalloc prefix not aligned")
+	ErrPfxExhausted    = errors.New("pfxalloc pool exhausted")
+	ErrPfxInUse        = errors.New("pfxalloc prefix in use")
+	ErrPfxNotAllocated = errors.New("pfxalloc prefix not allocated")
+)
+
+// PfxAllocError - Error of the prefix allocator, which matches its ErrPfx Kind with errors.Is.
+// Prefix is the sub-prefix asked for, or just its length like "/28" for allocations
+type PfxAllocError struct {
+	Kind   error
+	Msg    string
+	Block  string
+	Prefix string
+}
+
+// Error - Get the error message along with the block and sub-prefix it is about
+func (e *PfxAllocError) Error() string {
+	return errContext(e.Msg, "block", e.Block, "prefix", e.Prefix)
+}
+
+// Unwrap - Get the ErrPfx kind of the error
+func (e *PfxAllocError) Unwrap() error {
+	return e.Kind
+}
+
+// u128 - A 128-bit unsigned integer used for prefix arithmetic
+type u128 struct {
+	hi uint64
+	lo uint64
+}
+
+// u128Ones - Get a u128 with the low n bits set
+func u128Ones(n int) u128 {
+	if n >= 128 {
+		return u128{^uint64(0), ^uint64(0)}
+	}
+	if n >= 64 {
+		return u128{(1 << (n - 64)) - 1, ^uint64(0)}
+	}
+	return u128{0, (1 << n) - 1}
+}
+
+func (a u128) or(b u128) u128 {
+	return u128{a.hi | b.hi, a.lo | b.lo}
+}
+
+func (a u128) andNot(b u128) u128 {
+	return u128{a.hi &^ b.hi, a.lo &^ b.lo}
+}
+
+func (a u128) less(b u128) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+// pfxBlock - A block of the prefix allocator
+type pfxBlock struct {
+	base   u128
+	pfxLen int
+}
+
+// PrefixAllocator - Hands out aligned sub-prefixes of a prefix block.
+// Free space is kept as buddy blocks, which are split on allocation and
+// merged back with their buddies when freed to keep fragmentation low
+type PrefixAllocator struct {
+	mtx    sync.Mutex
+	block  net.IPNet
+	ipLen  int
+	bits   int
+	pfxLen int
+	free   map[int]map[u128]struct{}
+	alloc  map[pfxBlock]struct{}
+}
+
+// PrefixAllocatorNew - Create a new prefix allocator for the given CIDR block
+func PrefixAllocatorNew(cidr string) (*PrefixAllocator, error) {
+	_, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, &PfxAllocError{Kind: ErrPfxInvalidInput, Msg: "invalid CIDR", Block: cidr}
+	}
+
+	pa := new(PrefixAllocator)
+	pa.block = *ipn
+	pa.ipLen = len(ipn.IP)
+	pa.pfxLen, pa.bits = ipn.Mask.Size()
+	pa.free = make(map[int]map[u128]struct{})
+	pa.alloc = make(map[pfxBlock]struct{})
+
+	hi, lo := ipToU128(ipn.IP)
+	pa.addFree(u128{hi, lo}, pa.pfxLen)
+
+	return pa, nil
+}
+
+// hostMask - Get the host bits of a prefix length
+func (pa *PrefixAllocator) hostMask(pfxLen int) u128 {
+	return u128Ones(pa.bits - pfxLen)
+}
+
+// buddy - Get the buddy block of a block
+func (pa *PrefixAllocator) buddy(base u128, pfxLen int) u128 {
+	bit := u128Ones(pa.bits - pfxLen + 1).andNot(pa.hostMask(pfxLen))
+	return u128{base.hi ^ bit.hi, base.lo ^ bit.lo}
+}
+
+func (pa *PrefixAllocator) addFree(base u128, pfxLen int) {
+	if pa.free[pfxLen] == nil {
+		pa.free[pfxLen] = make(map[u128]struct{})
+	}
+	pa.free[pfxLen][base] = struct{}{}
+}
+
+func (pa *PrefixAllocator) delFree(base u128, pfxLen int) {
+	delete(pa.free[pfxLen], base)
+	if len(pa.free[pfxLen]) == 0 {
+		delete(pa.free, pfxLen)
+	}
+}
+
+// split - Split a free block down to the given length, keeping the half
+// which holds target. The target block is removed from the free blocks
+func (pa *PrefixAllocator) split(base u128, pfxLen int, target u128, tLen int) {
+	pa.delFree(base, pfxLen)
+	for pfxLen < tLen {
+		pfxLen++
+		upper := base.or(u128Ones(pa.bits - pfxLen + 1).andNot(pa.hostMask(pfxLen)))
+		if target.less(upper) {
+			pa.addFree(upper, pfxLen)
+		} else {
+			pa.addFree(base, pfxLen)
+			base = upper
+		}
+	}
+}
+
+func (pa *PrefixAllocator) toIPNet(base u128, pfxLen int) *net.IPNet {
+	return &net.IPNet{
+		IP:   u128ToIP(base.hi, base.lo, pa.ipLen),
+		Mask: net.CIDRMask(pfxLen, pa.bits),
+	}
+}
+
+// parsePrefix - Parse a sub-prefix of the block
+func (pa *PrefixAllocator) parsePrefix(cidr string) (u128, int, error) {
+	ip, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return u128{}, 0, &PfxAllocError{Kind: ErrPfxInvalidInput, Msg: "invalid CIDR", Block: pa.block.String(), Prefix: cidr}
+	}
+
+	pfxLen, bits := ipn.Mask.Size()
+	if bits != pa.bits || pfxLen < pa.pfxLen || !pa.block.Contains(ip) {
+		return u128{}, 0, &PfxAllocError{Kind: ErrPfxOutOfBounds, Msg: "prefix out of bounds", Block: pa.block.String(), Prefix: cidr}
+	}
+
+	if !ip.Equal(ipn.IP) {
+		return u128{}, 0, &PfxAllocError{Kind: ErrPfxNotAligned, Msg: "prefix not aligned", Block: pa.block.String(), Prefix: cidr}
+	}
+
+	hi, lo := ipToU128(ipn.IP)
+	return u128{hi, lo}, pfxLen, nil
+}
+
+// AllocatePrefix - Allocate a free sub-prefix of the given length
+// The smallest free block which fits is split, so that larger blocks are kept intact
+func (pa *PrefixAllocator) AllocatePrefix(pfxLen int) (*net.IPNet, error) {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	if pfxLen < pa.pfxLen || pfxLen > pa.bits {
+		return nil, &PfxAllocError{Kind: ErrPfxInvalidInput, Msg: "invalid prefix length", Block: pa.block.String(), Prefix: "/" + strconv.Itoa(pfxLen)}
+	}
+
+	for l := pfxLen; l >= pa.pfxLen; l-- {
+		if len(pa.free[l]) == 0 {
+			continue
+		}
+
+		first := true
+		var base u128
+		for b := range pa.free[l] {
+			if first || b.less(base) {
+				base = b
+				first = false
+			}
+		}
+
+		pa.split(base, l, base, pfxLen)
+		pa.alloc[pfxBlock{base, pfxLen}] = struct{}{}
+		return pa.toIPNet(base, pfxLen), nil
+	}
+
+	return nil, &PfxAllocError{Kind: ErrPfxExhausted, Msg: "prefix pool exhausted", Block: pa.block.String(), Prefix: "/" + strconv.Itoa(pfxLen)}
+}
+
+// ReservePrefix - Reserve a specific sub-prefix so that it is not handed out
+func (pa *PrefixAllocator) ReservePrefix(cidr string) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	target, tLen, err := pa.parsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	for l := tLen; l >= pa.pfxLen; l-- {
+		base := target.andNot(pa.hostMask(l))
+		if _, ok := pa.free[l][base]; ok {
+			pa.split(base, l, target, tLen)
+			pa.alloc[pfxBlock{target, tLen}] = struct{}{}
+			return nil
+		}
+	}
+
+	return &PfxAllocError{Kind: ErrPfxInUse, Msg: "prefix in use", Block: pa.block.String(), Prefix: cidr}
+}
+
+// FreePrefix - Return an allocated or reserved sub-prefix
+func (pa *PrefixAllocator) FreePrefix(cidr string) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	base, pfxLen, err := pa.parsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := pa.alloc[pfxBlock{base, pfxLen}]; !ok {
+		return &PfxAllocError{Kind: ErrPfxNotAllocated, Msg: "prefix not allocated", Block: pa.block.String(), Prefix: cidr}
+	}
+	delete(pa.alloc, pfxBlock{base, pfxLen})
+
+	for pfxLen > pa.pfxLen {
+		buddy := pa.buddy(base, pfxLen)
+		if _, ok := pa.free[pfxLen][buddy]; !ok {
+			break
+		}
+		pa.delFree(buddy, pfxLen)
+		pfxLen--
+		base = base.andNot(pa.hostMask(pfxLen))
+	}
+	pa.addFree(base, pfxLen)
+
+	return nil
+}
+
+func (pa *PrefixAllocator) sortedPrefixes(blocks []pfxBlock) []string {
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].base != blocks[j].base {
+			return blocks[i].base.less(blocks[j].base)
+		}
+		return blocks[i].pfxLen < blocks[j].pfxLen
+	})
+
+	pfxs := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		pfxs = append(pfxs, pa.toIPNet(b.base, b.pfxLen).String())
+	}
+	return pfxs
+}
+
+// ListFreePrefixes - Get the free blocks of the allocator in address order
+func (pa *PrefixAllocator) ListFreePrefixes() []string {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	var blocks []pfxBlock
+	for l, bases := range pa.free {
+		for base := range bases {
+			blocks = append(blocks, pfxBlock{base, l})
+		}
+	}
+	return pa.sortedPrefixes(blocks)
+}
+
+// ListAllocatedPrefixes - Get the allocated and reserved sub-prefixes in address order
+func (pa *PrefixAllocator) ListAllocatedPrefixes() []string {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	blocks := make([]pfxBlock, 0, len(pa.alloc))
+	for b := range pa.alloc {
+		blocks = append(blocks, b)
+	}
+	return pa.sortedPrefixes(blocks)
+}
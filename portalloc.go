@@ -0,0 +1,595 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright (c) 2023 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Defaults of the SNAT port allocator
+const (
+	PortAllocFirst     = 1024
+	PortAllocLast      = 65535
+	PortAllocBlockSize = 1024
+)
+
+// Port allocator error kinds, which are the Kind of a PortAllocError
+var (
+	ErrPortAllocInvalidInput = errors.New("portalloc invalid input")
+	ErrPortAllocOutOfBounds  = errors.New("portalloc port out of bounds")
+	ErrPortAllocReserved     = errors.New("portalloc port reserved")
+	ErrPortAllocExhausted    = errors.New("portalloc ports exhausted")
+	ErrPortAllocInUse        = errors.New("portalloc port in use")
+	ErrPortAllocNotAllocated = errors.New("portalloc port not allocated")
+	ErrPortAllocNoSNATPool   = errors.New("portalloc no snat pool")
+)
+
+// PortAllocError - Error of the SNAT port allocator, which matches its ErrPortAlloc Kind
+// with errors.Is. IP and Proto select the port space, a zero Port means no port
+type PortAllocError struct {
+	Kind  error
+	Msg   string
+	IP    netip.Addr
+	Proto string
+	Owner string
+	Port  uint16
+}
+
+// Error - Get the error message along with the port space, port and owner it is about
+func (e *PortAllocError) Error() string {
+	ip, port := "", ""
+	if e.IP.IsValid() {
+		ip = e.IP.String()
+	}
+	if e.Port != 0 {
+		port = strconv.Itoa(int(e.Port))
+	}
+	return errContext(e.Msg, "ip", ip, "proto", e.Proto, "port", port, "owner", e.Owner)
+}
+
+// Unwrap - Get the ErrPortAlloc kind of the error
+func (e *PortAllocError) Unwrap() error {
+	return e.Kind
+}
+
+// PortRange - Inclusive range of L4 ports
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// contains - Check if a port is in the range
+func (pr PortRange) contains(port uint16) bool {
+	return port >= pr.Start && port <= pr.End
+}
+
+// PortOwnerInfo - Ports held by an owner over all IP addresses and protocols
+type PortOwnerInfo struct {
+	Owner  string
+	Blocks int
+	Ports  int
+}
+
+// PortUsageInfo - Port usage of an IP address and protocol
+// Blocks counts the blocks held by owners and Ports the single ports
+type PortUsageInfo struct {
+	IP         netip.Addr
+	Proto      string
+	Blocks     int
+	FreeBlocks uint64
+	Ports      int
+}
+
+// portKey - Key of the ports of an IP address and protocol
+type portKey struct {
+	ip    netip.Addr
+	proto string
+}
+
+// portBlock - Block handed out port by port. Fixed blocks can't be handed out as a
+// whole, because they are partly reserved or shorter than a block
+type portBlock struct {
+	ports *Counter
+	used  int
+	fixed bool
+}
+
+// portPool - Ports of an IP address and protocol, split into blocks
+type portPool struct {
+	blocks *Counter
+	owner  map[uint64]string
+	single map[uint64]*portBlock
+	ports  map[uint16]string
+}
+
+// portOwned - A block or a single port held by an owner
+type portOwned struct {
+	key   portKey
+	block bool
+	n     uint64
+}
+
+// PortAllocator - Allocator of L4 source ports for SNAT, keyed by IP address and protocol.
+// The port space of every key is split into blocks which are handed out to owners as
+// a whole, or port by port for single port allocations
+type PortAllocator struct {
+	mtx       sync.Mutex
+	first     uint16
+	last      uint16
+	blockSize uint16
+	reserved  []PortRange
+	pools     map[portKey]*portPool
+	owned     map[string]map[portOwned]struct{}
+	ipa       *IPAllocator
+	cluster   string
+	snat      map[netip.Addr]struct{}
+}
+
+// PortAllocatorNew - Create a new port allocator handing out ports from first to last
+// in blocks of blockSize ports. Reserved ports, like well-known ranges inside the port
+// space, are never handed out
+func PortAllocatorNew(first uint16, last uint16, blockSize uint16, reserved ...PortRange) (*PortAllocator, error) {
+	if first == 0 || last < first || blockSize == 0 {
+		return nil, &PortAllocError{Kind: ErrPortAllocInvalidInput, Msg: "invalid port range"}
+	}
+	for _, pr := range reserved {
+		if pr.End < pr.Start {
+			return nil, &PortAllocError{Kind: ErrPortAllocInvalidInput, Msg: "invalid reserved port range", Port: pr.Start}
+		}
+	}
+
+	pa := new(PortAllocator)
+	pa.first = first
+	pa.last = last
+	pa.blockSize = blockSize
+	pa.reserved = append([]PortRange(nil), reserved...)
+	pa.pools = make(map[portKey]*portPool)
+	pa.owned = make(map[string]map[portOwned]struct{})
+	pa.snat = make(map[netip.Addr]struct{})
+
+	return pa, nil
+}
+
+// numBlocks - Get the number of blocks of the port space
+func (pa *PortAllocator) numBlocks() uint64 {
+	n := uint64(pa.last) - uint64(pa.first) + 1
+	return (n + uint64(pa.blockSize) - 1) / uint64(pa.blockSize)
+}
+
+// blockRange - Get the ports of a block
+func (pa *PortAllocator) blockRange(b uint64) PortRange {
+	start := uint64(pa.first) + b*uint64(pa.blockSize)
+	end := start + uint64(pa.blockSize) - 1
+	if end > uint64(pa.last) {
+		end = uint64(pa.last)
+	}
+	return PortRange{Start: uint16(start), End: uint16(end)}
+}
+
+// isReserved - Check if a port is reserved
+func (pa *PortAllocator) isReserved(port uint16) bool {
+	for _, pr := range pa.reserved {
+		if pr.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPortPool - Create the ports of a key. Blocks which are partly reserved or short
+// are set aside for single ports. Caller must hold pa.mtx
+func (pa *PortAllocator) newPortPool() *portPool {
+	pp := new(portPool)
+	pp.blocks = NewCounter(0, pa.numBlocks())
+	pp.owner = make(map[uint64]string)
+	pp.single = make(map[uint64]*portBlock)
+	pp.ports = make(map[uint16]string)
+
+	for b := uint64(0); b < pa.numBlocks(); b++ {
+		br := pa.blockRange(b)
+		fixed := uint64(br.End)-uint64(br.Start)+1 < uint64(pa.blockSize)
+		for _, pr := range pa.reserved {
+			if pr.Start <= br.End && pr.End >= br.Start {
+				fixed = true
+			}
+		}
+		if !fixed {
+			continue
+		}
+		pp.blocks.ReserveCounter(b)
+		pb := pa.newPortBlock(b)
+		pb.fixed = true
+		for port := uint64(br.Start); port <= uint64(br.End); port++ {
+			if pa.isReserved(uint16(port)) {
+				pb.ports.ReserveCounter(port)
+			}
+		}
+		pp.single[b] = pb
+	}
+
+	return pp
+}
+
+// newPortBlock - Create a block to be handed out port by port
+func (pa *PortAllocator) newPortBlock(b uint64) *portBlock {
+	br := pa.blockRange(b)
+	return &portBlock{ports: NewCounter(uint64(br.Start), uint64(br.End)-uint64(br.Start)+1)}
+}
+
+// getPortPool - Get the ports of a key, creating them if needed. Caller must hold pa.mtx
+func (pa *PortAllocator) getPortPool(ip netip.Addr, proto string) (portKey, *portPool, error) {
+	if !ip.IsValid() || ip.Zone() != "" || proto == "" {
+		return portKey{}, nil, &PortAllocError{Kind: ErrPortAllocInvalidInput, Msg: "invalid ip or protocol", IP: ip, Proto: proto}
+	}
+
+	key := portKey{ip: ip.Unmap(), proto: proto}
+	pp := pa.pools[key]
+	if pp == nil {
+		pp = pa.newPortPool()
+		pa.pools[key] = pp
+	}
+	return key, pp, nil
+}
+
+// own - Account a block or port to an owner. Caller must hold pa.mtx
+func (pa *PortAllocator) own(owner string, po portOwned) {
+	if pa.owned[owner] == nil {
+		pa.owned[owner] = make(map[portOwned]struct{})
+	}
+	pa.owned[owner][po] = struct{}{}
+}
+
+// disown - Drop a block or port of an owner. Caller must hold pa.mtx
+func (pa *PortAllocator) disown(owner string, po portOwned) {
+	delete(pa.owned[owner], po)
+	if len(pa.owned[owner]) == 0 {
+		delete(pa.owned, owner)
+	}
+}
+
+// AllocatePort - Allocate a single port of an IP address and protocol for an owner
+func (pa *PortAllocator) AllocatePort(ip netip.Addr, proto string, owner string) (uint16, error) {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	return pa.allocatePort(ip, proto, owner)
+}
+
+// allocatePort - Allocate a single port. Caller must hold pa.mtx
+func (pa *PortAllocator) allocatePort(ip netip.Addr, proto string, owner string) (uint16, error) {
+	key, pp, err := pa.getPortPool(ip, proto)
+	if err != nil {
+		return 0, err
+	}
+
+	var blks []uint64
+	for b, pb := range pp.single {
+		if pb.ports.CounterFree() > 0 {
+			blks = append(blks, b)
+		}
+	}
+	sort.Slice(blks, func(i, j int) bool { return blks[i] < blks[j] })
+
+	var pb *portBlock
+	if len(blks) > 0 {
+		pb = pp.single[blks[0]]
+	} else {
+		b, err := pp.blocks.GetCounter()
+		if err != nil {
+			err = &PortAllocError{Kind: ErrPortAllocExhausted, Msg: "ports exhausted", IP: key.ip, Proto: proto, Owner: owner}
+			return 0, errors.Join(err, pa.dropPortPool(key))
+		}
+		pb = pa.newPortBlock(b)
+		pp.single[b] = pb
+	}
+
+	port, err := pb.ports.GetCounter()
+	if err != nil {
+		return 0, &PortAllocError{Kind: ErrPortAllocExhausted, Msg: "port counter failure", IP: key.ip, Proto: proto, Owner: owner}
+	}
+	pb.used++
+	pp.ports[uint16(port)] = owner
+	pa.own(owner, portOwned{key: key, n: port})
+
+	return uint16(port), nil
+}
+
+// ReservePort - Don't allocate this port of an IP address and protocol and account it to an owner
+func (pa *PortAllocator) ReservePort(ip netip.Addr, proto string, owner string, port uint16) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	if port < pa.first || port > pa.last {
+		return &PortAllocError{Kind: ErrPortAllocOutOfBounds, Msg: "port out of bounds", IP: ip, Proto: proto, Port: port}
+	}
+	if pa.isReserved(port) {
+		return &PortAllocError{Kind: ErrPortAllocReserved, Msg: "port reserved", IP: ip, Proto: proto, Port: port}
+	}
+
+	key, pp, err := pa.getPortPool(ip, proto)
+	if err != nil {
+		return err
+	}
+
+	b := uint64(port-pa.first) / uint64(pa.blockSize)
+	pb := pp.single[b]
+	if pb == nil {
+		if pp.blocks.ReserveCounter(b) != nil {
+			err := &PortAllocError{Kind: ErrPortAllocInUse, Msg: "port block in use", IP: key.ip, Proto: proto, Owner: pp.owner[b], Port: port}
+			return errors.Join(err, pa.dropPortPool(key))
+		}
+		pb = pa.newPortBlock(b)
+		pp.single[b] = pb
+	}
+
+	if err := pb.ports.ReserveCounter(uint64(port)); err != nil {
+		if pb.used == 0 && !pb.fixed {
+			delete(pp.single, b)
+			pp.blocks.PutCounter(b)
+		}
+		err = &PortAllocError{Kind: ErrPortAllocInUse, Msg: "port in use", IP: key.ip, Proto: proto, Owner: pp.ports[port], Port: port}
+		return errors.Join(err, pa.dropPortPool(key))
+	}
+	pb.used++
+	pp.ports[port] = owner
+	pa.own(owner, portOwned{key: key, n: uint64(port)})
+
+	return nil
+}
+
+// ReleasePort - Return a single port of an owner
+func (pa *PortAllocator) ReleasePort(ip netip.Addr, proto string, owner string, port uint16) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	key := portKey{ip: ip.Unmap(), proto: proto}
+	pp := pa.pools[key]
+	if pp == nil {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port not allocated", IP: ip, Proto: proto, Owner: owner, Port: port}
+	}
+	if o, ok := pp.ports[port]; !ok || o != owner {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port not allocated to owner", IP: key.ip, Proto: proto, Owner: owner, Port: port}
+	}
+
+	return pa.releasePort(key, pp, port)
+}
+
+// releasePort - Return a single port. Caller must hold pa.mtx
+func (pa *PortAllocator) releasePort(key portKey, pp *portPool, port uint16) error {
+	b := uint64(port-pa.first) / uint64(pa.blockSize)
+	pb := pp.single[b]
+	if err := pb.ports.PutCounter(uint64(port)); err != nil {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port put counter failure", IP: key.ip, Proto: key.proto, Port: port}
+	}
+
+	pa.disown(pp.ports[port], portOwned{key: key, n: uint64(port)})
+	delete(pp.ports, port)
+	pb.used--
+	if pb.used == 0 && !pb.fixed {
+		delete(pp.single, b)
+		pp.blocks.PutCounter(b)
+	}
+
+	return pa.dropPortPool(key)
+}
+
+// AllocatePortBlock - Allocate a block of ports of an IP address and protocol for an owner
+func (pa *PortAllocator) AllocatePortBlock(ip netip.Addr, proto string, owner string) (PortRange, error) {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	return pa.allocatePortBlock(ip, proto, owner)
+}
+
+// allocatePortBlock - Allocate a block of ports. Caller must hold pa.mtx
+func (pa *PortAllocator) allocatePortBlock(ip netip.Addr, proto string, owner string) (PortRange, error) {
+	key, pp, err := pa.getPortPool(ip, proto)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	b, err := pp.blocks.GetCounter()
+	if err != nil {
+		err = &PortAllocError{Kind: ErrPortAllocExhausted, Msg: "port blocks exhausted", IP: key.ip, Proto: proto, Owner: owner}
+		return PortRange{}, errors.Join(err, pa.dropPortPool(key))
+	}
+	pp.owner[b] = owner
+	pa.own(owner, portOwned{key: key, block: true, n: b})
+
+	return pa.blockRange(b), nil
+}
+
+// ReleasePortBlock - Return a block of ports of an owner
+func (pa *PortAllocator) ReleasePortBlock(ip netip.Addr, proto string, owner string, block PortRange) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	key := portKey{ip: ip.Unmap(), proto: proto}
+	pp := pa.pools[key]
+	if pp == nil || block.Start < pa.first || block.Start > pa.last {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port block not allocated", IP: ip, Proto: proto, Owner: owner, Port: block.Start}
+	}
+
+	b := uint64(block.Start-pa.first) / uint64(pa.blockSize)
+	if o, ok := pp.owner[b]; !ok || o != owner || pa.blockRange(b) != block {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port block not allocated to owner", IP: key.ip, Proto: proto, Owner: owner, Port: block.Start}
+	}
+
+	return pa.releasePortBlock(key, pp, b)
+}
+
+// releasePortBlock - Return a block of ports. Caller must hold pa.mtx
+func (pa *PortAllocator) releasePortBlock(key portKey, pp *portPool, b uint64) error {
+	if err := pp.blocks.PutCounter(b); err != nil {
+		return &PortAllocError{Kind: ErrPortAllocNotAllocated, Msg: "port block put counter failure", IP: key.ip, Proto: key.proto, Port: pa.blockRange(b).Start}
+	}
+
+	pa.disown(pp.owner[b], portOwned{key: key, block: true, n: b})
+	delete(pp.owner, b)
+
+	return pa.dropPortPool(key)
+}
+
+// ReleaseOwner - Return all ports and blocks of an owner, like when its sessions drained
+func (pa *PortAllocator) ReleaseOwner(owner string) error {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	var errs []error
+	for po := range pa.owned[owner] {
+		pp := pa.pools[po.key]
+		if pp == nil {
+			continue
+		}
+
+		if po.block {
+			errs = append(errs, pa.releasePortBlock(po.key, pp, po.n))
+		} else {
+			errs = append(errs, pa.releasePort(po.key, pp, uint16(po.n)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// dropPortPool - Drop the ports of a key once none are in use, along with its SNAT
+// IP address once none of its ports are in use. Caller must hold pa.mtx
+func (pa *PortAllocator) dropPortPool(key portKey) error {
+	pp := pa.pools[key]
+	if pp == nil || len(pp.owner) != 0 || len(pp.ports) != 0 {
+		return nil
+	}
+	delete(pa.pools, key)
+	return pa.dropSNAT(key.ip)
+}
+
+// dropSNAT - Return an SNAT IP address to the IP allocator once none of its ports
+// are in use. It returns the error of the IP allocator, if any. Caller must hold pa.mtx
+func (pa *PortAllocator) dropSNAT(ip netip.Addr) error {
+	if _, ok := pa.snat[ip]; !ok {
+		return nil
+	}
+	for k := range pa.pools {
+		if k.ip == ip {
+			return nil
+		}
+	}
+	delete(pa.snat, ip)
+	return pa.ipa.DeAllocateAddrFromCluster(pa.cluster, IPAMNoIdent, ip)
+}
+
+// GetPortOwnerInfo - Get the number of blocks and single ports held by an owner
+func (pa *PortAllocator) GetPortOwnerInfo(owner string) PortOwnerInfo {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	info := PortOwnerInfo{Owner: owner}
+	for po := range pa.owned[owner] {
+		if po.block {
+			info.Blocks++
+		} else {
+			info.Ports++
+		}
+	}
+	return info
+}
+
+// GetPortUsage - Get the port usage of an IP address and protocol
+func (pa *PortAllocator) GetPortUsage(ip netip.Addr, proto string) PortUsageInfo {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	info := PortUsageInfo{IP: ip.Unmap(), Proto: proto}
+	pp := pa.pools[portKey{ip: info.IP, proto: proto}]
+	if pp == nil {
+		info.FreeBlocks = pa.newPortPool().blocks.CounterFree()
+		return info
+	}
+
+	info.Blocks = len(pp.owner)
+	info.FreeBlocks = pp.blocks.CounterFree()
+	info.Ports = len(pp.ports)
+	return info
+}
+
+// SetSNATCluster - Take the SNAT IP addresses of allocations without an IP address
+// from a cluster of an IP allocator. An SNAT IP address is allocated once the ones in
+// use have no ports left and returned to the IP allocator once none of its ports are in use
+func (pa *PortAllocator) SetSNATCluster(ipa *IPAllocator, cluster string) {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	pa.ipa = ipa
+	pa.cluster = cluster
+}
+
+// AllocateSNATPort - Allocate a single port for an owner on any SNAT IP address of the
+// given family. It returns the SNAT IP address along with the port
+func (pa *PortAllocator) AllocateSNATPort(v6 bool, proto string, owner string) (netip.Addr, uint16, error) {
+	var port uint16
+
+	ip, err := pa.allocateSNAT(v6, proto, owner, func(ip netip.Addr) (err error) {
+		port, err = pa.allocatePort(ip, proto, owner)
+		return err
+	})
+	return ip, port, err
+}
+
+// AllocateSNATPortBlock - Allocate a block of ports for an owner on any SNAT IP address
+// of the given family. It returns the SNAT IP address along with the block
+func (pa *PortAllocator) AllocateSNATPortBlock(v6 bool, proto string, owner string) (netip.Addr, PortRange, error) {
+	var block PortRange
+
+	ip, err := pa.allocateSNAT(v6, proto, owner, func(ip netip.Addr) (err error) {
+		block, err = pa.allocatePortBlock(ip, proto, owner)
+		return err
+	})
+	return ip, block, err
+}
+
+// allocateSNAT - Allocate ports on the lowest SNAT IP address in use which has some left,
+// else on a new SNAT IP address from the IP allocator
+func (pa *PortAllocator) allocateSNAT(v6 bool, proto string, owner string, alloc func(ip netip.Addr) error) (netip.Addr, error) {
+	pa.mtx.Lock()
+	defer pa.mtx.Unlock()
+
+	if pa.ipa == nil {
+		return netip.Addr{}, &PortAllocError{Kind: ErrPortAllocNoSNATPool, Msg: "no snat cluster", Proto: proto, Owner: owner}
+	}
+
+	ips := make([]netip.Addr, 0, len(pa.snat))
+	for ip := range pa.snat {
+		if ip.Is6() == v6 {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Less(ips[j]) })
+
+	for _, ip := range ips {
+		err := alloc(ip)
+		if err == nil {
+			return ip, nil
+		}
+		if !errors.Is(err, ErrPortAllocExhausted) {
+			return netip.Addr{}, err
+		}
+	}
+
+	ip, _, err := pa.ipa.AllocateAddrFromCluster(pa.cluster, v6, IPAMNoIdent)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip = ip.Unmap()
+	pa.snat[ip] = struct{}{}
+
+	if err := alloc(ip); err != nil {
+		return netip.Addr{}, errors.Join(err, pa.dropSNAT(ip))
+	}
+
+	return ip, nil
+}